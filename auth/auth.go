@@ -24,6 +24,33 @@ type Backend interface {
 	Close()
 }
 
+// UserInfo describes a publisher, used to fill stream metadata
+type UserInfo struct {
+	Username    string
+	DisplayName string
+	Description string
+}
+
+// InfoBackend is a backend able to describe its users.
+// Info returns the display name and the description of a user.
+type InfoBackend interface {
+	Info(string) (string, string, error)
+}
+
+// Info returns what the backend knows about a user.
+// It falls back to the username if the backend cannot describe users.
+func Info(backend Backend, username string) UserInfo {
+	info := UserInfo{Username: username}
+	if b, ok := backend.(InfoBackend); ok {
+		var err error
+		info.DisplayName, info.Description, err = b.Info(username)
+		if err != nil {
+			log.Printf("Failed to get user information for %s: %s", username, err)
+		}
+	}
+	return info
+}
+
 // New initialize authentification backend
 func New(cfg *Options) (Backend, error) {
 	var backend Backend
@@ -19,14 +19,20 @@ type LDAP struct {
 	Conn *ldap.Conn
 }
 
-// Login tries to bind to LDAP
-// Returns (true, nil) if success
-func (a LDAP) Login(username string, password string) (bool, error) {
-	// Resolve stream alias if necessary
+// resolveAlias returns the username a stream alias stands for
+func (a LDAP) resolveAlias(username string) string {
 	for aliasFor, ok := a.Cfg.Aliases[username]; ok; aliasFor, ok = a.Cfg.Aliases[username] {
 		log.Printf("[LDAP] Use stream alias %s for username %s", username, aliasFor)
 		username = aliasFor
 	}
+	return username
+}
+
+// Login tries to bind to LDAP
+// Returns (true, nil) if success
+func (a LDAP) Login(username string, password string) (bool, error) {
+	// Resolve stream alias if necessary
+	username = a.resolveAlias(username)
 
 	// Try to bind as user
 	bindDn := "cn=" + username + "," + a.Cfg.UserDn
@@ -36,6 +42,22 @@ func (a LDAP) Login(username string, password string) (bool, error) {
 	return err == nil, err
 }
 
+// Info reads displayName and description attributes of the user entry
+func (a LDAP) Info(username string) (string, string, error) {
+	username = a.resolveAlias(username)
+	req := ldap.NewSearchRequest(
+		"cn="+username+","+a.Cfg.UserDn,
+		ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, 0, false,
+		"(objectClass=*)", []string{"displayName", "description"}, nil,
+	)
+	res, err := a.Conn.Search(req)
+	if err != nil || len(res.Entries) < 1 {
+		return "", "", err
+	}
+	entry := res.Entries[0]
+	return entry.GetAttributeValue("displayName"), entry.GetAttributeValue("description"), nil
+}
+
 // Close LDAP connection
 func (a LDAP) Close() {
 	a.Conn.Close()
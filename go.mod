@@ -7,10 +7,14 @@ require (
 	github.com/gorilla/websocket v1.4.0
 	github.com/haivision/srtgo v0.0.0-20201025191851-67964e8f497a
 	github.com/markbates/pkger v0.17.1
-	github.com/pion/rtp v1.6.1
-	github.com/pion/webrtc/v3 v3.0.0-beta.10
+	github.com/pion/ice/v2 v2.3.2
+	github.com/pion/interceptor v0.1.12
+	github.com/pion/rtcp v1.2.10
+	github.com/pion/rtp v1.7.13
+	github.com/pion/turn/v2 v2.1.0
+	github.com/pion/webrtc/v3 v3.1.61
 	github.com/pkg/profile v1.5.0
 	github.com/prometheus/client_golang v1.7.1
 	github.com/sherifabdlnaby/configuro v0.0.2
-	golang.org/x/crypto v0.0.0-20200820211705-5c72a883971a
+	golang.org/x/crypto v0.6.0
 )
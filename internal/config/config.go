@@ -2,15 +2,22 @@
 package config
 
 import (
+	"fmt"
+	"gitlab.crans.org/nounous/ghostream/stream/dash"
+	"gitlab.crans.org/nounous/ghostream/stream/hls"
 	"gitlab.crans.org/nounous/ghostream/stream/ovenmediaengine"
 	"net"
+	"time"
 
 	"github.com/sherifabdlnaby/configuro"
 	"gitlab.crans.org/nounous/ghostream/auth"
 	"gitlab.crans.org/nounous/ghostream/auth/basic"
 	"gitlab.crans.org/nounous/ghostream/auth/ldap"
 	"gitlab.crans.org/nounous/ghostream/internal/monitoring"
+	"gitlab.crans.org/nounous/ghostream/messaging"
 	"gitlab.crans.org/nounous/ghostream/stream/forwarding"
+	"gitlab.crans.org/nounous/ghostream/stream/pull"
+	"gitlab.crans.org/nounous/ghostream/stream/rtmp"
 	"gitlab.crans.org/nounous/ghostream/stream/srt"
 	"gitlab.crans.org/nounous/ghostream/stream/telnet"
 	"gitlab.crans.org/nounous/ghostream/stream/webrtc"
@@ -22,9 +29,14 @@ import (
 // Config holds application configuration
 type Config struct {
 	Auth       auth.Options
+	DASH       dash.Options
 	Forwarding forwarding.Options
+	HLS        hls.Options
+	Messaging  messaging.Options
 	Monitoring monitoring.Options
 	OME        ovenmediaengine.Options
+	Pull       pull.Options
+	RTMP       rtmp.Options
 	Srt        srt.Options
 	Telnet     telnet.Options
 	Transcoder transcoder.Options
@@ -47,7 +59,22 @@ func New() *Config {
 				UserDn:  "cn=users,dc=example,dc=com",
 			},
 		},
+		DASH: dash.Options{
+			Enabled:         false,
+			SegmentDuration: 2 * time.Second,
+			WindowSize:      6,
+		},
 		Forwarding: make(map[string][]string),
+		HLS: hls.Options{
+			Enabled:         false,
+			SegmentDuration: 2 * time.Second,
+			PartDuration:    500 * time.Millisecond,
+			PlaylistSize:    6,
+		},
+		Messaging: messaging.Options{
+			GOPCacheSize: 16 * 1024 * 1024,
+			GracePeriod:  5 * time.Second,
+		},
 		Monitoring: monitoring.Options{
 			Enabled:       true,
 			ListenAddress: ":2112",
@@ -57,10 +84,16 @@ func New() *Config {
 			URL:     "ovenmediaengine:1915",
 			App:     "play",
 		},
+		Pull: make(map[string]string),
+		RTMP: rtmp.Options{
+			Enabled:       false,
+			ListenAddress: ":1935",
+		},
 		Srt: srt.Options{
 			Enabled:       true,
 			ListenAddress: ":9710",
 			MaxClients:    64,
+			Streams:       make(map[string]srt.StreamOptions),
 		},
 		Telnet: telnet.Options{
 			Enabled:       false,
@@ -94,6 +127,10 @@ func New() *Config {
 			MaxPortUDP:  11000,
 			MinPortUDP:  10000,
 			STUNServers: []string{"stun:stun.l.google.com:19302"},
+			WHIP:        true,
+
+			TURNListenAddress: ":3478",
+			TURNCredentialTTL: time.Hour,
 		},
 	}
 }
@@ -118,15 +155,43 @@ func Load() (*Config, error) {
 		return nil, err
 	}
 
-	// Copy STUN configuration to clients
-	cfg.Web.STUNServers = cfg.WebRTC.STUNServers
-
-	// Copy SRT server port to display it on web page
+	// Copy SRT server ports to display them on web page
 	_, srtPort, err := net.SplitHostPort(cfg.Srt.ListenAddress)
 	if err != nil {
 		return nil, err
 	}
 	cfg.Web.SRTServerPort = srtPort
+	cfg.Web.SRTStreamPorts = make(map[string]string)
+	for name, streamCfg := range cfg.Srt.Streams {
+		if err := checkStreamName(name); err != nil {
+			return nil, err
+		}
+		if streamCfg.ListenAddress == "" {
+			return nil, fmt.Errorf("SRT stream %s has no listen address", name)
+		}
+		_, port, err := net.SplitHostPort(streamCfg.ListenAddress)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Web.SRTStreamPorts[name] = port
+	}
+
+	// Users and pulled sources publish the stream with their name
+	for name := range cfg.Auth.Basic.Credentials {
+		if err := checkStreamName(name); err != nil {
+			return nil, err
+		}
+	}
+	for name := range cfg.Auth.LDAP.Aliases {
+		if err := checkStreamName(name); err != nil {
+			return nil, err
+		}
+	}
+	for name := range cfg.Pull {
+		if err := checkStreamName(name); err != nil {
+			return nil, err
+		}
+	}
 
 	// If no credentials register, add demo account with password "demo"
 	if len(cfg.Auth.Basic.Credentials) < 1 {
@@ -135,3 +200,12 @@ func Load() (*Config, error) {
 
 	return cfg, nil
 }
+
+// checkStreamName returns an error if a configured stream name is reserved,
+// /live.m3u is the playlist of every stream
+func checkStreamName(name string) error {
+	if name == "live" {
+		return fmt.Errorf("stream name %s is reserved", name)
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"os"
 	"testing"
 )
 
@@ -10,3 +11,30 @@ func TestLoad(t *testing.T) {
 		t.Error("Failed to load configuration:", err)
 	}
 }
+
+func TestLoadStreamWithoutListenAddress(t *testing.T) {
+	os.Setenv("GHOSTREAM_SRT_STREAMS_PRIVATE_PASSPHRASE", "a very long secret")
+	defer os.Unsetenv("GHOSTREAM_SRT_STREAMS_PRIVATE_PASSPHRASE")
+	if _, err := Load(); err == nil {
+		t.Error("Stream without listen address was loaded")
+	}
+
+	os.Setenv("GHOSTREAM_SRT_STREAMS_PRIVATE_LISTENADDRESS", ":9711")
+	defer os.Unsetenv("GHOSTREAM_SRT_STREAMS_PRIVATE_LISTENADDRESS")
+	cfg, err := Load()
+	if err != nil {
+		t.Fatal("Failed to load configuration:", err)
+	}
+	if cfg.Web.SRTStreamPorts["private"] != "9711" {
+		t.Errorf("Wrong SRT port of stream: %v", cfg.Web.SRTStreamPorts)
+	}
+}
+
+func TestLoadReservedStreamName(t *testing.T) {
+	// A stream named live would hide the playlist of every stream
+	os.Setenv("GHOSTREAM_SRT_STREAMS_LIVE_LISTENADDRESS", ":9712")
+	defer os.Unsetenv("GHOSTREAM_SRT_STREAMS_LIVE_LISTENADDRESS")
+	if _, err := Load(); err == nil {
+		t.Error("Stream with a reserved name was loaded")
+	}
+}
@@ -0,0 +1,65 @@
+// Package demux extracts media frames from the MPEG-TS and FLV streams
+// carried by messaging
+package demux
+
+// AAC sampling frequencies by index
+var aacSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// AACSamplesPerFrame is the number of samples of an AAC frame
+const AACSamplesPerFrame = 1024
+
+// AACConfig returns the sample rate and channel count of an AudioSpecificConfig.
+func AACConfig(config []byte) (sampleRate, channels int) {
+	if len(config) < 2 {
+		return 0, 0
+	}
+	index := int(config[0]&0x07)<<1 | int(config[1]>>7)
+	if index < len(aacSampleRates) {
+		sampleRate = aacSampleRates[index]
+	}
+	return sampleRate, int(config[1]>>3) & 0x0f
+}
+
+// ADTSHeader returns the ADTS header to put before a raw AAC frame.
+func ADTSHeader(config []byte, size int) []byte {
+	objectType, index, channels := byte(2), byte(4), byte(2)
+	if len(config) >= 2 {
+		objectType = config[0] >> 3
+		index = (config[0]&0x07)<<1 | config[1]>>7
+		channels = (config[1] >> 3) & 0x0f
+	}
+	length := size + 7
+	return []byte{
+		0xff, 0xf1, // MPEG-4, no CRC
+		(objectType-1)<<6 | index<<2 | channels>>2,
+		(channels&0x03)<<6 | byte(length>>11),
+		byte(length >> 3),
+		byte(length&0x07)<<5 | 0x1f,
+		0xfc,
+	}
+}
+
+// splitADTS splits ADTS frames and returns raw frames with their
+// AudioSpecificConfig.
+func splitADTS(b []byte) (frames [][]byte, config []byte) {
+	for len(b) >= 7 && b[0] == 0xff && b[1]&0xf0 == 0xf0 {
+		headerSize := 7
+		if b[1]&0x01 == 0 {
+			// CRC follows header
+			headerSize = 9
+		}
+		length := int(b[3]&0x03)<<11 | int(b[4])<<3 | int(b[5]>>5)
+		if length < headerSize || length > len(b) {
+			break
+		}
+		if config == nil {
+			objectType := b[2]>>6 + 1
+			index := (b[2] >> 2) & 0x0f
+			channels := (b[2]&0x01)<<2 | b[3]>>6
+			config = []byte{objectType<<3 | index>>1, (index&0x01)<<7 | channels<<3}
+		}
+		frames = append(frames, b[headerSize:length])
+		b = b[length:]
+	}
+	return frames, config
+}
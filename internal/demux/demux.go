@@ -0,0 +1,91 @@
+// Package demux extracts media frames from the MPEG-TS and FLV streams
+// carried by messaging
+package demux
+
+import (
+	"gitlab.crans.org/nounous/ghostream/internal/flv"
+	"gitlab.crans.org/nounous/ghostream/internal/mpegts"
+)
+
+// Frame is an access unit of an elementary stream.
+type Frame struct {
+	// Codec short name, such as "h264", "aac" or "opus"
+	Codec string
+
+	// Timestamps with a 90 kHz clock
+	PTS int64
+	DTS int64
+
+	// Keyframe is true on frames a decoder can start from
+	Keyframe bool
+
+	// H.264 frames are an Annex B byte stream with parameter sets before
+	// keyframes, AAC frames are raw without ADTS header.
+	Data []byte
+
+	// AudioSpecificConfig of AAC frames
+	Config []byte
+}
+
+// IsVideo returns true if the frame is a video frame.
+func (f *Frame) IsVideo() bool {
+	return IsVideoCodec(f.Codec)
+}
+
+// IsVideoCodec returns true if a codec name is a video codec.
+func IsVideoCodec(codec string) bool {
+	switch codec {
+	case "h264", "hevc", "mpeg2video", "vp8", "vp9", "av1":
+		return true
+	}
+	return false
+}
+
+type parser interface {
+	write(data []byte) []Frame
+	codecs() []string
+}
+
+// Demuxer follows a stream cut in arbitrary messages and returns its frames.
+type Demuxer struct {
+	// Parser is chosen when receiving the first message,
+	// it stays nil for unknown formats
+	parser  parser
+	started bool
+}
+
+// New creates a demuxer, stream format is detected on first message.
+func New() *Demuxer {
+	return &Demuxer{}
+}
+
+// Write consumes the next message and returns the completed frames.
+// Frames do not reference data.
+func (d *Demuxer) Write(data []byte) []Frame {
+	if len(data) == 0 {
+		return nil
+	}
+	if !d.started {
+		d.started = true
+		switch {
+		case data[0] == mpegts.SyncByte:
+			d.parser = newTSDemuxer()
+		case flv.IsHeader(data):
+			d.parser = &flvDemuxer{}
+		}
+	}
+	if d.parser == nil {
+		return nil
+	}
+	return d.parser.write(data)
+}
+
+// Codecs returns the codecs of the elementary streams found so far,
+// video first. Streams are declared in MPEG-TS program tables, they are
+// found on sequence headers or first frames in FLV.
+func (d *Demuxer) Codecs() []string {
+	if d.parser == nil {
+		return nil
+	}
+	return d.parser.codecs()
+}
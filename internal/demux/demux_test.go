@@ -0,0 +1,127 @@
+package demux
+
+import (
+	"bytes"
+	"testing"
+
+	"gitlab.crans.org/nounous/ghostream/internal/mpegts"
+)
+
+var (
+	sps = []byte{0x67, 0x42, 0xc0, 0x28, 0xf4, 0x03, 0xc0, 0x11, 0x3f, 0x2a}
+	pps = []byte{0x68, 0xce, 0x3c, 0x80}
+	idr = append([]byte{0x65}, bytes.Repeat([]byte{42}, 400)...)
+)
+
+// writeSplit feeds the demuxer with messages of n bytes
+func writeSplit(d *Demuxer, data []byte, n int) (frames []Frame) {
+	for len(data) > 0 {
+		if n > len(data) {
+			n = len(data)
+		}
+		frames = append(frames, d.Write(data[:n])...)
+		data = data[n:]
+	}
+	return frames
+}
+
+func TestDemuxTS(t *testing.T) {
+	buff := &bytes.Buffer{}
+	muxer := mpegts.NewMuxer(buff)
+	videoPID := muxer.AddStream(mpegts.StreamTypeH264, nil)
+	audioPID := muxer.AddStream(mpegts.StreamTypeADTSAAC, nil)
+	config := []byte{0x12, 0x10} // AAC LC, 44.1 kHz, stereo
+
+	annexB := []byte{0, 0, 0, 1}
+	annexB = append(annexB, sps...)
+	annexB = append(annexB, 0, 0, 0, 1)
+	annexB = append(annexB, idr...)
+	muxer.WritePES(videoPID, 3600, 0, true, annexB)
+	adts := append(ADTSHeader(config, 3), 1, 2, 3)
+	adts = append(adts, ADTSHeader(config, 2)...)
+	adts = append(adts, 4, 5)
+	muxer.WritePES(audioPID, 9000, 9000, false, adts)
+	muxer.WritePES(videoPID, 7200, 3600, false, []byte{0, 0, 0, 1, 0x41, 1})
+
+	d := New()
+	frames := writeSplit(d, buff.Bytes(), 100)
+	if len(frames) != 3 {
+		t.Fatalf("Demuxed %d frames instead of 3: %v", len(frames), frames)
+	}
+	if codecs := d.Codecs(); len(codecs) != 2 || codecs[0] != "h264" || codecs[1] != "aac" {
+		t.Errorf("Wrong codecs %v", codecs)
+	}
+
+	// Audio is complete once its PES length is reached,
+	// video when next video PES starts
+	if f := frames[2]; f.Codec != "h264" || !f.Keyframe || f.PTS != 3600 || f.DTS != 0 || !bytes.Equal(f.Data, annexB) {
+		t.Errorf("Wrong video frame %v", f)
+	}
+	if f := frames[0]; f.Codec != "aac" || f.PTS != 9000 || !bytes.Equal(f.Data, []byte{1, 2, 3}) || !bytes.Equal(f.Config, config) {
+		t.Errorf("Wrong first audio frame %v", f)
+	}
+	if f := frames[1]; f.PTS != 9000+1024*90000/44100 || !bytes.Equal(f.Data, []byte{4, 5}) {
+		t.Errorf("Wrong second audio frame %v", f)
+	}
+}
+
+func TestDemuxFLV(t *testing.T) {
+	tag := func(tagType byte, timestamp int, data []byte) []byte {
+		size := len(data)
+		b := []byte{tagType, byte(size >> 16), byte(size >> 8), byte(size), 0, byte(timestamp >> 8), byte(timestamp), 0, 0, 0, 0}
+		b = append(b, data...)
+		return append(b, 0, 0, 0, byte(size+11))
+	}
+	stream := []byte{'F', 'L', 'V', 1, 5, 0, 0, 0, 9, 0, 0, 0, 0}
+
+	// AVC sequence header with one SPS and one PPS
+	record := []byte{0x17, 0, 0, 0, 0, 1, 0x42, 0xc0, 0x28, 0xff, 0xe1, 0, byte(len(sps))}
+	record = append(record, sps...)
+	record = append(record, 1, 0, byte(len(pps)))
+	record = append(record, pps...)
+	stream = append(stream, tag(9, 0, record)...)
+
+	// Keyframe with composition time
+	video := []byte{0x17, 1, 0, 0, 40, 0, 0, byte(len(idr) >> 8), byte(len(idr))}
+	stream = append(stream, tag(9, 80, append(video, idr...))...)
+
+	// AAC
+	stream = append(stream, tag(8, 0, []byte{0xaf, 0, 0x12, 0x10})...)
+	stream = append(stream, tag(8, 100, []byte{0xaf, 1, 1, 2, 3})...)
+
+	d := New()
+	frames := writeSplit(d, stream, 7)
+	if len(frames) != 2 {
+		t.Fatalf("Demuxed %d frames instead of 2: %v", len(frames), frames)
+	}
+	if codecs := d.Codecs(); len(codecs) != 2 || codecs[0] != "h264" || codecs[1] != "aac" {
+		t.Errorf("Wrong codecs %v", codecs)
+	}
+
+	expected := []byte{0, 0, 0, 1}
+	expected = append(expected, sps...)
+	expected = append(expected, 0, 0, 0, 1)
+	expected = append(expected, pps...)
+	expected = append(expected, 0, 0, 0, 1)
+	expected = append(expected, idr...)
+	if f := frames[0]; f.Codec != "h264" || !f.Keyframe || f.DTS != 80*90 || f.PTS != 120*90 || !bytes.Equal(f.Data, expected) {
+		t.Errorf("Wrong video frame %v", f)
+	}
+	if f := frames[1]; f.Codec != "aac" || f.PTS != 100*90 || !bytes.Equal(f.Data, []byte{1, 2, 3}) || !bytes.Equal(f.Config, []byte{0x12, 0x10}) {
+		t.Errorf("Wrong audio frame %v", f)
+	}
+	if rate, channels := AACConfig(frames[1].Config); rate != 44100 || channels != 2 {
+		t.Errorf("Wrong AAC configuration %d Hz, %d channels", rate, channels)
+	}
+}
+
+func TestOpusDuration(t *testing.T) {
+	// CELT 20 ms, one frame
+	if d := OpusDuration([]byte{31 << 3}); d != 1800 {
+		t.Errorf("Opus packet lasts %d instead of 1800", d)
+	}
+	// SILK 60 ms, three frames
+	if d := OpusDuration([]byte{3<<3 | 3, 3}); d != 3*5400 {
+		t.Errorf("Opus packet lasts %d instead of %d", d, 3*5400)
+	}
+}
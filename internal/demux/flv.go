@@ -0,0 +1,185 @@
+// Package demux extracts media frames from the MPEG-TS and FLV streams
+// carried by messaging
+package demux
+
+import (
+	"gitlab.crans.org/nounous/ghostream/internal/flv"
+	"gitlab.crans.org/nounous/ghostream/internal/h264"
+)
+
+// flvDemuxer extracts frames from FLV tags
+type flvDemuxer struct {
+	// Bytes of incomplete file header or tag
+	buff []byte
+
+	// File header was read
+	started bool
+
+	// Parameter sets and NAL unit length size from AVC sequence header
+	sps, pps   [][]byte
+	lengthSize int
+
+	// AudioSpecificConfig from AAC sequence header
+	aacConfig []byte
+
+	// Codecs found in tags
+	videoCodec, audioCodec string
+}
+
+func (d *flvDemuxer) write(data []byte) (frames []Frame) {
+	d.buff = append(d.buff, data...)
+	b := d.buff
+	for {
+		if !d.started {
+			if len(b) < flv.HeaderSize {
+				break
+			}
+			b = b[flv.HeaderSize:]
+			d.started = true
+			continue
+		}
+		if len(b) < flv.TagHeaderSize {
+			break
+		}
+		h := flv.ParseTagHeader(b)
+		if len(b) < h.Size() {
+			break
+		}
+		frames = append(frames, d.tag(h, b[flv.TagHeaderSize:flv.TagHeaderSize+h.DataSize])...)
+		b = b[h.Size():]
+	}
+
+	// Keep incomplete bytes in a new buffer
+	d.buff = append([]byte(nil), b...)
+	return frames
+}
+
+// tag converts an audio or video tag to frames.
+func (d *flvDemuxer) tag(h flv.TagHeader, data []byte) []Frame {
+	ts := int64(h.Timestamp) * 90
+	switch h.Type {
+	case flv.TagTypeVideo:
+		if len(data) < 5 || data[0]&0x0f != flv.CodecIDAVC {
+			return nil
+		}
+		d.videoCodec = "h264"
+		if data[1] == 0 {
+			d.parseAVCConfig(data[5:])
+			return nil
+		}
+		if data[1] != 1 || d.lengthSize == 0 {
+			return nil
+		}
+
+		// Composition time is a signed 24-bit offset
+		cts := int64(int32(uint32(data[2])<<24|uint32(data[3])<<16|uint32(data[4])<<8) >> 8)
+		keyframe := data[0]>>4 == 1
+		return []Frame{{
+			Codec:    "h264",
+			PTS:      ts + cts*90,
+			DTS:      ts,
+			Keyframe: keyframe,
+			Data:     d.annexB(data[5:], keyframe),
+		}}
+	case flv.TagTypeAudio:
+		codec := flv.AudioCodecName(data)
+		if codec == "aac" || codec == "mp3" {
+			d.audioCodec = codec
+		}
+		switch {
+		case codec == "aac" && len(data) >= 2:
+			if data[1] == 0 {
+				d.aacConfig = append([]byte(nil), data[2:]...)
+				return nil
+			}
+			if d.aacConfig == nil {
+				return nil
+			}
+			raw := append([]byte(nil), data[2:]...)
+			return []Frame{{Codec: codec, PTS: ts, DTS: ts, Keyframe: true, Data: raw, Config: d.aacConfig}}
+		case codec == "mp3":
+			raw := append([]byte(nil), data[1:]...)
+			return []Frame{{Codec: codec, PTS: ts, DTS: ts, Keyframe: true, Data: raw}}
+		}
+	}
+	return nil
+}
+
+func (d *flvDemuxer) codecs() (codecs []string) {
+	for _, codec := range []string{d.videoCodec, d.audioCodec} {
+		if codec != "" {
+			codecs = append(codecs, codec)
+		}
+	}
+	return codecs
+}
+
+// parseAVCConfig reads an AVCDecoderConfigurationRecord.
+func (d *flvDemuxer) parseAVCConfig(record []byte) {
+	if len(record) < 6 {
+		return
+	}
+	d.lengthSize = int(record[4]&0x03) + 1
+	d.sps, d.pps = nil, nil
+	i := 6
+	for n := int(record[5] & 0x1f); n > 0 && i+2 <= len(record); n-- {
+		size := int(record[i])<<8 | int(record[i+1])
+		if i+2+size > len(record) {
+			return
+		}
+		d.sps = append(d.sps, append([]byte(nil), record[i+2:i+2+size]...))
+		i += 2 + size
+	}
+	if i >= len(record) {
+		return
+	}
+	n := int(record[i])
+	i++
+	for ; n > 0 && i+2 <= len(record); n-- {
+		size := int(record[i])<<8 | int(record[i+1])
+		if i+2+size > len(record) {
+			return
+		}
+		d.pps = append(d.pps, append([]byte(nil), record[i+2:i+2+size]...))
+		i += 2 + size
+	}
+}
+
+// annexB converts length prefixed NAL units to an Annex B byte stream.
+// Parameter sets are added before keyframes if they are not in band.
+func (d *flvDemuxer) annexB(b []byte, keyframe bool) []byte {
+	out := make([]byte, 0, len(b)+64)
+	startCode := []byte{0, 0, 0, 1}
+	inBand := false
+	var nalus [][]byte
+	for len(b) >= d.lengthSize {
+		size := 0
+		for _, c := range b[:d.lengthSize] {
+			size = size<<8 | int(c)
+		}
+		b = b[d.lengthSize:]
+		if size > len(b) {
+			break
+		}
+		if size > 0 && b[0]&0x1f == h264.NALUTypeSPS {
+			inBand = true
+		}
+		nalus = append(nalus, b[:size])
+		b = b[size:]
+	}
+	if keyframe && !inBand {
+		for _, ps := range d.sps {
+			out = append(out, startCode...)
+			out = append(out, ps...)
+		}
+		for _, ps := range d.pps {
+			out = append(out, startCode...)
+			out = append(out, ps...)
+		}
+	}
+	for _, nalu := range nalus {
+		out = append(out, startCode...)
+		out = append(out, nalu...)
+	}
+	return out
+}
@@ -0,0 +1,68 @@
+// Package demux extracts media frames from the MPEG-TS and FLV streams
+// carried by messaging
+package demux
+
+// OpusDuration returns the duration of an Opus packet with a 90 kHz clock.
+func OpusDuration(packet []byte) int64 {
+	if len(packet) < 1 {
+		return 0
+	}
+	toc := packet[0]
+
+	// Frame duration in tenth of milliseconds, from configuration number
+	var frame int64
+	switch config := toc >> 3; {
+	case config < 12:
+		frame = []int64{100, 200, 400, 600}[config&0x03]
+	case config < 16:
+		frame = []int64{100, 200}[config&0x01]
+	default:
+		frame = []int64{25, 50, 100, 200}[config&0x03]
+	}
+
+	count := int64(1)
+	switch toc & 0x03 {
+	case 1, 2:
+		count = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0
+		}
+		count = int64(packet[1] & 0x3f)
+	}
+	return count * frame * 9
+}
+
+// splitOpus removes control headers of Opus packets in a PES payload.
+func splitOpus(b []byte) (packets [][]byte) {
+	for len(b) >= 2 && b[0] == 0x7f && b[1]&0xe0 == 0xe0 {
+		flags := b[1]
+		i := 2
+		size := 0
+		for i < len(b) {
+			size += int(b[i])
+			i++
+			if b[i-1] != 0xff {
+				break
+			}
+		}
+		if flags&0x10 != 0 {
+			// Start trim
+			i += 2
+		}
+		if flags&0x08 != 0 {
+			// End trim
+			i += 2
+		}
+		if flags&0x04 != 0 && i < len(b) {
+			// Control extension
+			i += 1 + int(b[i])
+		}
+		if i+size > len(b) {
+			break
+		}
+		packets = append(packets, b[i:i+size])
+		b = b[i+size:]
+	}
+	return packets
+}
@@ -0,0 +1,195 @@
+// Package demux extracts media frames from the MPEG-TS and FLV streams
+// carried by messaging
+package demux
+
+import (
+	"sort"
+
+	"gitlab.crans.org/nounous/ghostream/internal/h264"
+	"gitlab.crans.org/nounous/ghostream/internal/mpegts"
+)
+
+// tsDemuxer extracts frames from PES packets of a MPEG transport stream
+type tsDemuxer struct {
+	// Incomplete packet from previous message
+	partial []byte
+
+	pmtPID  uint16
+	streams map[uint16]*pesBuffer
+}
+
+// pesBuffer collects a PES packet of an elementary stream
+type pesBuffer struct {
+	codec        string
+	data         []byte
+	randomAccess bool
+}
+
+func newTSDemuxer() *tsDemuxer {
+	return &tsDemuxer{streams: make(map[uint16]*pesBuffer)}
+}
+
+func (d *tsDemuxer) write(data []byte) (frames []Frame) {
+	i := 0
+
+	// Complete packet from previous message
+	if len(d.partial) > 0 {
+		n := mpegts.PacketSize - len(d.partial)
+		if n > len(data) {
+			d.partial = append(d.partial, data...)
+			return nil
+		}
+		d.partial = append(d.partial, data[:n]...)
+		frames = append(frames, d.packet(d.partial)...)
+		d.partial = d.partial[:0]
+		i = n
+	}
+
+	for i < len(data) {
+		if data[i] != mpegts.SyncByte {
+			// Lost synchronization
+			i++
+			continue
+		}
+		if i+mpegts.PacketSize > len(data) {
+			d.partial = append(d.partial, data[i:]...)
+			break
+		}
+		frames = append(frames, d.packet(data[i:i+mpegts.PacketSize])...)
+		i += mpegts.PacketSize
+	}
+	return frames
+}
+
+// packet follows program tables and collects PES packets.
+func (d *tsDemuxer) packet(pkt []byte) []Frame {
+	pid := mpegts.PID(pkt)
+	switch {
+	case pid == mpegts.PATPID:
+		if pmtPID, ok := mpegts.ParsePAT(pkt); ok {
+			d.pmtPID = pmtPID
+		}
+		return nil
+	case pid == d.pmtPID && d.pmtPID != 0:
+		if streams, ok := mpegts.ParsePMT(pkt); ok {
+			d.updateStreams(streams)
+		}
+		return nil
+	}
+
+	s, ok := d.streams[pid]
+	if !ok {
+		return nil
+	}
+	payload := mpegts.Payload(pkt)
+	var frames []Frame
+	if mpegts.PayloadUnitStart(pkt) {
+		// Previous PES packet is complete
+		frames = s.flush()
+		s.data = append(make([]byte, 0, 4*mpegts.PacketSize), payload...)
+		s.randomAccess = mpegts.RandomAccess(pkt)
+	} else if s.data != nil {
+		s.data = append(s.data, payload...)
+	}
+
+	// Do not wait for next packet when PES length is known
+	if len(s.data) >= 6 {
+		length := int(s.data[4])<<8 | int(s.data[5])
+		if length > 0 && len(s.data) >= 6+length {
+			frames = append(frames, s.flush()...)
+		}
+	}
+	return frames
+}
+
+// updateStreams keeps streams with a known codec.
+func (d *tsDemuxer) updateStreams(streams []mpegts.ElementaryStream) {
+	updated := make(map[uint16]*pesBuffer)
+	for _, es := range streams {
+		codec := es.Codec()
+		if codec == "" {
+			continue
+		}
+		if s, ok := d.streams[es.PID]; ok && s.codec == codec {
+			updated[es.PID] = s
+			continue
+		}
+		updated[es.PID] = &pesBuffer{codec: codec}
+	}
+	d.streams = updated
+}
+
+func (d *tsDemuxer) codecs() []string {
+	var video, audio []string
+	for _, s := range d.streams {
+		if IsVideoCodec(s.codec) {
+			video = append(video, s.codec)
+		} else {
+			audio = append(audio, s.codec)
+		}
+	}
+	sort.Strings(video)
+	sort.Strings(audio)
+	return append(video, audio...)
+}
+
+// flush parses the collected PES packet.
+func (s *pesBuffer) flush() []Frame {
+	data := s.data
+	s.data = nil
+	if len(data) < 9 || data[0] != 0 || data[1] != 0 || data[2] != 1 {
+		return nil
+	}
+	if length := int(data[4])<<8 | int(data[5]); length > 0 && 6+length < len(data) {
+		data = data[:6+length]
+	}
+
+	// Timestamps
+	flags := data[7] >> 6
+	headerSize := 9 + int(data[8])
+	if headerSize > len(data) || flags&0x02 == 0 || len(data) < 14 {
+		return nil
+	}
+	pts := parseTimestamp(data[9:])
+	dts := pts
+	if flags == 0x03 && len(data) >= 19 {
+		dts = parseTimestamp(data[14:])
+	}
+	es := data[headerSize:]
+
+	switch s.codec {
+	case "h264":
+		keyframe := s.randomAccess || h264.IsKeyframe(es)
+		return []Frame{{Codec: s.codec, PTS: pts, DTS: dts, Keyframe: keyframe, Data: es}}
+	case "aac":
+		raw, config := splitADTS(es)
+		sampleRate, _ := AACConfig(config)
+		if sampleRate == 0 {
+			return nil
+		}
+		frames := make([]Frame, len(raw))
+		for i, r := range raw {
+			ts := pts + int64(i)*AACSamplesPerFrame*90000/int64(sampleRate)
+			frames[i] = Frame{Codec: s.codec, PTS: ts, DTS: ts, Keyframe: true, Data: r, Config: config}
+		}
+		return frames
+	case "opus":
+		packets := splitOpus(es)
+		frames := make([]Frame, len(packets))
+		for i, p := range packets {
+			frames[i] = Frame{Codec: s.codec, PTS: pts, DTS: pts, Keyframe: true, Data: p}
+			pts += OpusDuration(p)
+		}
+		return frames
+	}
+
+	// Other codecs are passed as is, audio frames are all keyframes
+	f := Frame{Codec: s.codec, PTS: pts, DTS: dts, Data: es}
+	f.Keyframe = s.randomAccess || !f.IsVideo()
+	return []Frame{f}
+}
+
+// parseTimestamp parses a 33-bit PES timestamp.
+func parseTimestamp(b []byte) int64 {
+	return int64(b[0]>>1&0x07)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)
+}
@@ -0,0 +1,162 @@
+// Package flv provides helpers to inspect FLV streams
+package flv
+
+const (
+	// HeaderSize is the size of the FLV file header followed by the first
+	// previous tag size field
+	HeaderSize = 9 + 4
+
+	// TagHeaderSize is the size of a FLV tag header
+	TagHeaderSize = 11
+)
+
+// Tag types
+const (
+	TagTypeAudio  = 8
+	TagTypeVideo  = 9
+	TagTypeScript = 18
+)
+
+// Video codec identifiers
+const (
+	CodecIDH263 = 2
+	CodecIDVP6  = 4
+	CodecIDAVC  = 7
+)
+
+// Audio codec identifiers
+const (
+	SoundFormatMP3   = 2
+	SoundFormatAAC   = 10
+	SoundFormatSpeex = 11
+)
+
+// IsHeader returns true if the data starts with a FLV file header.
+func IsHeader(b []byte) bool {
+	return len(b) >= 3 && b[0] == 'F' && b[1] == 'L' && b[2] == 'V'
+}
+
+// TagHeader holds the header of a FLV tag.
+type TagHeader struct {
+	Type      byte
+	DataSize  int
+	Timestamp uint32
+}
+
+// ParseTagHeader parses the 11 bytes of a tag header.
+func ParseTagHeader(b []byte) TagHeader {
+	return TagHeader{
+		Type:      b[0] & 0x1f,
+		DataSize:  int(b[1])<<16 | int(b[2])<<8 | int(b[3]),
+		Timestamp: uint32(b[7])<<24 | uint32(b[4])<<16 | uint32(b[5])<<8 | uint32(b[6]),
+	}
+}
+
+// Size returns the size of the tag including its header and trailing previous
+// tag size field.
+func (h TagHeader) Size() int {
+	return TagHeaderSize + h.DataSize + 4
+}
+
+// IsVideoKeyframe returns true if the video tag data (first bytes after the tag
+// header) starts a keyframe which is not a codec configuration record.
+func IsVideoKeyframe(data []byte) bool {
+	if len(data) < 1 || data[0]>>4 != 1 {
+		return false
+	}
+	if data[0]&0x0f == CodecIDAVC {
+		// AVC sequence header is not a picture
+		return len(data) >= 2 && data[1] == 1
+	}
+	return true
+}
+
+// IsSequenceHeader returns true if the audio or video tag data is a codec
+// configuration record that every decoder needs.
+func IsSequenceHeader(tagType byte, data []byte) bool {
+	switch tagType {
+	case TagTypeVideo:
+		return len(data) >= 2 && data[0]&0x0f == CodecIDAVC && data[1] == 0
+	case TagTypeAudio:
+		return len(data) >= 2 && data[0]>>4 == SoundFormatAAC && data[1] == 0
+	}
+	return false
+}
+
+// VideoCodecName returns a short name of the codec of video tag data,
+// or an empty string if it is unknown.
+func VideoCodecName(data []byte) string {
+	if len(data) < 1 {
+		return ""
+	}
+	switch data[0] & 0x0f {
+	case CodecIDH263:
+		return "h263"
+	case CodecIDVP6:
+		return "vp6"
+	case CodecIDAVC:
+		return "h264"
+	}
+	return ""
+}
+
+// AudioCodecName returns a short name of the codec of audio tag data,
+// or an empty string if it is unknown.
+func AudioCodecName(data []byte) string {
+	if len(data) < 1 {
+		return ""
+	}
+	switch data[0] >> 4 {
+	case SoundFormatMP3:
+		return "mp3"
+	case SoundFormatAAC:
+		return "aac"
+	case SoundFormatSpeex:
+		return "speex"
+	}
+	return ""
+}
+
+// AVCSequenceHeaderSPS returns the first sequence parameter set of an AVC
+// sequence header video tag data, or nil.
+func AVCSequenceHeaderSPS(data []byte) []byte {
+	if len(data) < 5+8 || !IsSequenceHeader(TagTypeVideo, data) {
+		return nil
+	}
+
+	// Skip video tag header then AVCDecoderConfigurationRecord header
+	record := data[5:]
+	if record[5]&0x1f < 1 {
+		return nil
+	}
+	size := int(record[6])<<8 | int(record[7])
+	if 8+size > len(record) {
+		return nil
+	}
+	return record[8 : 8+size]
+}
+
+// Header returns a FLV file header followed by the first previous tag size.
+func Header(audio, video bool) []byte {
+	var flags byte
+	if audio {
+		flags |= 4
+	}
+	if video {
+		flags |= 1
+	}
+	return []byte{'F', 'L', 'V', 1, flags, 0, 0, 0, 9, 0, 0, 0, 0}
+}
+
+// Tag returns a FLV tag with its trailing previous tag size.
+// Timestamp is in milliseconds.
+func Tag(tagType byte, timestamp uint32, data []byte) []byte {
+	size := len(data)
+	tag := make([]byte, 0, TagHeaderSize+size+4)
+	tag = append(tag, tagType, byte(size>>16), byte(size>>8), byte(size))
+	tag = append(tag, byte(timestamp>>16), byte(timestamp>>8), byte(timestamp), byte(timestamp>>24))
+	tag = append(tag, 0, 0, 0)
+	tag = append(tag, data...)
+	tagSize := uint32(TagHeaderSize + size)
+	return append(tag, byte(tagSize>>24), byte(tagSize>>16), byte(tagSize>>8), byte(tagSize))
+}
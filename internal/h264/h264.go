@@ -0,0 +1,279 @@
+// Package h264 provides helpers to inspect H.264 bitstreams
+package h264
+
+import (
+	"errors"
+	"fmt"
+)
+
+// NAL unit types
+const (
+	NALUTypeIDR = 5
+	NALUTypeSEI = 6
+	NALUTypeSPS = 7
+	NALUTypePPS = 8
+	NALUTypeAUD = 9
+)
+
+// SplitAnnexB splits an Annex B byte stream into NAL units, without start codes.
+func SplitAnnexB(b []byte) (nalus [][]byte) {
+	start := -1
+	i := 0
+	for i+2 < len(b) {
+		// Look for 0x000001 start code
+		if b[i] != 0 || b[i+1] != 0 || b[i+2] != 1 {
+			i++
+			continue
+		}
+		if start >= 0 {
+			end := i
+			// Remove leading zero of 4-byte start code
+			for end > start && b[end-1] == 0 {
+				end--
+			}
+			nalus = append(nalus, b[start:end])
+		}
+		i += 3
+		start = i
+	}
+	if start >= 0 && start < len(b) {
+		nalus = append(nalus, b[start:])
+	}
+	return nalus
+}
+
+// IsKeyframe returns true if the Annex B byte stream contains an IDR picture
+// or a sequence parameter set.
+func IsKeyframe(b []byte) bool {
+	for _, nalu := range SplitAnnexB(b) {
+		if len(nalu) < 1 {
+			continue
+		}
+		switch nalu[0] & 0x1f {
+		case NALUTypeIDR, NALUTypeSPS:
+			return true
+		}
+	}
+	return false
+}
+
+// ToAVCC converts an Annex B access unit to NAL units prefixed with their
+// 4-byte length, as in MP4 and FLV, without access unit delimiters.
+func ToAVCC(annexB []byte) []byte {
+	var out []byte
+	for _, nalu := range SplitAnnexB(annexB) {
+		if len(nalu) == 0 || nalu[0]&0x1f == NALUTypeAUD {
+			continue
+		}
+		size := len(nalu)
+		out = append(out, byte(size>>24), byte(size>>16), byte(size>>8), byte(size))
+		out = append(out, nalu...)
+	}
+	return out
+}
+
+// ParameterSets returns the first SPS and PPS of an Annex B access unit.
+func ParameterSets(annexB []byte) (sps, pps []byte) {
+	for _, nalu := range SplitAnnexB(annexB) {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch nalu[0] & 0x1f {
+		case NALUTypeSPS:
+			if sps == nil {
+				sps = nalu
+			}
+		case NALUTypePPS:
+			if pps == nil {
+				pps = nalu
+			}
+		}
+	}
+	return sps, pps
+}
+
+// DecoderConfig returns the AVCDecoderConfigurationRecord of a SPS and a PPS,
+// with 4-byte NAL unit lengths.
+func DecoderConfig(sps, pps []byte) []byte {
+	record := []byte{1, sps[1], sps[2], sps[3], 0xff, 0xe1, byte(len(sps) >> 8), byte(len(sps))}
+	record = append(record, sps...)
+	record = append(record, 1, byte(len(pps)>>8), byte(len(pps)))
+	return append(record, pps...)
+}
+
+// SPS holds the fields of a sequence parameter set ghostream needs.
+type SPS struct {
+	ProfileIDC      byte
+	ConstraintFlags byte
+	LevelIDC        byte
+	Width           int
+	Height          int
+}
+
+// ProfileLevelID returns the profile-level-id of the sequence, as in SDP.
+func (sps SPS) ProfileLevelID() string {
+	return fmt.Sprintf("%02x%02x%02x", sps.ProfileIDC, sps.ConstraintFlags, sps.LevelIDC)
+}
+
+// bitReader reads Exp-Golomb coded fields
+type bitReader struct {
+	b   []byte
+	pos int
+	err error
+}
+
+func (r *bitReader) bit() uint {
+	if r.pos >= 8*len(r.b) {
+		r.err = errors.New("sequence parameter set is truncated")
+		return 0
+	}
+	v := uint(r.b[r.pos/8]>>(7-r.pos%8)) & 1
+	r.pos++
+	return v
+}
+
+func (r *bitReader) bits(n int) uint {
+	var v uint
+	for i := 0; i < n; i++ {
+		v = v<<1 | r.bit()
+	}
+	return v
+}
+
+// ue reads an unsigned Exp-Golomb code
+func (r *bitReader) ue() uint {
+	zeros := 0
+	for r.bit() == 0 && r.err == nil {
+		zeros++
+		if zeros > 31 {
+			r.err = errors.New("invalid Exp-Golomb code")
+			return 0
+		}
+	}
+	return 1<<uint(zeros) - 1 + r.bits(zeros)
+}
+
+// se reads a signed Exp-Golomb code
+func (r *bitReader) se() int {
+	v := r.ue()
+	if v%2 == 0 {
+		return -int(v / 2)
+	}
+	return int(v/2 + 1)
+}
+
+// removeEmulationPrevention removes 0x03 bytes following two zero bytes.
+func removeEmulationPrevention(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	zeros := 0
+	for _, c := range b {
+		if zeros >= 2 && c == 3 {
+			zeros = 0
+			continue
+		}
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// ParseSPS parses a sequence parameter set NAL unit, including its header byte.
+func ParseSPS(nalu []byte) (sps SPS, err error) {
+	if len(nalu) < 4 || nalu[0]&0x1f != NALUTypeSPS {
+		return sps, errors.New("not a sequence parameter set")
+	}
+	r := &bitReader{b: removeEmulationPrevention(nalu[1:])}
+	sps.ProfileIDC = byte(r.bits(8))
+	sps.ConstraintFlags = byte(r.bits(8))
+	sps.LevelIDC = byte(r.bits(8))
+	r.ue() // seq_parameter_set_id
+
+	chromaFormatIDC := uint(1)
+	switch sps.ProfileIDC {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormatIDC = r.ue()
+		if chromaFormatIDC == 3 {
+			r.bit() // separate_colour_plane_flag
+		}
+		r.ue()  // bit_depth_luma_minus8
+		r.ue()  // bit_depth_chroma_minus8
+		r.bit() // qpprime_y_zero_transform_bypass_flag
+		if r.bit() == 1 {
+			// Skip scaling lists
+			count := 8
+			if chromaFormatIDC == 3 {
+				count = 12
+			}
+			for i := 0; i < count; i++ {
+				if r.bit() == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := 8, 8
+				for j := 0; j < size && r.err == nil; j++ {
+					if next != 0 {
+						next = (last + r.se() + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+
+	r.ue() // log2_max_frame_num_minus4
+	switch r.ue() {
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.bit() // delta_pic_order_always_zero_flag
+		r.se()  // offset_for_non_ref_pic
+		r.se()  // offset_for_top_to_bottom_field
+		n := r.ue()
+		for i := uint(0); i < n && r.err == nil; i++ {
+			r.se()
+		}
+	}
+	r.ue()  // max_num_ref_frames
+	r.bit() // gaps_in_frame_num_value_allowed_flag
+
+	widthInMbs := int(r.ue()) + 1
+	heightInMapUnits := int(r.ue()) + 1
+	frameMbsOnly := int(r.bit())
+	if frameMbsOnly == 0 {
+		r.bit() // mb_adaptive_frame_field_flag
+	}
+	r.bit() // direct_8x8_inference_flag
+
+	var cropLeft, cropRight, cropTop, cropBottom int
+	if r.bit() == 1 {
+		cropLeft = int(r.ue())
+		cropRight = int(r.ue())
+		cropTop = int(r.ue())
+		cropBottom = int(r.ue())
+	}
+	if r.err != nil {
+		return sps, r.err
+	}
+
+	// Crop units depend on chroma subsampling
+	cropX, cropY := 1, 2-frameMbsOnly
+	switch chromaFormatIDC {
+	case 1:
+		cropX, cropY = 2, 2*(2-frameMbsOnly)
+	case 2:
+		cropX, cropY = 2, 2-frameMbsOnly
+	}
+
+	sps.Width = widthInMbs*16 - cropX*(cropLeft+cropRight)
+	sps.Height = (2-frameMbsOnly)*heightInMapUnits*16 - cropY*(cropTop+cropBottom)
+	return sps, nil
+}
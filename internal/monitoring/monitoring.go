@@ -29,11 +29,53 @@ var (
 		Help: "The total amount of WebRTC sessions exchanged",
 	})
 
+	// MessagingDroppedMessages is the total amount of messages dropped for slow outputs
+	MessagingDroppedMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ghostream_messaging_dropped_messages_total",
+		Help: "The total amount of messages dropped because an output was too slow",
+	}, []string{"stream", "output", "policy"})
+
+	// MessagingDisconnectedOutputs is the total amount of outputs disconnected for being too slow
+	MessagingDisconnectedOutputs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ghostream_messaging_disconnected_outputs_total",
+		Help: "The total amount of outputs disconnected because they were too slow",
+	}, []string{"stream", "output", "policy"})
+
+	// MessagingIncomingBitrate is the measured bitrate of each stream quality
+	MessagingIncomingBitrate = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ghostream_messaging_incoming_bitrate",
+		Help: "The incoming bitrate of each stream quality in bits per second",
+	}, []string{"stream", "quality"})
+
+	// PullConnected is 1 when the pull source of a stream is connected
+	PullConnected = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ghostream_pull_connected",
+		Help: "Whether the pull source of each stream is connected",
+	}, []string{"stream"})
+
 	// WebRTCConnectedSessions is the total amount of WebRTC session exchange
 	WebRTCConnectedSessions = promauto.NewGauge(prometheus.GaugeOpts{
 		Name: "ghostream_webrtc_connected_sessions",
 		Help: "The current amount of opened WebRTC sessions",
 	})
+
+	// WebRTCFeedback is the total amount of RTCP feedback received from WebRTC viewers
+	WebRTCFeedback = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ghostream_webrtc_feedback_total",
+		Help: "The total amount of NACK, PLI and FIR received from WebRTC viewers",
+	}, []string{"stream", "type"})
+
+	// WebRTCFractionLost is the fraction of packets lost by a WebRTC viewer since its previous report
+	WebRTCFractionLost = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ghostream_webrtc_fraction_lost",
+		Help: "The fraction of packets lost by a WebRTC viewer since its previous report",
+	}, []string{"stream", "session", "media"})
+
+	// WebRTCJitter is the interarrival jitter of packets received by a WebRTC viewer
+	WebRTCJitter = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ghostream_webrtc_jitter_seconds",
+		Help: "The interarrival jitter of packets received by a WebRTC viewer",
+	}, []string{"stream", "session", "media"})
 )
 
 // Serve monitoring server that expose prometheus metrics
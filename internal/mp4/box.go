@@ -0,0 +1,58 @@
+// Package mp4 writes fragmented MP4 initialization and media segments
+package mp4
+
+import (
+	"encoding/binary"
+)
+
+// box returns an ISO BMFF box containing the concatenation of content.
+func box(boxType string, content ...[]byte) []byte {
+	size := 8
+	for _, c := range content {
+		size += len(c)
+	}
+	b := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(b, uint32(size))
+	copy(b[4:], boxType)
+	for _, c := range content {
+		b = append(b, c...)
+	}
+	return b
+}
+
+// fullBox returns a box with version and flags.
+func fullBox(boxType string, version byte, flags uint32, content ...[]byte) []byte {
+	header := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return box(boxType, append([][]byte{header}, content...)...)
+}
+
+func u8(v int) []byte {
+	return []byte{byte(v)}
+}
+
+func u16(v int) []byte {
+	return []byte{byte(v >> 8), byte(v)}
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func u64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func zeros(n int) []byte {
+	return make([]byte, n)
+}
+
+// Unity transformation matrix of movie and track headers
+var matrix = []byte{
+	0x00, 0x01, 0x00, 0x00, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0x00, 0x01, 0x00, 0x00, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0x40, 0x00, 0x00, 0x00,
+}
@@ -0,0 +1,164 @@
+// Package mp4 writes fragmented MP4 initialization and media segments
+package mp4
+
+import (
+	"errors"
+
+	"gitlab.crans.org/nounous/ghostream/internal/h264"
+)
+
+// Track describes the only track of a fragmented MP4 file.
+type Track struct {
+	// Codec short name, "h264", "aac", "mp3" or "opus"
+	Codec string
+
+	// Timestamps units per second
+	Timescale uint32
+
+	// Video parameters, SPS and PPS are needed for H.264
+	Width  int
+	Height int
+	SPS    []byte
+	PPS    []byte
+
+	// Audio parameters, AudioSpecificConfig is needed for AAC
+	SampleRate int
+	Channels   int
+	Config     []byte
+}
+
+// Sample is a frame of a media segment, H.264 data is in AVCC format.
+type Sample struct {
+	Duration uint32
+
+	// Presentation time minus decoding time
+	CompositionOffset int32
+
+	Keyframe bool
+	Data     []byte
+}
+
+// Track identifier in files
+const trackID = 1
+
+// InitSegment returns the initialization segment of a track.
+func InitSegment(t Track) ([]byte, error) {
+	entry, err := sampleEntry(t)
+	if err != nil {
+		return nil, err
+	}
+
+	video := t.Codec == "h264"
+	handler, name := "soun", "SoundHandler"
+	mediaHeader := fullBox("smhd", 0, 0, zeros(4))
+	volume := 0x0100
+	if video {
+		handler, name = "vide", "VideoHandler"
+		mediaHeader = fullBox("vmhd", 0, 1, zeros(8))
+		volume = 0
+	}
+
+	ftyp := box("ftyp", []byte("iso6"), u32(0x200), []byte("iso6mp41dash"))
+	mvhd := fullBox("mvhd", 0, 0,
+		zeros(8), u32(1000), zeros(4), // times, timescale, duration
+		u32(0x00010000), u16(0x0100), zeros(10), // rate, volume
+		matrix, zeros(24), u32(trackID+1))
+	tkhd := fullBox("tkhd", 0, 3,
+		zeros(8), u32(trackID), zeros(4), zeros(4), // times, track, reserved, duration
+		zeros(8), zeros(4), u16(volume), zeros(2), // layer, group
+		matrix, u32(uint32(t.Width)<<16), u32(uint32(t.Height)<<16))
+	mdhd := fullBox("mdhd", 0, 0, zeros(8), u32(t.Timescale), zeros(4), u16(0x55c4), zeros(2))
+	hdlr := fullBox("hdlr", 0, 0, zeros(4), []byte(handler), zeros(12), []byte(name), zeros(1))
+	dinf := box("dinf", fullBox("dref", 0, 0, u32(1), fullBox("url ", 0, 1)))
+	stbl := box("stbl",
+		fullBox("stsd", 0, 0, u32(1), entry),
+		fullBox("stts", 0, 0, u32(0)),
+		fullBox("stsc", 0, 0, u32(0)),
+		fullBox("stsz", 0, 0, u32(0), u32(0)),
+		fullBox("stco", 0, 0, u32(0)))
+	trak := box("trak", tkhd, box("mdia", mdhd, hdlr, box("minf", mediaHeader, dinf, stbl)))
+	trex := fullBox("trex", 0, 0, u32(trackID), u32(1), zeros(12))
+	moov := box("moov", mvhd, trak, box("mvex", trex))
+
+	return append(ftyp, moov...), nil
+}
+
+// sampleEntry returns the sample description of a track.
+func sampleEntry(t Track) ([]byte, error) {
+	switch t.Codec {
+	case "h264":
+		if len(t.SPS) < 4 || len(t.PPS) == 0 {
+			return nil, errors.New("missing H.264 parameter sets")
+		}
+		avcC := box("avcC", h264.DecoderConfig(t.SPS, t.PPS))
+		return box("avc1",
+			zeros(6), u16(1), // data reference index
+			zeros(16), u16(t.Width), u16(t.Height),
+			u32(0x00480000), u32(0x00480000), zeros(4), u16(1), // resolution, frame count
+			zeros(32), u16(0x18), u16(0xffff), // compressor name, depth
+			avcC), nil
+	case "aac", "mp3":
+		objectType, config := 0x40, t.Config
+		if t.Codec == "mp3" {
+			objectType = 0x6b
+		} else if len(config) < 2 {
+			return nil, errors.New("missing AAC configuration")
+		}
+		return audioSampleEntry("mp4a", t, esds(objectType, config)), nil
+	case "opus":
+		dOps := box("dOps", u8(0), u8(t.Channels), u16(312), u32(uint32(t.SampleRate)), u16(0), u8(0))
+		return audioSampleEntry("Opus", t, dOps), nil
+	}
+	return nil, errors.New("unsupported codec " + t.Codec)
+}
+
+func audioSampleEntry(entryType string, t Track, config []byte) []byte {
+	return box(entryType,
+		zeros(6), u16(1), // data reference index
+		zeros(8), u16(t.Channels), u16(16), zeros(4),
+		u32(uint32(t.SampleRate)<<16),
+		config)
+}
+
+// esds returns the elementary stream descriptor of MPEG-4 audio.
+func esds(objectType int, config []byte) []byte {
+	var specific []byte
+	if len(config) > 0 {
+		specific = append([]byte{0x05, byte(len(config))}, config...)
+	}
+	decoderConfig := append([]byte{0x04, byte(13 + len(specific)), byte(objectType), 0x15}, zeros(11)...)
+	decoderConfig = append(decoderConfig, specific...)
+	sl := []byte{0x06, 1, 0x02}
+	es := append([]byte{0x03, byte(3 + len(decoderConfig) + len(sl)), 0, 0, 0}, decoderConfig...)
+	es = append(es, sl...)
+	return fullBox("esds", 0, 0, es)
+}
+
+// Fragment returns a media segment with the samples of a track.
+// Decode time is the decoding timestamp of the first sample.
+func Fragment(sequence uint32, decodeTime uint64, samples []Sample) []byte {
+	var entries, data []byte
+	for _, s := range samples {
+		flags := uint32(0x01010000) // depends on others, not a sync sample
+		if s.Keyframe {
+			flags = 0x02000000
+		}
+		entries = append(entries, u32(s.Duration)...)
+		entries = append(entries, u32(uint32(len(s.Data)))...)
+		entries = append(entries, u32(flags)...)
+		entries = append(entries, u32(uint32(s.CompositionOffset))...)
+		data = append(data, s.Data...)
+	}
+
+	// Data offset is relative to moof start, it is set after moof size is known
+	trun := fullBox("trun", 1, 0x000f01, u32(uint32(len(samples))), zeros(4), entries)
+	traf := box("traf",
+		fullBox("tfhd", 0, 0x020000, u32(trackID)), // default base is moof
+		fullBox("tfdt", 1, 0, u64(decodeTime)),
+		trun)
+	moof := box("moof", fullBox("mfhd", 0, 0, u32(sequence)), traf)
+	offset := len(moof) - len(trun) + 16
+	copy(moof[offset:], u32(uint32(len(moof)+8)))
+
+	return append(moof, box("mdat", data)...)
+}
@@ -0,0 +1,78 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"gitlab.crans.org/nounous/ghostream/internal/h264"
+)
+
+// boxes returns the child boxes of data by type
+func boxes(t *testing.T, data []byte) map[string][]byte {
+	result := make(map[string][]byte)
+	for len(data) > 0 {
+		if len(data) < 8 {
+			t.Fatalf("Truncated box header")
+		}
+		size := int(binary.BigEndian.Uint32(data))
+		if size < 8 || size > len(data) {
+			t.Fatalf("Wrong %s box size %d", data[4:8], size)
+		}
+		result[string(data[4:8])] = data[8:size]
+		data = data[size:]
+	}
+	return result
+}
+
+func TestInitSegment(t *testing.T) {
+	sps := []byte{0x67, 0x42, 0xc0, 0x28, 0xf4, 0x03, 0xc0, 0x11, 0x3f, 0x2a}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	init, err := InitSegment(Track{Codec: "h264", Timescale: 90000, Width: 1920, Height: 1080, SPS: sps, PPS: pps})
+	if err != nil {
+		t.Fatalf("Failed to write initialization segment: %s", err)
+	}
+	top := boxes(t, init)
+	moov := boxes(t, top["moov"])
+	trak := boxes(t, moov["trak"])
+	minf := boxes(t, boxes(t, trak["mdia"])["minf"])
+	stsd := boxes(t, minf["stbl"])["stsd"]
+	if _, ok := top["ftyp"]; !ok || moov["mvex"] == nil || minf["vmhd"] == nil {
+		t.Errorf("Missing boxes in initialization segment")
+	}
+	// Sample entry follows stsd version, flags and entry count
+	avc1 := stsd[8:]
+	if string(avc1[4:8]) != "avc1" || binary.BigEndian.Uint16(avc1[8+24:]) != 1920 || !bytes.Contains(avc1, sps) {
+		t.Errorf("Wrong video sample entry: %v", avc1)
+	}
+
+	if _, err := InitSegment(Track{Codec: "aac", Timescale: 90000, SampleRate: 48000, Channels: 2}); err == nil {
+		t.Errorf("AAC without configuration was accepted")
+	}
+	if _, err := InitSegment(Track{Codec: "vp8"}); err == nil {
+		t.Errorf("Unsupported codec was accepted")
+	}
+}
+
+func TestFragment(t *testing.T) {
+	samples := []Sample{
+		{Duration: 3600, Keyframe: true, Data: h264.ToAVCC([]byte{0, 0, 0, 1, 0x09, 0xf0, 0, 0, 1, 0x65, 1, 2})},
+		{Duration: 3600, CompositionOffset: 3600, Data: []byte{0, 0, 0, 1, 0x41}},
+	}
+	if !bytes.Equal(samples[0].Data, []byte{0, 0, 0, 3, 0x65, 1, 2}) {
+		t.Errorf("Wrong AVC sample: %v", samples[0].Data)
+	}
+	fragment := Fragment(7, 90000, samples)
+	top := boxes(t, fragment)
+	traf := boxes(t, boxes(t, top["moof"])["traf"])
+	if binary.BigEndian.Uint64(traf["tfdt"][4:]) != 90000 {
+		t.Errorf("Wrong decode time")
+	}
+
+	// Data offset points to first sample in mdat
+	trun := traf["trun"]
+	offset := binary.BigEndian.Uint32(trun[8:])
+	if binary.BigEndian.Uint32(trun[4:]) != 2 || !bytes.HasPrefix(fragment[offset:], samples[0].Data) {
+		t.Errorf("Wrong track run: %v", trun)
+	}
+}
@@ -0,0 +1,214 @@
+// Package mpegts provides helpers to inspect MPEG transport streams
+package mpegts
+
+const (
+	// PacketSize is the size of a transport stream packet
+	PacketSize = 188
+
+	// SyncByte starts every transport stream packet
+	SyncByte = 0x47
+
+	// PATPID is the PID of the program association table
+	PATPID = 0x0000
+)
+
+// Stream types found in program map tables
+const (
+	StreamTypeMPEG2Video = 0x02
+	StreamTypeMPEG1Audio = 0x03
+	StreamTypeMPEG2Audio = 0x04
+	StreamTypePrivate    = 0x06
+	StreamTypeADTSAAC    = 0x0F
+	StreamTypeH264       = 0x1B
+	StreamTypeH265       = 0x24
+	StreamTypeAC3        = 0x81
+)
+
+// PID returns the packet identifier of a transport stream packet.
+func PID(pkt []byte) uint16 {
+	return uint16(pkt[1]&0x1f)<<8 | uint16(pkt[2])
+}
+
+// PayloadUnitStart returns true if a PES packet or a PSI section starts
+// in this transport stream packet.
+func PayloadUnitStart(pkt []byte) bool {
+	return pkt[1]&0x40 != 0
+}
+
+// RandomAccess returns true if the random access indicator is set in the
+// adaptation field, meaning a decoder can start from this packet.
+func RandomAccess(pkt []byte) bool {
+	if pkt[3]&0x20 == 0 || pkt[4] == 0 {
+		// No adaptation field
+		return false
+	}
+	return pkt[5]&0x40 != 0
+}
+
+// Payload returns the payload of a transport stream packet.
+func Payload(pkt []byte) []byte {
+	if pkt[3]&0x10 == 0 {
+		// No payload
+		return nil
+	}
+	offset := 4
+	if pkt[3]&0x20 != 0 {
+		// Skip adaptation field
+		offset += 1 + int(pkt[4])
+	}
+	if offset >= len(pkt) {
+		return nil
+	}
+	return pkt[offset:]
+}
+
+// section returns the PSI section starting in this packet, without pointer field.
+func section(pkt []byte) []byte {
+	payload := Payload(pkt)
+	if !PayloadUnitStart(pkt) || len(payload) < 1 {
+		return nil
+	}
+	pointer := int(payload[0])
+	if 1+pointer >= len(payload) {
+		return nil
+	}
+	return payload[1+pointer:]
+}
+
+// ParsePAT returns the PID of the program map table of the first program
+// described in a program association table packet.
+func ParsePAT(pkt []byte) (pmtPID uint16, ok bool) {
+	s := section(pkt)
+	if len(s) < 8 || s[0] != 0x00 {
+		return 0, false
+	}
+	length := int(s[1]&0x0f)<<8 | int(s[2])
+	end := 3 + length - 4 // ignore CRC
+	if end > len(s) {
+		end = len(s)
+	}
+	for i := 8; i+4 <= end; i += 4 {
+		program := uint16(s[i])<<8 | uint16(s[i+1])
+		if program == 0 {
+			// Network information table
+			continue
+		}
+		return uint16(s[i+2]&0x1f)<<8 | uint16(s[i+3]), true
+	}
+	return 0, false
+}
+
+// ElementaryStream describes one stream of a program map table.
+type ElementaryStream struct {
+	PID         uint16
+	StreamType  byte
+	Descriptors []byte
+}
+
+// ParsePMT returns the elementary streams described in a program map table packet.
+func ParsePMT(pkt []byte) (streams []ElementaryStream, ok bool) {
+	s := section(pkt)
+	if len(s) < 12 || s[0] != 0x02 {
+		return nil, false
+	}
+	length := int(s[1]&0x0f)<<8 | int(s[2])
+	end := 3 + length - 4 // ignore CRC
+	if end > len(s) {
+		end = len(s)
+	}
+	infoLength := int(s[10]&0x0f)<<8 | int(s[11])
+	for i := 12 + infoLength; i+5 <= end; {
+		es := ElementaryStream{
+			StreamType: s[i],
+			PID:        uint16(s[i+1]&0x1f)<<8 | uint16(s[i+2]),
+		}
+		next := i + 5 + (int(s[i+3]&0x0f)<<8 | int(s[i+4]))
+		if next <= end {
+			es.Descriptors = s[i+5 : next]
+		}
+		streams = append(streams, es)
+		i = next
+	}
+	return streams, true
+}
+
+// IsVideo returns true if the stream type describes a video stream.
+func IsVideo(streamType byte) bool {
+	switch streamType {
+	case StreamTypeMPEG2Video, StreamTypeH264, StreamTypeH265:
+		return true
+	}
+	return false
+}
+
+// IsAudio returns true if the stream type describes an audio stream.
+func IsAudio(streamType byte) bool {
+	switch streamType {
+	case StreamTypeMPEG1Audio, StreamTypeMPEG2Audio, StreamTypeADTSAAC, StreamTypeAC3:
+		return true
+	}
+	return false
+}
+
+// CodecName returns a short name of the codec of a stream type,
+// or an empty string if it is unknown.
+func CodecName(streamType byte) string {
+	switch streamType {
+	case StreamTypeMPEG2Video:
+		return "mpeg2video"
+	case StreamTypeMPEG1Audio, StreamTypeMPEG2Audio:
+		return "mp3"
+	case StreamTypeADTSAAC:
+		return "aac"
+	case StreamTypeH264:
+		return "h264"
+	case StreamTypeH265:
+		return "hevc"
+	case StreamTypeAC3:
+		return "ac3"
+	}
+	return ""
+}
+
+// Codec returns a short name of the codec of an elementary stream,
+// or an empty string if it is unknown.
+func (es ElementaryStream) Codec() string {
+	if es.StreamType == StreamTypePrivate && isOpus(es.Descriptors) {
+		return "opus"
+	}
+	return CodecName(es.StreamType)
+}
+
+// IsAudio returns true if the elementary stream is an audio stream.
+func (es ElementaryStream) IsAudio() bool {
+	return IsAudio(es.StreamType) || es.Codec() == "opus"
+}
+
+// OpusDescriptors returns the program map table descriptors of an Opus stream.
+func OpusDescriptors(channels int) []byte {
+	return []byte{
+		0x05, 4, 'O', 'p', 'u', 's', // registration descriptor
+		0x7f, 2, 0x80, byte(channels), // extension descriptor, channel configuration
+	}
+}
+
+// isOpus looks for the Opus registration descriptor.
+func isOpus(descriptors []byte) bool {
+	for i := 0; i+2 <= len(descriptors); i += 2 + int(descriptors[i+1]) {
+		tag, length := descriptors[i], int(descriptors[i+1])
+		if tag == 0x05 && length >= 4 && i+6 <= len(descriptors) && string(descriptors[i+2:i+6]) == "Opus" {
+			return true
+		}
+	}
+	return false
+}
+
+// OpusControlHeader returns the header to put before each Opus packet
+// in a PES payload.
+func OpusControlHeader(size int) []byte {
+	header := []byte{0x7f, 0xe0}
+	for ; size >= 255; size -= 255 {
+		header = append(header, 0xff)
+	}
+	return append(header, byte(size))
+}
@@ -0,0 +1,57 @@
+package mpegts
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMuxer(t *testing.T) {
+	buff := &bytes.Buffer{}
+	muxer := NewMuxer(buff)
+	videoPID := muxer.AddStream(StreamTypeH264, nil)
+	audioPID := muxer.AddStream(StreamTypePrivate, OpusDescriptors(2))
+
+	// Keyframe is written after tables
+	frame := bytes.Repeat([]byte{42}, 500)
+	if err := muxer.WritePES(videoPID, 9000, 9000, true, frame); err != nil {
+		t.Fatalf("Failed to write video: %s", err)
+	}
+	if err := muxer.WritePES(audioPID, 9000, 9000, false, []byte{1, 2, 3}); err != nil {
+		t.Fatalf("Failed to write audio: %s", err)
+	}
+	data := buff.Bytes()
+	if len(data)%PacketSize != 0 {
+		t.Fatalf("Muxer wrote %d bytes, not a multiple of packet size", len(data))
+	}
+
+	// Tables
+	pmtPID, ok := ParsePAT(data[:PacketSize])
+	if !ok || pmtPID != muxerPMTPID {
+		t.Fatalf("Failed to parse program association table")
+	}
+	streams, ok := ParsePMT(data[PacketSize : 2*PacketSize])
+	if !ok || len(streams) != 2 {
+		t.Fatalf("Failed to parse program map table")
+	}
+	if streams[0].PID != videoPID || streams[0].Codec() != "h264" {
+		t.Errorf("Wrong video stream %v", streams[0])
+	}
+	if streams[1].PID != audioPID || streams[1].Codec() != "opus" || !streams[1].IsAudio() {
+		t.Errorf("Wrong audio stream %v", streams[1])
+	}
+
+	// Video starts with a random access point and a PES header
+	pkt := data[2*PacketSize : 3*PacketSize]
+	if PID(pkt) != videoPID || !PayloadUnitStart(pkt) || !RandomAccess(pkt) {
+		t.Errorf("Video does not start with a random access point")
+	}
+	if payload := Payload(pkt); !bytes.HasPrefix(payload, []byte{0, 0, 1, 0xe0}) {
+		t.Errorf("Video packet does not start with a PES header")
+	}
+
+	// Last packet is audio, padded with stuffing
+	pkt = data[len(data)-PacketSize:]
+	if payload := Payload(pkt); PID(pkt) != audioPID || !bytes.HasSuffix(payload, []byte{1, 2, 3}) {
+		t.Errorf("Audio packet is wrong")
+	}
+}
@@ -0,0 +1,270 @@
+// Package mpegts provides helpers to inspect MPEG transport streams
+package mpegts
+
+import (
+	"io"
+)
+
+const (
+	// PID of the program map table written by Muxer
+	muxerPMTPID = 0x1000
+
+	// PID of the first elementary stream written by Muxer
+	muxerFirstPID = 0x100
+)
+
+// Muxer writes elementary streams in a MPEG transport stream
+// with one program.
+type Muxer struct {
+	w       io.Writer
+	streams []muxerStream
+
+	// PID of the stream which carries the program clock reference
+	pcrPID uint16
+
+	// Continuity counter of each PID
+	continuity map[uint16]byte
+
+	tablesWritten bool
+
+	// Version of the program map table, updated when adding streams
+	version byte
+}
+
+type muxerStream struct {
+	pid         uint16
+	streamType  byte
+	streamID    byte
+	descriptors []byte
+}
+
+// NewMuxer creates a muxer writing to w.
+func NewMuxer(w io.Writer) *Muxer {
+	return &Muxer{w: w, continuity: make(map[uint16]byte)}
+}
+
+// AddStream declares a new elementary stream and returns its PID.
+// Descriptors are written in the program map table.
+// Streams added after writing data are announced in a new version of
+// the program map table.
+func (m *Muxer) AddStream(streamType byte, descriptors []byte) uint16 {
+	if m.tablesWritten {
+		m.version = (m.version + 1) & 0x1f
+		m.tablesWritten = false
+	}
+	pid := muxerFirstPID + uint16(len(m.streams))
+	streamID := byte(0xbd) // private stream 1
+	switch {
+	case IsVideo(streamType):
+		streamID = 0xe0
+	case IsAudio(streamType):
+		streamID = 0xc0
+	}
+	m.streams = append(m.streams, muxerStream{
+		pid:         pid,
+		streamType:  streamType,
+		streamID:    streamID,
+		descriptors: descriptors,
+	})
+
+	// Clock is carried by video, or by first stream
+	if m.pcrPID == 0 || (IsVideo(streamType) && !IsVideo(m.streamType(m.pcrPID))) {
+		m.pcrPID = pid
+	}
+	return pid
+}
+
+func (m *Muxer) streamType(pid uint16) byte {
+	for _, s := range m.streams {
+		if s.pid == pid {
+			return s.streamType
+		}
+	}
+	return 0
+}
+
+// WriteTables writes the program association and program map tables.
+// They are also written before each random access point.
+func (m *Muxer) WriteTables() error {
+	// Program association table
+	pat := []byte{
+		0x00, 0xb0, 13, // table id, section length
+		0x00, 0x01, 0xc1, 0x00, 0x00, // transport stream id, version, section numbers
+		0x00, 0x01, 0xe0 | muxerPMTPID>>8, muxerPMTPID & 0xff, // program 1
+	}
+	if err := m.writeSection(PATPID, pat); err != nil {
+		return err
+	}
+
+	// Program map table
+	pmt := []byte{
+		0x02, 0xb0, 0, // table id, section length
+		0x00, 0x01, 0xc1 | m.version<<1, 0x00, 0x00, // program 1, version, section numbers
+		0xe0 | byte(m.pcrPID>>8), byte(m.pcrPID), 0xf0, 0x00,
+	}
+	for _, s := range m.streams {
+		pmt = append(pmt, s.streamType, 0xe0|byte(s.pid>>8), byte(s.pid))
+		pmt = append(pmt, 0xf0|byte(len(s.descriptors)>>8), byte(len(s.descriptors)))
+		pmt = append(pmt, s.descriptors...)
+	}
+	length := len(pmt) - 3 + 4
+	pmt[1] |= byte(length >> 8)
+	pmt[2] = byte(length)
+	if err := m.writeSection(muxerPMTPID, pmt); err != nil {
+		return err
+	}
+	m.tablesWritten = true
+	return nil
+}
+
+// writeSection writes a PSI section in one packet, adding its CRC.
+func (m *Muxer) writeSection(pid uint16, section []byte) error {
+	payload := make([]byte, 0, PacketSize-4)
+	payload = append(payload, 0) // pointer field
+	payload = append(payload, section...)
+	crc := crc32MPEG(section)
+	payload = append(payload, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+	for len(payload) < PacketSize-4 {
+		payload = append(payload, 0xff)
+	}
+	_, err := m.writePacket(pid, true, false, -1, payload)
+	return err
+}
+
+// WritePES writes an access unit of an elementary stream.
+// Timestamps use a 90 kHz clock, dts is ignored if it equals pts.
+// Random access must be set on keyframes so decoders can start there.
+func (m *Muxer) WritePES(pid uint16, pts, dts int64, randomAccess bool, data []byte) error {
+	if randomAccess || !m.tablesWritten {
+		if err := m.WriteTables(); err != nil {
+			return err
+		}
+	}
+
+	var streamID byte
+	for _, s := range m.streams {
+		if s.pid == pid {
+			streamID = s.streamID
+		}
+	}
+
+	// PES header
+	header := make([]byte, 0, 19)
+	header = append(header, 0x00, 0x00, 0x01, streamID, 0, 0, 0x80)
+	if dts != pts {
+		header = append(header, 0xc0, 10)
+		header = appendTimestamp(header, 0x3, pts)
+		header = appendTimestamp(header, 0x1, dts)
+	} else {
+		header = append(header, 0x80, 5)
+		header = appendTimestamp(header, 0x2, pts)
+	}
+	if length := len(header) - 6 + len(data); length <= 0xffff && !IsVideo(m.streamType(pid)) {
+		header[4] = byte(length >> 8)
+		header[5] = byte(length)
+	}
+	pes := append(header, data...)
+
+	// Split in packets
+	pcr := int64(-1)
+	if pid == m.pcrPID {
+		pcr = dts
+	}
+	first := true
+	for len(pes) > 0 {
+		n, err := m.writePacket(pid, first, first && randomAccess, pcr, pes)
+		if err != nil {
+			return err
+		}
+		pes = pes[n:]
+		first = false
+		pcr = -1
+	}
+	return nil
+}
+
+// writePacket writes one packet with as much payload as possible and
+// returns the number of payload bytes written.
+// A negative pcr means no program clock reference.
+func (m *Muxer) writePacket(pid uint16, start, randomAccess bool, pcr int64, payload []byte) (int, error) {
+	pkt := make([]byte, 4, PacketSize)
+	pkt[0] = SyncByte
+	pkt[1] = byte(pid>>8) & 0x1f
+	if start {
+		pkt[1] |= 0x40
+	}
+	pkt[2] = byte(pid)
+	pkt[3] = 0x10 | m.continuity[pid]
+	m.continuity[pid] = (m.continuity[pid] + 1) & 0x0f
+
+	// Adaptation field, without its length
+	var af []byte
+	if randomAccess || pcr >= 0 {
+		af = []byte{0}
+		if randomAccess {
+			af[0] |= 0x40
+		}
+		if pcr >= 0 {
+			af[0] |= 0x10
+			af = append(af, byte(pcr>>25), byte(pcr>>17), byte(pcr>>9), byte(pcr>>1), byte(pcr<<7)|0x7e, 0)
+		}
+	}
+	space := PacketSize - 4
+	if af != nil {
+		space -= 1 + len(af)
+	}
+
+	// Fill last packet with stuffing bytes
+	if len(payload) < space {
+		stuffing := space - len(payload)
+		if af == nil {
+			// Adaptation field length takes one byte
+			af = []byte{}
+			stuffing--
+			if stuffing > 0 {
+				af = append(af, 0)
+				stuffing--
+			}
+		}
+		for ; stuffing > 0; stuffing-- {
+			af = append(af, 0xff)
+		}
+		space = len(payload)
+	}
+
+	if af != nil {
+		pkt[3] |= 0x20
+		pkt = append(pkt, byte(len(af)))
+		pkt = append(pkt, af...)
+	}
+	pkt = append(pkt, payload[:space]...)
+	_, err := m.w.Write(pkt)
+	return space, err
+}
+
+// appendTimestamp appends a 33-bit PES timestamp with its 4-bit prefix.
+func appendTimestamp(b []byte, prefix byte, ts int64) []byte {
+	return append(b,
+		prefix<<4|byte(ts>>29)&0x0e|1,
+		byte(ts>>22),
+		byte(ts>>14)|1,
+		byte(ts>>7),
+		byte(ts<<1)|1,
+	)
+}
+
+// crc32MPEG computes the CRC used by PSI sections
+func crc32MPEG(b []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, c := range b {
+		crc ^= uint32(c) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,118 @@
+// Package packaging runs a packager on each stream quality for segmented
+// HTTP protocols, such as HLS and DASH
+package packaging
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"gitlab.crans.org/nounous/ghostream/messaging"
+)
+
+// Packager packages the data of one quality
+type Packager interface {
+	Write(data []byte)
+}
+
+// closer is implemented by packagers that must know when quality ends
+type closer interface {
+	Close()
+}
+
+// Registry holds the packagers of a protocol by stream then quality
+type Registry struct {
+	// Name of the protocol, for policy metrics
+	name string
+
+	packagers map[string]map[string]Packager
+	lock      sync.Mutex
+}
+
+// NewRegistry returns an empty registry for a protocol
+func NewRegistry(name string) *Registry {
+	return &Registry{
+		name:      name,
+		packagers: make(map[string]map[string]Packager),
+	}
+}
+
+// Serve packages each new quality with a packager from newPackager
+func (r *Registry) Serve(streams *messaging.Streams, newPackager func(quality *messaging.Quality) Packager) {
+	// Subscribe to new quality event
+	event := make(chan messaging.Event, 8)
+	streams.Subscribe(event, messaging.Filter{Types: []messaging.EventType{messaging.QualityCreated}})
+
+	for e := range event {
+		stream, err := streams.Get(e.Stream)
+		if err != nil {
+			log.Printf("Failed to get stream '%s'", e.Stream)
+			continue
+		}
+		quality, err := stream.GetQuality(e.Quality)
+		if err != nil {
+			log.Printf("Failed to get quality '%s'", e.Quality)
+			continue
+		}
+		go r.handleQuality(quality, e.Stream, e.Quality, newPackager(quality))
+	}
+}
+
+// handleQuality packages a quality until it is closed
+func (r *Registry) handleQuality(quality *messaging.Quality, name, qualityName string, p Packager) {
+	r.lock.Lock()
+	if r.packagers[name] == nil {
+		r.packagers[name] = make(map[string]Packager)
+	}
+	r.packagers[name][qualityName] = p
+	r.lock.Unlock()
+
+	output := make(chan []byte, 1024)
+	quality.Register(output, messaging.Policy{Name: r.name, Mode: messaging.DropUntilKeyframe})
+	for data := range output {
+		p.Write(data)
+	}
+
+	// Quality was closed
+	if c, ok := p.(closer); ok {
+		c.Close()
+	}
+	r.lock.Lock()
+	if r.packagers[name][qualityName] == p {
+		delete(r.packagers[name], qualityName)
+		if len(r.packagers[name]) == 0 {
+			delete(r.packagers, name)
+		}
+	}
+	r.lock.Unlock()
+}
+
+// Get returns the packager of a stream quality, or nil
+func (r *Registry) Get(name, qualityName string) Packager {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.packagers[name][qualityName]
+}
+
+// Qualities returns the packagers of a stream by quality name
+func (r *Registry) Qualities(name string) map[string]Packager {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	result := make(map[string]Packager)
+	for q, p := range r.packagers[name] {
+		result[q] = p
+	}
+	return result
+}
+
+// Handler serves requests under prefix with serve, which gets the
+// request path split after prefix.
+// Players are often embedded on other websites, so cross-origin
+// requests are allowed.
+func Handler(prefix string, serve func(w http.ResponseWriter, r *http.Request, path []string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		serve(w, r, strings.Split(strings.TrimPrefix(r.URL.Path, prefix), "/"))
+	}
+}
@@ -0,0 +1,46 @@
+// Package packagingtest provides utilities to test packagers
+package packagingtest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	"gitlab.crans.org/nounous/ghostream/internal/demux"
+	"gitlab.crans.org/nounous/ghostream/internal/mpegts"
+)
+
+// Stream returns a MPEG-TS stream with 25 fps H.264 video, a keyframe
+// each second, and AAC audio. Timestamps start at one second.
+func Stream(seconds int) []byte {
+	buff := &bytes.Buffer{}
+	muxer := mpegts.NewMuxer(buff)
+	videoPID := muxer.AddStream(mpegts.StreamTypeH264, nil)
+	audioPID := muxer.AddStream(mpegts.StreamTypeADTSAAC, nil)
+	sps := []byte{0, 0, 0, 1, 0x67, 0x42, 0xc0, 0x28, 0xf4, 0x03, 0xc0, 0x11, 0x3f, 0x2a}
+	pps := []byte{0, 0, 0, 1, 0x68, 0xce, 0x3c, 0x80}
+	config := []byte{0x11, 0x90} // AAC LC, 48 kHz, stereo
+	for i := 0; i < 25*seconds; i++ {
+		ts := int64(90000 + i*3600)
+		if i%25 == 0 {
+			keyframe := append(append(append([]byte{}, sps...), pps...), 0, 0, 0, 1, 0x65, 1, 2, 3)
+			muxer.WritePES(videoPID, ts, ts, true, keyframe)
+		} else {
+			muxer.WritePES(videoPID, ts, ts, false, []byte{0, 0, 0, 1, 0x41, 1, 2, 3})
+		}
+		if i%2 == 0 {
+			muxer.WritePES(audioPID, ts, ts, false, append(demux.ADTSHeader(config, 3), 1, 2, 3))
+		}
+	}
+	return buff.Bytes()
+}
+
+// Get requests url from handler and returns the status code and body
+func Get(handler http.HandlerFunc, url string) (int, string) {
+	r, _ := http.NewRequest("GET", url, nil)
+	w := httptest.NewRecorder()
+	handler(w, r)
+	body, _ := ioutil.ReadAll(w.Body)
+	return w.Code, string(body)
+}
@@ -13,7 +13,11 @@ import (
 	"gitlab.crans.org/nounous/ghostream/internal/config"
 	"gitlab.crans.org/nounous/ghostream/internal/monitoring"
 	"gitlab.crans.org/nounous/ghostream/messaging"
+	"gitlab.crans.org/nounous/ghostream/stream/dash"
 	"gitlab.crans.org/nounous/ghostream/stream/forwarding"
+	"gitlab.crans.org/nounous/ghostream/stream/hls"
+	"gitlab.crans.org/nounous/ghostream/stream/pull"
+	"gitlab.crans.org/nounous/ghostream/stream/rtmp"
 	"gitlab.crans.org/nounous/ghostream/stream/srt"
 	"gitlab.crans.org/nounous/ghostream/stream/telnet"
 	"gitlab.crans.org/nounous/ghostream/stream/webrtc"
@@ -44,16 +48,20 @@ func main() {
 	}
 
 	// Init streams messaging
-	streams := messaging.New()
+	streams := messaging.New(&cfg.Messaging)
 
 	// Start routines
 	go transcoder.Init(streams, &cfg.Transcoder)
 	go forwarding.Serve(streams, cfg.Forwarding)
+	go hls.Serve(streams, &cfg.HLS)
+	go dash.Serve(streams, &cfg.DASH)
 	go monitoring.Serve(&cfg.Monitoring)
 	go ovenmediaengine.Serve(streams, &cfg.OME)
+	go pull.Serve(streams, cfg.Pull)
+	go rtmp.Serve(streams, authBackend, &cfg.RTMP)
 	go srt.Serve(streams, authBackend, &cfg.Srt)
 	go telnet.Serve(streams, &cfg.Telnet)
-	go web.Serve(streams, &cfg.Web, &cfg.OME)
+	go web.Serve(streams, authBackend, srt.Statistics{}, &cfg.Web, &cfg.OME, &cfg.WebRTC)
 	go webrtc.Serve(streams, &cfg.WebRTC)
 
 	// Wait for routines
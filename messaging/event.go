@@ -0,0 +1,209 @@
+// Package messaging defines a structure to communication between inputs and outputs
+package messaging
+
+import (
+	"log"
+	"sync"
+)
+
+// EventType identifies a change of streams state.
+type EventType int
+
+const (
+	// StreamCreated is sent when a new stream is created
+	StreamCreated EventType = iota
+
+	// StreamDeleted is sent when a stream is deleted,
+	// after deletion of all its qualities
+	StreamDeleted
+
+	// QualityCreated is sent when a quality is added to a stream
+	QualityCreated
+
+	// QualityDeleted is sent when a quality is removed from a stream
+	QualityDeleted
+
+	// ViewerJoined is sent when a client starts watching a stream
+	ViewerJoined
+
+	// ViewerLeft is sent when a client stops watching a stream
+	ViewerLeft
+)
+
+// String returns event type name.
+func (t EventType) String() string {
+	switch t {
+	case StreamCreated:
+		return "StreamCreated"
+	case StreamDeleted:
+		return "StreamDeleted"
+	case QualityCreated:
+		return "QualityCreated"
+	case QualityDeleted:
+		return "QualityDeleted"
+	case ViewerJoined:
+		return "ViewerJoined"
+	case ViewerLeft:
+		return "ViewerLeft"
+	}
+	return "Unknown"
+}
+
+// Event describes a change of streams state.
+type Event struct {
+	Type EventType
+
+	// Name of the stream
+	Stream string
+
+	// Name of the quality, only for quality events
+	Quality string
+}
+
+// Filter selects events a subscriber receives.
+// The zero value selects all events.
+type Filter struct {
+	// Only receive events of this stream, if not empty
+	Stream string
+
+	// Only receive these event types, if not empty
+	Types []EventType
+}
+
+func (f *Filter) match(e Event) bool {
+	if f.Stream != "" && f.Stream != e.Stream {
+		return false
+	}
+	if len(f.Types) == 0 {
+		return true
+	}
+	for _, t := range f.Types {
+		if t == e.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// Maximum number of viewer events waiting for a subscriber
+const maxViewerEvents = 256
+
+// subscriber queues events for one output.
+//
+// Stream and quality events are never dropped and are received in the order
+// they happened. Their queue is not bounded, it only grows with the number
+// of streams, so announcing an event never blocks and a slow subscriber only
+// delays itself.
+//
+// Viewer events are frequent, at most maxViewerEvents of them wait. When
+// they are full, a viewer leaving cancels a pending join of the stream, and
+// the reverse. Other viewer events are dropped until the queue drains.
+type subscriber struct {
+	output chan Event
+	filter Filter
+
+	// Pending events and number of viewer events among them
+	queue   []Event
+	viewers int
+	lock    sync.Mutex
+
+	// Number of dropped viewer events
+	dropped uint64
+
+	// Wake up the goroutine when an event is queued
+	wake chan struct{}
+
+	// Closed on unsubscribe
+	done chan struct{}
+}
+
+func newSubscriber(output chan Event, filter Filter) *subscriber {
+	s := &subscriber{
+		output: output,
+		filter: filter,
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// isViewerEvent returns true for event types with bounded delivery
+func isViewerEvent(t EventType) bool {
+	return t == ViewerJoined || t == ViewerLeft
+}
+
+// push queues an event if it matches subscriber filter.
+func (s *subscriber) push(e Event) {
+	if !s.filter.match(e) {
+		return
+	}
+	s.lock.Lock()
+	if isViewerEvent(e.Type) && !s.pushViewer(e) {
+		s.lock.Unlock()
+		return
+	}
+	s.queue = append(s.queue, e)
+	s.lock.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pushViewer makes room for a viewer event, lock must be held.
+// It returns false if the event must not be queued.
+func (s *subscriber) pushViewer(e Event) bool {
+	if s.viewers < maxViewerEvents {
+		s.viewers++
+		return true
+	}
+
+	// Cancel the opposite pending event of this stream
+	opposite := ViewerJoined
+	if e.Type == ViewerJoined {
+		opposite = ViewerLeft
+	}
+	for i := len(s.queue) - 1; i >= 0; i-- {
+		if s.queue[i].Type == opposite && s.queue[i].Stream == e.Stream {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			s.viewers--
+			return false
+		}
+	}
+
+	if s.dropped == 0 {
+		log.Printf("Event subscriber is too slow, dropping viewer events")
+	}
+	s.dropped++
+	return false
+}
+
+// run sends queued events to output until unsubscribe.
+func (s *subscriber) run() {
+	defer close(s.output)
+	for {
+		s.lock.Lock()
+		if len(s.queue) == 0 {
+			s.lock.Unlock()
+			select {
+			case <-s.wake:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+		e := s.queue[0]
+		s.queue = s.queue[1:]
+		if isViewerEvent(e.Type) {
+			s.viewers--
+		}
+		s.lock.Unlock()
+
+		select {
+		case s.output <- e:
+		case <-s.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,497 @@
+// Package messaging defines a structure to communication between inputs and outputs
+package messaging
+
+import (
+	"log"
+
+	"gitlab.crans.org/nounous/ghostream/internal/flv"
+	"gitlab.crans.org/nounous/ghostream/internal/h264"
+	"gitlab.crans.org/nounous/ghostream/internal/mpegts"
+)
+
+// keyframeParser follows a byte stream cut in arbitrary messages
+// and finds where a decoder can start.
+type keyframeParser interface {
+	// parse consumes the next message and returns the absolute stream
+	// positions where a keyframe starts.
+	// A position can be before the message if a header was split.
+	parse(data []byte) []int64
+
+	// header returns the data a decoder needs before the first keyframe.
+	header() []byte
+
+	// media returns the media detected so far, without bitrate.
+	media() MediaInfo
+}
+
+// Maximum size of a header parsers need to find a keyframe
+const maxHeaderSize = mpegts.PacketSize
+
+// gopCache keeps incoming data from the last keyframe,
+// so a new output can decode the stream immediately.
+type gopCache struct {
+	// Maximum size of cached data in bytes
+	maxSize int
+
+	// Parser is chosen when receiving the first message
+	parser keyframeParser
+
+	// Absolute stream position after last message
+	pos int64
+
+	// Cached messages since last keyframe
+	messages [][]byte
+	size     int
+
+	// False when there is no keyframe yet or when the cache overflowed
+	valid bool
+}
+
+func newGOPCache(maxSize int) *gopCache {
+	return &gopCache{maxSize: maxSize}
+}
+
+// write follows the stream and updates the cache.
+// It returns the offset in data of the first keyframe, or -1 if there is none.
+// Messages are not copied, so producers must not reuse their buffers.
+func (c *gopCache) write(data []byte) int {
+	if len(data) == 0 {
+		return -1
+	}
+
+	// Detect stream format on first message
+	if c.parser == nil {
+		switch {
+		case data[0] == mpegts.SyncByte:
+			c.parser = &tsParser{}
+		case flv.IsHeader(data):
+			c.parser = &flvParser{}
+		default:
+			// Unknown format, consider each message can be decoded alone
+			c.parser = &rawParser{}
+		}
+	}
+
+	start := c.pos
+	c.pos += int64(len(data))
+	keyframes := c.parser.parse(data)
+	if c.maxSize > 0 {
+		c.store(data, start, keyframes)
+	}
+
+	for _, k := range keyframes {
+		if k >= start {
+			return int(k - start)
+		}
+	}
+	return -1
+}
+
+// store keeps data since last keyframe.
+func (c *gopCache) store(data []byte, start int64, keyframes []int64) {
+	// Without keyframe, only keep last bytes as a keyframe header can be split
+	for !c.valid && len(c.messages) > 0 && c.size-len(c.messages[0]) >= maxHeaderSize {
+		c.trim(len(c.messages[0]))
+	}
+	cacheStart := start - int64(c.size)
+	c.append(data)
+
+	// Restart cache from last keyframe
+	if len(keyframes) > 0 {
+		if k := keyframes[len(keyframes)-1]; k >= cacheStart {
+			c.trim(int(k - cacheStart))
+			c.valid = true
+		} else {
+			// Keyframe started in data we did not keep
+			c.clear()
+		}
+	}
+
+	// If the group of pictures is too large, wait for next keyframe
+	if c.size > c.maxSize {
+		c.clear()
+	}
+}
+
+func (c *gopCache) append(data []byte) {
+	c.messages = append(c.messages, data)
+	c.size += len(data)
+}
+
+// trim removes n bytes at the beginning of the cache.
+func (c *gopCache) trim(n int) {
+	c.size -= n
+	for n > 0 && len(c.messages) > 0 {
+		if n < len(c.messages[0]) {
+			c.messages[0] = c.messages[0][n:]
+			break
+		}
+		n -= len(c.messages[0])
+		c.messages[0] = nil
+		c.messages = c.messages[1:]
+	}
+}
+
+func (c *gopCache) clear() {
+	c.messages = nil
+	c.size = 0
+	c.valid = false
+}
+
+// snapshot returns cached data in one message, or nil if nothing is cached.
+func (c *gopCache) snapshot() []byte {
+	if !c.valid {
+		return nil
+	}
+	header := c.parser.header()
+	data := make([]byte, 0, len(header)+c.size)
+	data = append(data, header...)
+	for _, msg := range c.messages {
+		data = append(data, msg...)
+	}
+	return data
+}
+
+// header returns the header to send before a keyframe, such as MPEG-TS
+// program tables or FLV sequence headers.
+func (c *gopCache) header() []byte {
+	if c.parser == nil {
+		return nil
+	}
+	return c.parser.header()
+}
+
+// media returns the media detected in the stream.
+func (c *gopCache) media() MediaInfo {
+	if c.parser == nil {
+		return MediaInfo{}
+	}
+	return c.parser.media()
+}
+
+// rawParser is used for unknown formats, each message is a keyframe
+type rawParser struct {
+	pos int64
+}
+
+func (p *rawParser) parse(data []byte) []int64 {
+	start := p.pos
+	p.pos += int64(len(data))
+	return []int64{start}
+}
+
+func (p *rawParser) header() []byte {
+	return nil
+}
+
+func (p *rawParser) media() MediaInfo {
+	return MediaInfo{}
+}
+
+// tsParser finds keyframes in a MPEG transport stream
+type tsParser struct {
+	pos int64
+
+	// Incomplete packet from previous message
+	partial []byte
+
+	pmtPID     uint16
+	videoPID   uint16
+	videoType  byte
+	audioCodec string
+
+	// Resolution and profile from last sequence parameter set
+	width, height int
+	videoProfile  string
+
+	// Last program tables
+	pat []byte
+	pmt []byte
+}
+
+func (p *tsParser) parse(data []byte) (keyframes []int64) {
+	start := p.pos
+	p.pos += int64(len(data))
+	i := 0
+
+	// Complete packet from previous message
+	if len(p.partial) > 0 {
+		n := mpegts.PacketSize - len(p.partial)
+		if n > len(data) {
+			p.partial = append(p.partial, data...)
+			return nil
+		}
+		p.partial = append(p.partial, data[:n]...)
+		if p.packet(p.partial) {
+			keyframes = append(keyframes, start-int64(len(p.partial)-n))
+		}
+		p.partial = p.partial[:0]
+		i = n
+	}
+
+	for i < len(data) {
+		if data[i] != mpegts.SyncByte {
+			// Lost synchronization
+			i++
+			continue
+		}
+		if i+mpegts.PacketSize > len(data) {
+			p.partial = append(p.partial, data[i:]...)
+			break
+		}
+		if p.packet(data[i : i+mpegts.PacketSize]) {
+			keyframes = append(keyframes, start+int64(i))
+		}
+		i += mpegts.PacketSize
+	}
+	return keyframes
+}
+
+// packet inspects one packet and returns true if it starts a keyframe.
+func (p *tsParser) packet(pkt []byte) bool {
+	pid := mpegts.PID(pkt)
+	switch {
+	case pid == mpegts.PATPID:
+		if pmtPID, ok := mpegts.ParsePAT(pkt); ok {
+			p.pmtPID = pmtPID
+			p.pat = append(p.pat[:0], pkt...)
+		}
+	case pid == p.pmtPID && p.pmtPID != 0:
+		if streams, ok := mpegts.ParsePMT(pkt); ok {
+			// First video and audio streams are described
+			p.videoPID, p.videoType, p.audioCodec = 0, 0, ""
+			for _, es := range streams {
+				switch {
+				case mpegts.IsVideo(es.StreamType) && p.videoPID == 0:
+					p.videoPID = es.PID
+					p.videoType = es.StreamType
+				case es.IsAudio() && p.audioCodec == "":
+					p.audioCodec = es.Codec()
+				}
+			}
+			p.pmt = append(p.pmt[:0], pkt...)
+		}
+	case pid == p.videoPID && p.videoPID != 0 && mpegts.PayloadUnitStart(pkt):
+		if p.videoType != mpegts.StreamTypeH264 {
+			return mpegts.RandomAccess(pkt)
+		}
+
+		// Some muxers do not set random access indicator
+		payload := mpegts.Payload(pkt)
+		if len(payload) <= 9 || len(payload) <= 9+int(payload[8]) {
+			return mpegts.RandomAccess(pkt)
+		}
+		es := payload[9+int(payload[8]):]
+		keyframe := mpegts.RandomAccess(pkt) || h264.IsKeyframe(es)
+		if keyframe {
+			p.parseSPS(es)
+		}
+		return keyframe
+	}
+	return false
+}
+
+// parseSPS updates resolution and profile from a sequence parameter set,
+// if present.
+func (p *tsParser) parseSPS(es []byte) {
+	for _, nalu := range h264.SplitAnnexB(es) {
+		if len(nalu) < 1 || nalu[0]&0x1f != h264.NALUTypeSPS {
+			continue
+		}
+		sps, err := h264.ParseSPS(nalu)
+		if err != nil {
+			log.Printf("Failed to parse H.264 sequence parameter set: %s", err)
+			return
+		}
+		p.width, p.height = sps.Width, sps.Height
+		p.videoProfile = sps.ProfileLevelID()
+		return
+	}
+}
+
+func (p *tsParser) media() MediaInfo {
+	return MediaInfo{
+		VideoCodec:   mpegts.CodecName(p.videoType),
+		AudioCodec:   p.audioCodec,
+		Width:        p.width,
+		Height:       p.height,
+		VideoProfile: p.videoProfile,
+	}
+}
+
+func (p *tsParser) header() []byte {
+	if p.pat == nil || p.pmt == nil {
+		return nil
+	}
+	header := make([]byte, 0, 2*mpegts.PacketSize)
+	header = append(header, p.pat...)
+	return append(header, p.pmt...)
+}
+
+// flvParser finds keyframes in a FLV stream
+type flvParser struct {
+	pos int64
+
+	// File header was read
+	started bool
+
+	// Bytes of current file header or tag that are kept
+	partial  []byte
+	tagStart int64
+
+	// Current tag header, once read
+	tag       flv.TagHeader
+	hasHeader bool
+
+	// Current tag is kept entirely
+	keep bool
+
+	// Bytes to skip from current tag
+	skip int
+
+	// Parser cannot follow the stream anymore
+	lost bool
+
+	// Detected media
+	info MediaInfo
+
+	// Headers every decoder needs
+	fileHeader  []byte
+	scriptTag   []byte
+	videoHeader []byte
+	audioHeader []byte
+}
+
+// Tags larger than this are not kept as headers
+const flvMaxHeaderTagSize = 64 * 1024
+
+// want returns the number of bytes to collect before taking a decision.
+func (p *flvParser) want() int {
+	switch {
+	case !p.started:
+		return flv.HeaderSize
+	case !p.hasHeader:
+		return flv.TagHeaderSize
+	case p.keep:
+		return p.tag.Size()
+	case p.tag.DataSize < 2:
+		return flv.TagHeaderSize + p.tag.DataSize
+	}
+	return flv.TagHeaderSize + 2
+}
+
+func (p *flvParser) parse(data []byte) (keyframes []int64) {
+	start := p.pos
+	p.pos += int64(len(data))
+	i := 0
+	for i < len(data) && !p.lost {
+		// Skip tag body
+		if p.skip > 0 {
+			n := p.skip
+			if n > len(data)-i {
+				n = len(data) - i
+			}
+			p.skip -= n
+			i += n
+			continue
+		}
+
+		// Collect bytes
+		if len(p.partial) == 0 {
+			p.tagStart = start + int64(i)
+		}
+		want := p.want()
+		n := want - len(p.partial)
+		if n > len(data)-i {
+			n = len(data) - i
+		}
+		p.partial = append(p.partial, data[i:i+n]...)
+		i += n
+		if len(p.partial) < want {
+			// Wait for next message
+			break
+		}
+
+		switch {
+		case !p.started:
+			// File header
+			p.fileHeader = append([]byte{}, p.partial...)
+			p.started = true
+			p.partial = p.partial[:0]
+		case !p.hasHeader:
+			// Tag header
+			p.tag = flv.ParseTagHeader(p.partial)
+			if p.tag.Type != flv.TagTypeAudio && p.tag.Type != flv.TagTypeVideo && p.tag.Type != flv.TagTypeScript {
+				p.lost = true
+			}
+			p.hasHeader = true
+		case p.keep:
+			// Complete header tag
+			tag := append([]byte{}, p.partial...)
+			switch p.tag.Type {
+			case flv.TagTypeScript:
+				p.scriptTag = tag
+			case flv.TagTypeVideo:
+				p.videoHeader = tag
+				p.parseSPS(tag[flv.TagHeaderSize:])
+			case flv.TagTypeAudio:
+				p.audioHeader = tag
+			}
+			p.keep = false
+			p.hasHeader = false
+			p.partial = p.partial[:0]
+		default:
+			// First bytes of tag data
+			body := p.partial[flv.TagHeaderSize:]
+			switch p.tag.Type {
+			case flv.TagTypeVideo:
+				if flv.IsVideoKeyframe(body) {
+					keyframes = append(keyframes, p.tagStart)
+				}
+				if codec := flv.VideoCodecName(body); codec != "" {
+					p.info.VideoCodec = codec
+				}
+			case flv.TagTypeAudio:
+				if codec := flv.AudioCodecName(body); codec != "" {
+					p.info.AudioCodec = codec
+				}
+			}
+			keep := p.tag.Type == flv.TagTypeScript || flv.IsSequenceHeader(p.tag.Type, body)
+			if keep && p.tag.Size() <= flvMaxHeaderTagSize {
+				p.keep = true
+				continue
+			}
+			p.skip = p.tag.Size() - len(p.partial)
+			p.hasHeader = false
+			p.partial = p.partial[:0]
+		}
+	}
+	return keyframes
+}
+
+// parseSPS updates resolution and profile from an AVC sequence header.
+func (p *flvParser) parseSPS(data []byte) {
+	nalu := flv.AVCSequenceHeaderSPS(data)
+	if nalu == nil {
+		return
+	}
+	sps, err := h264.ParseSPS(nalu)
+	if err != nil {
+		log.Printf("Failed to parse H.264 sequence parameter set: %s", err)
+		return
+	}
+	p.info.Width, p.info.Height = sps.Width, sps.Height
+	p.info.VideoProfile = sps.ProfileLevelID()
+}
+
+func (p *flvParser) media() MediaInfo {
+	return p.info
+}
+
+func (p *flvParser) header() []byte {
+	header := make([]byte, 0, len(p.fileHeader)+len(p.scriptTag)+len(p.videoHeader)+len(p.audioHeader))
+	header = append(header, p.fileHeader...)
+	header = append(header, p.scriptTag...)
+	header = append(header, p.videoHeader...)
+	return append(header, p.audioHeader...)
+}
@@ -0,0 +1,41 @@
+// Package messaging defines a structure to communication between inputs and outputs
+package messaging
+
+import (
+	"time"
+)
+
+// MediaInfo describes the media detected in a quality.
+// Fields are empty until detected.
+type MediaInfo struct {
+	VideoCodec string
+	AudioCodec string
+	Width      int
+	Height     int
+
+	// H.264 profile-level-id of video, as in SDP
+	VideoProfile string
+
+	// Incoming bitrate in bits per second
+	Bitrate int
+}
+
+// Metadata describes a stream.
+// Ingest handlers fill it in, media information is detected on source quality.
+type Metadata struct {
+	Title       string
+	Description string
+
+	// Username of the publisher
+	Publisher string
+
+	StartTime time.Time
+
+	// Ingest protocol, such as "srt"
+	Protocol string
+
+	// Address of the publisher, it is not published
+	RemoteAddr string `json:"-"`
+
+	MediaInfo
+}
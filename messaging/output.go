@@ -0,0 +1,231 @@
+// Package messaging defines a structure to communication between inputs and outputs
+package messaging
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"gitlab.crans.org/nounous/ghostream/internal/monitoring"
+)
+
+// PolicyMode defines what happens when an output does not read fast enough.
+type PolicyMode int
+
+const (
+	// DropOldest removes the oldest message of a full output,
+	// this breaks the stream until next keyframe.
+	DropOldest PolicyMode = iota
+
+	// DropUntilKeyframe drops incoming messages until next keyframe,
+	// so the output never receives a broken group of pictures.
+	DropUntilKeyframe
+
+	// Disconnect closes a full output.
+	Disconnect
+
+	// Block waits for the output without delaying other outputs,
+	// then closes the output if it is still full after the timeout.
+	Block
+)
+
+// String returns policy mode name, used in monitoring.
+func (m PolicyMode) String() string {
+	switch m {
+	case DropOldest:
+		return "drop-oldest"
+	case DropUntilKeyframe:
+		return "drop-until-keyframe"
+	case Disconnect:
+		return "disconnect"
+	case Block:
+		return "block"
+	}
+	return "unknown"
+}
+
+// Policy defines how a quality sends data to an output.
+type Policy struct {
+	// Kind of output in statistics and monitoring, such as "srt" or "hls"
+	Name string
+
+	// What to do when output is full
+	Mode PolicyMode
+
+	// Maximum duration to wait for output with Block mode
+	Timeout time.Duration
+}
+
+const (
+	// Size of the queue of an output with Block mode
+	blockQueueSize = 1024
+
+	// Timeout used with Block mode if policy does not define one
+	defaultBlockTimeout = 10 * time.Second
+)
+
+// OutputStats holds statistics about one output.
+type OutputStats struct {
+	Policy  Policy
+	Dropped uint64
+	Queued  int
+}
+
+// output wraps a channel registered on a quality
+type output struct {
+	ch     chan []byte
+	policy Policy
+
+	// Stream name used in monitoring
+	stream string
+
+	// Number of dropped messages, use atomic operations
+	dropped uint64
+
+	// Waiting for next keyframe after dropping data
+	waitKeyframe bool
+
+	// Send stream header with next keyframe, as publisher changed
+	replayHeader bool
+
+	// With Block mode, messages go through this queue.
+	// A goroutine waits on the output so that the quality never blocks.
+	queue chan []byte
+
+	// Output was closed because it was too slow
+	kicked chan struct{}
+}
+
+func newOutput(ch chan []byte, policy Policy, stream string) *output {
+	o := &output{ch: ch, policy: policy, stream: stream}
+	if o.policy.Name == "" {
+		o.policy.Name = "unknown"
+	}
+	if policy.Mode == Block {
+		if o.policy.Timeout <= 0 {
+			o.policy.Timeout = defaultBlockTimeout
+		}
+		o.queue = make(chan []byte, blockQueueSize)
+		o.kicked = make(chan struct{})
+		go o.pump()
+	}
+	return o
+}
+
+// send a message to the output, keyframe is the offset of the first keyframe
+// in the message or -1, header is the stream header to send before it.
+// It returns false if the output should be disconnected.
+func (o *output) send(msg []byte, keyframe int, header []byte) bool {
+	if o.waitKeyframe {
+		if keyframe < 0 {
+			o.drop()
+			return true
+		}
+		// Resume from keyframe
+		msg = msg[keyframe:]
+		if o.replayHeader {
+			msg = append(append(make([]byte, 0, len(header)+len(msg)), header...), msg...)
+			o.replayHeader = false
+		}
+		o.waitKeyframe = false
+	}
+
+	if o.policy.Mode == Block {
+		select {
+		case <-o.kicked:
+			// Pump timed out
+			return false
+		case o.queue <- msg:
+			return true
+		default:
+			return false
+		}
+	}
+
+	select {
+	case o.ch <- msg:
+		return true
+	default:
+	}
+
+	// Output is full
+	switch o.policy.Mode {
+	case DropOldest:
+		select {
+		case <-o.ch:
+		default:
+		}
+		o.drop()
+		select {
+		case o.ch <- msg:
+		default:
+			o.drop()
+		}
+	case DropUntilKeyframe:
+		o.drop()
+		o.waitKeyframe = true
+	case Disconnect:
+		return false
+	}
+	return true
+}
+
+func (o *output) drop() {
+	atomic.AddUint64(&o.dropped, 1)
+	monitoring.MessagingDroppedMessages.WithLabelValues(o.stream, o.policy.Name, o.policy.Mode.String()).Inc()
+}
+
+// pump sends queued messages to output, used with Block mode.
+func (o *output) pump() {
+	timer := time.NewTimer(o.policy.Timeout)
+	defer timer.Stop()
+	for msg := range o.queue {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(o.policy.Timeout)
+		select {
+		case o.ch <- msg:
+			continue
+		case <-timer.C:
+			log.Printf("Output blocked for more than %s, disconnecting it", o.policy.Timeout)
+			close(o.kicked)
+		}
+		break
+	}
+
+	// Queue was closed or output timed out
+	close(o.ch)
+}
+
+// close the output, it must have been removed from quality outputs.
+// If kick is true, the output is closed because it was too slow.
+func (o *output) close(kick bool) {
+	if kick {
+		monitoring.MessagingDisconnectedOutputs.WithLabelValues(o.stream, o.policy.Name, o.policy.Mode.String()).Inc()
+	}
+	if dropped := atomic.LoadUint64(&o.dropped); dropped > 0 {
+		log.Printf("%s output of stream %s with policy %s dropped %d messages", o.policy.Name, o.stream, o.policy.Mode, dropped)
+	}
+	if o.queue != nil {
+		// Pump will close output
+		close(o.queue)
+		return
+	}
+	close(o.ch)
+}
+
+func (o *output) stats() OutputStats {
+	queued := len(o.ch)
+	if o.queue != nil {
+		queued += len(o.queue)
+	}
+	return OutputStats{
+		Policy:  o.policy,
+		Dropped: atomic.LoadUint64(&o.dropped),
+		Queued:  queued,
+	}
+}
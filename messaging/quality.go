@@ -2,38 +2,45 @@
 package messaging
 
 import (
+	"log"
 	"sync"
+	"time"
 
-	"github.com/pion/webrtc/v3"
+	"gitlab.crans.org/nounous/ghostream/internal/monitoring"
 )
 
 // Quality holds a specific stream quality.
 // It makes packages able to subscribe to an incoming stream.
 type Quality struct {
+	// Names used in monitoring
+	streamName string
+	name       string
+
 	// Incoming data come from this channel
 	Broadcast chan<- []byte
 
 	// Incoming data will be outputted to all those outputs.
 	// Use a map to be able to delete an item.
-	outputs map[chan []byte]struct{}
+	outputs map[chan []byte]*output
 
-	// Mutex to lock outputs map
+	// Mutex to lock outputs map and cache
 	lockOutputs sync.Mutex
 
-	// WebRTC session descriptor exchange.
-	// When new client connects, a SDP arrives on WebRtcRemoteSdp,
-	// then webrtc package answers on WebRtcLocalSdp.
-	WebRtcLocalSdp  chan webrtc.SessionDescription
-	WebRtcRemoteSdp chan webrtc.SessionDescription
+	// Data since last keyframe, replayed to new outputs
+	cache *gopCache
+
+	// Bitrate measurement, protected by lockOutputs
+	bitrate       int
+	windowBytes   int
+	windowStarted time.Time
 }
 
-func newQuality() (q *Quality) {
-	q = &Quality{}
+func newQuality(streamName, name string, cfg *Options) (q *Quality) {
+	q = &Quality{streamName: streamName, name: name}
 	broadcast := make(chan []byte, 1024)
 	q.Broadcast = broadcast
-	q.outputs = make(map[chan []byte]struct{})
-	q.WebRtcLocalSdp = make(chan webrtc.SessionDescription, 1)
-	q.WebRtcRemoteSdp = make(chan webrtc.SessionDescription, 1)
+	q.outputs = make(map[chan []byte]*output)
+	q.cache = newGOPCache(cfg.GOPCacheSize)
 	go q.run(broadcast)
 	return q
 }
@@ -41,49 +48,134 @@ func newQuality() (q *Quality) {
 func (q *Quality) run(broadcast <-chan []byte) {
 	for msg := range broadcast {
 		q.lockOutputs.Lock()
-		for output := range q.outputs {
-			select {
-			case output <- msg:
-			default:
-				// If full, do a ring buffer
-				// Check that output is not of size zero
-				if len(output) > 1 {
-					<-output
-				}
+		if isResetMarker(msg) {
+			// New publisher, restart stream parsing and resume outputs on
+			// next keyframe, with the header of the new publisher
+			q.cache = newGOPCache(q.cache.maxSize)
+			for _, o := range q.outputs {
+				o.waitKeyframe = true
+				o.replayHeader = true
+			}
+			q.lockOutputs.Unlock()
+			continue
+		}
+		q.measure(len(msg))
+		keyframe := q.cache.write(msg)
+		var header []byte
+		if keyframe >= 0 {
+			header = q.cache.header()
+		}
+		for ch, o := range q.outputs {
+			if !o.send(msg, keyframe, header) {
+				log.Printf("Disconnecting output with policy %s as it is too slow", o.policy.Mode)
+				delete(q.outputs, ch)
+				o.close(true)
 			}
 		}
 		q.lockOutputs.Unlock()
 	}
 
 	// Incoming chan has been closed, close all outputs
+	monitoring.MessagingIncomingBitrate.DeleteLabelValues(q.streamName, q.name)
 	q.lockOutputs.Lock()
-	for ch := range q.outputs {
+	for ch, o := range q.outputs {
 		delete(q.outputs, ch)
-		close(ch)
+		o.close(false)
 	}
 	q.lockOutputs.Unlock()
 }
 
+// resetMarker is sent on broadcast channel to reset the quality,
+// it is recognized by its address so it never conflicts with data.
+var resetMarker = make([]byte, 0, 1)
+
+func isResetMarker(msg []byte) bool {
+	return len(msg) == 0 && cap(msg) == 1 && &msg[:1][0] == &resetMarker[:1][0]
+}
+
+// Reset must be called when a new publisher starts sending to this quality,
+// before sending any data.
+// Data already sent by previous publisher is still broadcasted, then outputs
+// wait for the first keyframe of the new publisher.
+func (q *Quality) Reset() {
+	q.Broadcast <- resetMarker
+}
+
+// Period of bitrate measurement
+const bitrateWindow = 2 * time.Second
+
+// measure updates incoming bitrate.
+func (q *Quality) measure(n int) {
+	now := time.Now()
+	if q.windowStarted.IsZero() {
+		q.windowStarted = now
+	}
+	q.windowBytes += n
+	if elapsed := now.Sub(q.windowStarted); elapsed >= bitrateWindow {
+		q.bitrate = int(float64(q.windowBytes*8) / elapsed.Seconds())
+		q.windowBytes = 0
+		q.windowStarted = now
+		monitoring.MessagingIncomingBitrate.WithLabelValues(q.streamName, q.name).Set(float64(q.bitrate))
+	}
+}
+
+// MediaInfo returns the media detected in this quality.
+func (q *Quality) MediaInfo() MediaInfo {
+	q.lockOutputs.Lock()
+	defer q.lockOutputs.Unlock()
+	info := q.cache.media()
+	info.Bitrate = q.bitrate
+	return info
+}
+
 // Close the incoming chan, this will also delete all outputs.
 func (q *Quality) Close() {
 	close(q.Broadcast)
 }
 
 // Register a new output on a stream.
-func (q *Quality) Register(output chan []byte) {
+// If data since last keyframe is cached, it is sent first in one message.
+// The policy defines what happens when the output does not read fast enough.
+func (q *Quality) Register(ch chan []byte, policy Policy) {
 	q.lockOutputs.Lock()
-	q.outputs[output] = struct{}{}
+	o := newOutput(ch, policy, q.streamName)
+	if data := q.cache.snapshot(); data != nil {
+		if !o.send(data, 0, nil) {
+			log.Printf("Failed to replay cached data to new output")
+		}
+	}
+	q.outputs[ch] = o
 	q.lockOutputs.Unlock()
 }
 
 // Unregister removes an output.
-func (q *Quality) Unregister(output chan []byte) {
+func (q *Quality) Unregister(ch chan []byte) {
 	// Make sure we did not already close this output
 	q.lockOutputs.Lock()
-	_, ok := q.outputs[output]
-	if ok {
-		delete(q.outputs, output)
-		close(output)
+	defer q.lockOutputs.Unlock()
+	if o, ok := q.outputs[ch]; ok {
+		delete(q.outputs, ch)
+		o.close(false)
+	}
+}
+
+// Dropped returns the number of messages dropped for an output.
+func (q *Quality) Dropped(ch chan []byte) uint64 {
+	q.lockOutputs.Lock()
+	defer q.lockOutputs.Unlock()
+	if o, ok := q.outputs[ch]; ok {
+		return o.stats().Dropped
 	}
+	return 0
+}
+
+// OutputStats returns statistics of all outputs.
+func (q *Quality) OutputStats() []OutputStats {
+	q.lockOutputs.Lock()
 	defer q.lockOutputs.Unlock()
+	stats := make([]OutputStats, 0, len(q.outputs))
+	for _, o := range q.outputs {
+		stats = append(stats, o.stats())
+	}
+	return stats
 }
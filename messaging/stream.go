@@ -3,11 +3,16 @@ package messaging
 
 import (
 	"errors"
+	"sort"
 	"sync"
+	"time"
 )
 
 // Stream makes packages able to subscribe to an incoming stream
 type Stream struct {
+	// Name of this stream
+	name string
+
 	// Different qualities of this stream
 	qualities map[string]*Quality
 
@@ -16,32 +21,54 @@ type Stream struct {
 
 	// Count clients for statistics
 	nbClients int
+
+	// Mutex to lock nbClients
+	lockClients sync.Mutex
+
+	// Stream description
+	metadata Metadata
+
+	// Mutex to lock metadata
+	lockMetadata sync.Mutex
+
+	// Messaging configuration
+	cfg *Options
+
+	// Running while the stream has no publisher, protected by Streams lock
+	releaseTimer *time.Timer
+
+	// Announce an event to streams subscribers
+	publish func(Event)
 }
 
-func newStream() (s *Stream) {
-	s = &Stream{}
+func newStream(name string, cfg *Options, publish func(Event)) (s *Stream) {
+	s = &Stream{name: name, cfg: cfg, publish: publish}
 	s.qualities = make(map[string]*Quality)
 	s.nbClients = 0
+	s.metadata.StartTime = time.Now()
 	return s
 }
 
 // Close stream.
 func (s *Stream) Close() {
-	for quality := range s.qualities {
-		s.DeleteQuality(quality)
+	for _, name := range s.Qualities() {
+		s.DeleteQuality(name)
 	}
 }
 
 // CreateQuality creates a new quality associated with this stream.
 func (s *Stream) CreateQuality(name string) (quality *Quality, err error) {
+	s.lockQualities.Lock()
+
 	// If quality already exist, fail
 	if _, ok := s.qualities[name]; ok {
+		s.lockQualities.Unlock()
 		return nil, errors.New("quality already exists")
 	}
 
-	s.lockQualities.Lock()
-	quality = newQuality()
+	quality = newQuality(s.name, name, s.cfg)
 	s.qualities[name] = quality
+	s.publish(Event{Type: QualityCreated, Stream: s.name, Quality: name})
 	s.lockQualities.Unlock()
 	return quality, nil
 }
@@ -50,9 +77,11 @@ func (s *Stream) CreateQuality(name string) (quality *Quality, err error) {
 func (s *Stream) DeleteQuality(name string) {
 	// Make sure we did not already close this output
 	s.lockQualities.Lock()
-	if _, ok := s.qualities[name]; ok {
-		s.qualities[name].Close()
+	quality, ok := s.qualities[name]
+	if ok {
+		quality.Close()
 		delete(s.qualities, name)
+		s.publish(Event{Type: QualityDeleted, Stream: s.name, Quality: name})
 	}
 	s.lockQualities.Unlock()
 }
@@ -68,17 +97,63 @@ func (s *Stream) GetQuality(name string) (quality *Quality, err error) {
 	return quality, nil
 }
 
+// Qualities returns the sorted names of stream qualities.
+func (s *Stream) Qualities() []string {
+	s.lockQualities.Lock()
+	names := make([]string, 0, len(s.qualities))
+	for name := range s.qualities {
+		names = append(names, name)
+	}
+	s.lockQualities.Unlock()
+	sort.Strings(names)
+	return names
+}
+
 // ClientCount returns the number of clients.
 func (s *Stream) ClientCount() int {
+	s.lockClients.Lock()
+	defer s.lockClients.Unlock()
 	return s.nbClients
 }
 
 // IncrementClientCount increments the number of clients.
 func (s *Stream) IncrementClientCount() {
+	s.lockClients.Lock()
 	s.nbClients++
+	s.lockClients.Unlock()
+	s.publish(Event{Type: ViewerJoined, Stream: s.name})
 }
 
 // DecrementClientCount decrements the number of clients.
 func (s *Stream) DecrementClientCount() {
+	s.lockClients.Lock()
 	s.nbClients--
+	s.lockClients.Unlock()
+	s.publish(Event{Type: ViewerLeft, Stream: s.name})
+}
+
+// Metadata returns stream description,
+// with media information detected on source quality.
+func (s *Stream) Metadata() Metadata {
+	s.lockMetadata.Lock()
+	m := s.metadata
+	s.lockMetadata.Unlock()
+
+	if q, err := s.GetQuality("source"); err == nil {
+		m.MediaInfo = q.MediaInfo()
+	}
+	return m
+}
+
+// SetMetadata updates stream description.
+// Media information is ignored as it is detected on source quality,
+// and start time is kept if it is not set.
+func (s *Stream) SetMetadata(m Metadata) {
+	s.lockMetadata.Lock()
+	defer s.lockMetadata.Unlock()
+	if m.StartTime.IsZero() {
+		m.StartTime = s.metadata.StartTime
+	}
+	m.MediaInfo = MediaInfo{}
+	s.metadata = m
 }
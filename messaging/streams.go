@@ -4,9 +4,22 @@ package messaging
 import (
 	"errors"
 	"log"
+	"sort"
 	"sync"
+	"time"
 )
 
+// Options holds messaging package configuration
+type Options struct {
+	// Maximum size in bytes of data cached since last keyframe,
+	// 0 disables the cache
+	GOPCacheSize int
+
+	// Time a stream stays alive after its publisher left,
+	// so a reconnecting publisher does not interrupt outputs
+	GracePeriod time.Duration
+}
+
 // Streams hold all application streams.
 type Streams struct {
 	// Associate each stream name to the stream
@@ -15,62 +28,72 @@ type Streams struct {
 	// Mutex to lock streams
 	lockStreams sync.Mutex
 
-	// Subscribers get notified when a new stream is created
+	// Subscribers get notified on streams state changes
 	// Use a map to be able to delete a subscriber
-	eventSubscribers map[chan string]struct{}
+	eventSubscribers map[chan Event]*subscriber
 
 	// Mutex to lock eventSubscribers
 	lockSubscribers sync.Mutex
+
+	// Configuration given to new streams
+	cfg *Options
 }
 
 // New creates a new stream list.
-func New() (l *Streams) {
-	l = &Streams{}
+func New(cfg *Options) (l *Streams) {
+	l = &Streams{cfg: cfg}
 	l.streams = make(map[string]*Stream)
-	l.eventSubscribers = make(map[chan string]struct{})
+	l.eventSubscribers = make(map[chan Event]*subscriber)
 	return l
 }
 
-// Subscribe to get notified on new stream.
-func (l *Streams) Subscribe(output chan string) {
+// Subscribe to get notified on streams state changes.
+// Only events matching the filter are sent to output.
+// Stream and quality events are never dropped and arrive in order,
+// viewer events may be coalesced or dropped, see subscriber.
+func (l *Streams) Subscribe(output chan Event, filter Filter) {
 	l.lockSubscribers.Lock()
-	l.eventSubscribers[output] = struct{}{}
+	l.eventSubscribers[output] = newSubscriber(output, filter)
 	l.lockSubscribers.Unlock()
 }
 
-// Unsubscribe to no longer get notified on new stream.
-func (l *Streams) Unsubscribe(output chan string) {
+// Unsubscribe to no longer get notified, this closes output.
+func (l *Streams) Unsubscribe(output chan Event) {
 	// Make sure we did not already delete this subscriber
 	l.lockSubscribers.Lock()
-	if _, ok := l.eventSubscribers[output]; ok {
+	if sub, ok := l.eventSubscribers[output]; ok {
 		delete(l.eventSubscribers, output)
+		close(sub.done)
+	}
+	l.lockSubscribers.Unlock()
+}
+
+// publish an event to all subscribers.
+func (l *Streams) publish(e Event) {
+	l.lockSubscribers.Lock()
+	for _, sub := range l.eventSubscribers {
+		sub.push(e)
 	}
 	l.lockSubscribers.Unlock()
 }
 
 // Create a new stream.
 func (l *Streams) Create(name string) (s *Stream, err error) {
+	l.lockStreams.Lock()
+
 	// If stream already exist, fail
 	if _, ok := l.streams[name]; ok {
+		l.lockStreams.Unlock()
 		return nil, errors.New("stream already exists")
 	}
 
 	// Create stream
-	s = newStream()
-	l.lockStreams.Lock()
+	s = newStream(name, l.cfg, l.publish)
 	l.streams[name] = s
-	l.lockStreams.Unlock()
 
-	// Notify
-	l.lockSubscribers.Lock()
-	for sub := range l.eventSubscribers {
-		select {
-		case sub <- name:
-		default:
-			log.Printf("Failed to announce stream '%s' to subscriber", name)
-		}
-	}
-	l.lockSubscribers.Unlock()
+	// Notify before unlocking, so events follow the order of changes
+	l.publish(Event{Type: StreamCreated, Stream: name})
+	l.lockStreams.Unlock()
 	return s, nil
 }
 
@@ -86,13 +109,112 @@ func (l *Streams) Get(name string) (s *Stream, err error) {
 	return s, nil
 }
 
+// Names returns the sorted names of streams.
+func (l *Streams) Names() []string {
+	l.lockStreams.Lock()
+	names := make([]string, 0, len(l.streams))
+	for name := range l.streams {
+		names = append(names, name)
+	}
+	l.lockStreams.Unlock()
+	sort.Strings(names)
+	return names
+}
+
 // Delete a stream.
 func (l *Streams) Delete(name string) {
+	l.lockStreams.Lock()
+	l.deleteLocked(name)
+	l.lockStreams.Unlock()
+}
+
+// deleteLocked deletes a stream, lockStreams must be held.
+func (l *Streams) deleteLocked(name string) {
 	// Make sure we did not already delete this stream
+	s, ok := l.streams[name]
+	if !ok {
+		return
+	}
+	delete(l.streams, name)
+	if s.releaseTimer != nil {
+		s.releaseTimer.Stop()
+		s.releaseTimer = nil
+	}
+	s.Close()
+	l.publish(Event{Type: StreamDeleted, Stream: name})
+}
+
+// Release a stream when its publisher leaves.
+// The stream is deleted after the grace period, unless a publisher reclaims it.
+func (l *Streams) Release(name string) {
+	if l.cfg.GracePeriod <= 0 {
+		l.Delete(name)
+		return
+	}
+
 	l.lockStreams.Lock()
-	if _, ok := l.streams[name]; ok {
-		l.streams[name].Close()
-		delete(l.streams, name)
+	defer l.lockStreams.Unlock()
+	s, ok := l.streams[name]
+	if !ok || s.releaseTimer != nil {
+		return
 	}
-	l.lockStreams.Unlock()
+	var timer *time.Timer
+	timer = time.AfterFunc(l.cfg.GracePeriod, func() {
+		// Make sure the stream was not reclaimed meanwhile,
+		// a publisher cannot reclaim it until it is deleted
+		l.lockStreams.Lock()
+		defer l.lockStreams.Unlock()
+		if l.streams[name] == s && s.releaseTimer == timer {
+			log.Printf("No publisher came back for stream '%s', deleting it", name)
+			l.deleteLocked(name)
+		}
+	})
+	s.releaseTimer = timer
+}
+
+// Reclaim a released stream for a reconnecting publisher.
+// It fails if the stream does not exist or still has a publisher.
+func (l *Streams) Reclaim(name string) (s *Stream, err error) {
+	l.lockStreams.Lock()
+	defer l.lockStreams.Unlock()
+	s, ok := l.streams[name]
+	if !ok {
+		return nil, errors.New("stream does not exist")
+	}
+	if s.releaseTimer == nil {
+		return nil, errors.New("stream already has a publisher")
+	}
+	s.releaseTimer.Stop()
+	s.releaseTimer = nil
+	return s, nil
+}
+
+// Publish prepares the source quality of a stream for a new publisher.
+// A publisher reconnecting during the grace period reattaches to its stream,
+// so outputs keep running.
+func (l *Streams) Publish(name string, metadata Metadata) (s *Stream, q *Quality, err error) {
+	// Reattach to the stream if publisher is reconnecting
+	if s, err = l.Reclaim(name); err == nil {
+		if q, err = s.GetQuality("source"); err != nil {
+			l.Release(name)
+			return nil, nil, err
+		}
+		q.Reset()
+		s.SetMetadata(metadata)
+		log.Printf("Publisher reconnected to stream '%s'", name)
+		return s, q, nil
+	}
+
+	// Create stream
+	if s, err = l.Create(name); err != nil {
+		return nil, nil, err
+	}
+	s.SetMetadata(metadata)
+
+	// Create source quality
+	if q, err = s.CreateQuality("source"); err != nil {
+		l.Delete(name)
+		return nil, nil, err
+	}
+	return s, q, nil
 }
@@ -1,24 +1,37 @@
 package messaging
 
-import "testing"
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gitlab.crans.org/nounous/ghostream/internal/monitoring"
+	"gitlab.crans.org/nounous/ghostream/internal/mpegts"
+)
 
 func TestWithOneStream(t *testing.T) {
-	streams := New()
+	streams := New(&Options{})
+
+	// Subscribe to all events
+	event := make(chan Event)
+	streams.Subscribe(event, Filter{})
 
-	// Subscribe to new streams
-	event := make(chan string, 8)
-	streams.Subscribe(event)
+	// Subscribe to quality events of another stream
+	otherEvent := make(chan Event, 8)
+	streams.Subscribe(otherEvent, Filter{Stream: "other", Types: []EventType{QualityCreated, QualityDeleted}})
 
 	// Create a stream
 	stream, err := streams.Create("demo")
 	if err != nil {
 		t.Errorf("Failed to create stream")
 	}
-
-	// Check that we receive the creation event
-	e := <-event
-	if e != "demo" {
-		t.Errorf("Message has wrong content: %s != demo", e)
+	if _, err := streams.Create("demo"); err == nil {
+		t.Errorf("Created the same stream twice")
+	}
+	if names := streams.Names(); len(names) != 1 || names[0] != "demo" {
+		t.Errorf("Wrong stream names: %v", names)
 	}
 
 	// Create a quality
@@ -29,7 +42,7 @@ func TestWithOneStream(t *testing.T) {
 
 	// Register one output
 	output := make(chan []byte, 64)
-	quality.Register(output)
+	quality.Register(output, Policy{Mode: DropOldest})
 	stream.IncrementClientCount()
 
 	// Try to pass one message
@@ -52,4 +65,452 @@ func TestWithOneStream(t *testing.T) {
 	if count := stream.ClientCount(); count != 0 {
 		t.Errorf("Client counter returned %d, expected 0", count)
 	}
+
+	// Delete stream
+	streams.Delete("demo")
+
+	// Check that we received all events in order
+	expected := []Event{
+		{Type: StreamCreated, Stream: "demo"},
+		{Type: QualityCreated, Stream: "demo", Quality: "source"},
+		{Type: ViewerJoined, Stream: "demo"},
+		{Type: ViewerLeft, Stream: "demo"},
+		{Type: QualityDeleted, Stream: "demo", Quality: "source"},
+		{Type: StreamDeleted, Stream: "demo"},
+	}
+	for _, e := range expected {
+		if got := <-event; got != e {
+			t.Errorf("Received event %v, expected %v", got, e)
+		}
+	}
+
+	// Filtered subscriber did not receive anything
+	streams.Unsubscribe(otherEvent)
+	if e, ok := <-otherEvent; ok {
+		t.Errorf("Filtered subscriber received %v", e)
+	}
+	streams.Unsubscribe(event)
+}
+
+func TestEventOrder(t *testing.T) {
+	streams := New(&Options{})
+	event := make(chan Event)
+	streams.Subscribe(event, Filter{Types: []EventType{StreamCreated, StreamDeleted}})
+	defer streams.Unsubscribe(event)
+
+	// Create and delete the same stream concurrently
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				streams.Create("demo")
+				streams.Delete("demo")
+			}
+		}()
+	}
+	wg.Wait()
+	streams.Create("end")
+
+	// Events of the stream must alternate
+	created := false
+	for e := <-event; e.Stream != "end"; e = <-event {
+		if (e.Type == StreamCreated) == created {
+			t.Fatalf("Received %v while stream created is %v", e, created)
+		}
+		created = !created
+	}
+	if created {
+		t.Errorf("Last event of stream is not a deletion")
+	}
+}
+
+func TestViewerEventsBounded(t *testing.T) {
+	// Subscriber without goroutine, events stay queued
+	s := &subscriber{wake: make(chan struct{}, 1)}
+	s.push(Event{Type: StreamCreated, Stream: "demo"})
+
+	// Viewer events are dropped when too many are pending
+	for i := 0; i < 2*maxViewerEvents; i++ {
+		s.push(Event{Type: ViewerJoined, Stream: "demo"})
+	}
+	if s.viewers != maxViewerEvents || s.dropped != maxViewerEvents {
+		t.Errorf("Expected %d queued viewer events, got %d", maxViewerEvents, s.viewers)
+	}
+
+	// A viewer leaving cancels a pending join
+	s.push(Event{Type: ViewerLeft, Stream: "demo"})
+	if s.viewers != maxViewerEvents-1 {
+		t.Errorf("Viewer events were not coalesced, %d are queued", s.viewers)
+	}
+
+	// Stream events are never dropped
+	s.push(Event{Type: StreamDeleted, Stream: "demo"})
+	if e := s.queue[len(s.queue)-1]; e.Type != StreamDeleted {
+		t.Errorf("Stream event was dropped, last event is %v", e)
+	}
+}
+
+// tsPacket builds a MPEG-TS packet with given PID and payload
+func tsPacket(pid uint16, pusi, randomAccess bool, payload []byte) []byte {
+	pkt := make([]byte, 188)
+	pkt[0] = 0x47
+	pkt[1] = byte(pid >> 8)
+	if pusi {
+		pkt[1] |= 0x40
+	}
+	pkt[2] = byte(pid)
+	pkt[3] = 0x10
+	i := 4
+	if randomAccess {
+		pkt[3] |= 0x20
+		pkt[4] = 1
+		pkt[5] = 0x40
+		i = 6
+	}
+	copy(pkt[i:], payload)
+	return pkt
+}
+
+func TestGOPCache(t *testing.T) {
+	cache := newGOPCache(1024 * 1024)
+
+	// PAT announcing PMT on PID 0x1000, PMT announcing H.264 on PID 0x100
+	pat := tsPacket(0, true, false, []byte{0, 0x00, 0xb0, 13, 0, 1, 0xc1, 0, 0, 0, 1, 0xf0, 0x00, 0, 0, 0, 0})
+	pmt := tsPacket(0x1000, true, false, []byte{0, 0x02, 0xb0, 18, 0, 1, 0xc1, 0, 0, 0xe1, 0x00, 0xf0, 0, 0x1b, 0xe1, 0x00, 0xf0, 0, 0, 0, 0, 0})
+	other := tsPacket(0x100, false, false, nil)
+	keyframe := tsPacket(0x100, true, true, nil)
+
+	// First data has no keyframe, nothing is cached
+	cache.write(append(append([]byte{}, pat...), pmt...))
+	cache.write(other)
+	if data := cache.snapshot(); data != nil {
+		t.Errorf("Cache returned data before first keyframe")
+	}
+
+	// Send a keyframe split in two messages then more data
+	cache.write(append(append([]byte{}, other...), keyframe[:100]...))
+	cache.write(append(append([]byte{}, keyframe[100:]...), other...))
+	cache.write(other)
+
+	// Cache should return tables and data from keyframe
+	data := cache.snapshot()
+	if len(data) != 5*188 {
+		t.Fatalf("Cached data has wrong size: %d != %d", len(data), 5*188)
+	}
+	if !bytes.Equal(data[:188], pat) || !bytes.Equal(data[188:376], pmt) || !bytes.Equal(data[376:564], keyframe) {
+		t.Errorf("Cached data does not start with tables and keyframe")
+	}
+
+	// FLV stream
+	cache = newGOPCache(1024 * 1024)
+	fileHeader := []byte{'F', 'L', 'V', 1, 5, 0, 0, 0, 9, 0, 0, 0, 0}
+	videoTag := func(data ...byte) []byte {
+		tag := []byte{9, 0, 0, byte(len(data)), 0, 0, 0, 0, 0, 0, 0}
+		tag = append(tag, data...)
+		return append(tag, 0, 0, 0, byte(11+len(data)))
+	}
+	sequenceHeader := videoTag(0x17, 0, 0, 0, 0)
+	interframe := videoTag(0x27, 1, 0, 0, 0, 42)
+	keyframeTag := videoTag(0x17, 1, 0, 0, 0, 42)
+
+	cache.write(fileHeader)
+	stream := append(append(append([]byte{}, sequenceHeader...), interframe...), keyframeTag...)
+	stream = append(stream, interframe...)
+	for _, b := range stream {
+		// Worst case, one byte per message
+		cache.write([]byte{b})
+	}
+	data = cache.snapshot()
+	expected := append(append(append(append([]byte{}, fileHeader...), sequenceHeader...), keyframeTag...), interframe...)
+	if !bytes.Equal(data, expected) {
+		t.Errorf("Cached FLV data is wrong: %v != %v", data, expected)
+	}
+
+	// Cache is dropped when too large
+	cache.maxSize = 10
+	cache.write(interframe)
+	if data := cache.snapshot(); data != nil {
+		t.Errorf("Cache returned data after overflow")
+	}
+}
+
+func TestRegisterReplay(t *testing.T) {
+	streams := New(&Options{GOPCacheSize: 1024 * 1024})
+	stream, _ := streams.Create("demo")
+	quality, _ := stream.CreateQuality("source")
+
+	// Wait for keyframe to be broadcasted
+	first := make(chan []byte, 8)
+	quality.Register(first, Policy{})
+	keyframe := append([]byte{'F', 'L', 'V', 1, 5, 0, 0, 0, 9, 0, 0, 0, 0}, 9, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 0x17, 1, 0, 0, 0, 13)
+	quality.Broadcast <- keyframe
+	<-first
+
+	// New output gets the keyframe
+	output := make(chan []byte, 8)
+	quality.Register(output, Policy{})
+	if msg := <-output; !bytes.Equal(msg, keyframe) {
+		t.Errorf("Replayed message has wrong content: %v != %v", msg, keyframe)
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	// Monitoring counters are global, start from zero on each run
+	monitoring.MessagingDroppedMessages.DeleteLabelValues("demo", "srt", "drop-until-keyframe")
+	streams := New(&Options{})
+	stream, _ := streams.Create("demo")
+	quality, _ := stream.CreateQuality("source")
+
+	// This output is used to wait for messages to be broadcasted
+	sync := make(chan []byte, 64)
+	quality.Register(sync, Policy{})
+	broadcast := func(msgs ...[]byte) {
+		for _, msg := range msgs {
+			quality.Broadcast <- msg
+		}
+		for range msgs {
+			<-sync
+		}
+	}
+
+	// Send MPEG-TS tables
+	pat := tsPacket(0, true, false, []byte{0, 0x00, 0xb0, 13, 0, 1, 0xc1, 0, 0, 0, 1, 0xf0, 0x00, 0, 0, 0, 0})
+	pmt := tsPacket(0x1000, true, false, []byte{0, 0x02, 0xb0, 18, 0, 1, 0xc1, 0, 0, 0xe1, 0x00, 0xf0, 0, 0x1b, 0xe1, 0x00, 0xf0, 0, 0, 0, 0, 0})
+	other := tsPacket(0x100, false, false, nil)
+	keyframe := tsPacket(0x100, true, true, nil)
+	broadcast(append(append([]byte{}, pat...), pmt...))
+
+	dropOldest := make(chan []byte, 1)
+	quality.Register(dropOldest, Policy{Name: "telnet", Mode: DropOldest})
+	dropUntilKeyframe := make(chan []byte, 1)
+	quality.Register(dropUntilKeyframe, Policy{Name: "srt", Mode: DropUntilKeyframe})
+	disconnect := make(chan []byte, 1)
+	quality.Register(disconnect, Policy{Mode: Disconnect})
+	block := make(chan []byte)
+	quality.Register(block, Policy{Mode: Block, Timeout: time.Hour})
+
+	// Fill outputs
+	broadcast(keyframe, other)
+
+	// Drop until keyframe output kept first keyframe, then resumes on keyframe
+	if msg := <-dropUntilKeyframe; !bytes.Equal(msg, keyframe) {
+		t.Errorf("Drop until keyframe output did not get first keyframe")
+	}
+	marker := append(append([]byte{}, other...), keyframe...)
+	broadcast(marker)
+	if msg := <-dropUntilKeyframe; !bytes.Equal(msg, keyframe) {
+		t.Errorf("Drop until keyframe output did not resume on keyframe")
+	}
+	if n := quality.Dropped(dropUntilKeyframe); n != 1 {
+		t.Errorf("Drop until keyframe output dropped %d messages, expected 1", n)
+	}
+	dropped := monitoring.MessagingDroppedMessages.WithLabelValues("demo", "srt", "drop-until-keyframe")
+	if n := testutil.ToFloat64(dropped); n != 1 {
+		t.Errorf("Monitoring counted %f messages dropped by srt output, expected 1", n)
+	}
+
+	// Drop oldest output keeps last message
+	if msg := <-dropOldest; !bytes.Equal(msg, marker) {
+		t.Errorf("Drop oldest output did not get last message")
+	}
+	if n := quality.Dropped(dropOldest); n != 2 {
+		t.Errorf("Drop oldest output dropped %d messages, expected 2", n)
+	}
+
+	// Disconnect output was closed
+	<-disconnect
+	if _, ok := <-disconnect; ok {
+		t.Errorf("Slow output was not disconnected")
+	}
+
+	// Block output did not lose any message
+	for _, expected := range [][]byte{keyframe, other, marker} {
+		if msg := <-block; !bytes.Equal(msg, expected) {
+			t.Errorf("Blocking output did not receive all messages")
+		}
+	}
+	stats := quality.OutputStats()
+	if len(stats) != 4 {
+		t.Errorf("Quality has %d outputs, expected 4", len(stats))
+	}
+	for _, s := range stats {
+		if s.Policy.Name == "telnet" && s.Dropped != 2 {
+			t.Errorf("Statistics of telnet output count %d dropped messages, expected 2", s.Dropped)
+		}
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	streams := New(&Options{})
+	stream, _ := streams.Create("demo")
+	stream.SetMetadata(Metadata{Title: "Demo", Publisher: "demo", Protocol: "srt"})
+	quality, _ := stream.CreateQuality("source")
+
+	// Wait for messages to be broadcasted
+	output := make(chan []byte, 8)
+	quality.Register(output, Policy{})
+
+	// FLV stream with a 1920x1080 H.264 sequence header and AAC audio
+	sps := []byte{0x67, 0x42, 0xc0, 0x28, 0xf4, 0x03, 0xc0, 0x11, 0x3f, 0x2a}
+	record := append([]byte{0x17, 0, 0, 0, 0, 1, 0x42, 0xc0, 0x28, 0xff, 0xe1, 0, byte(len(sps))}, sps...)
+	record = append(record, 0)
+	videoTag := append([]byte{9, 0, 0, byte(len(record)), 0, 0, 0, 0, 0, 0, 0}, record...)
+	videoTag = append(videoTag, 0, 0, 0, byte(11+len(record)))
+	audioTag := []byte{8, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 0xaf, 1, 0, 0, 0, 13}
+	quality.Broadcast <- []byte{'F', 'L', 'V', 1, 5, 0, 0, 0, 9, 0, 0, 0, 0}
+	quality.Broadcast <- videoTag
+	quality.Broadcast <- audioTag
+	for i := 0; i < 3; i++ {
+		<-output
+	}
+
+	metadata := stream.Metadata()
+	if metadata.Title != "Demo" || metadata.Publisher != "demo" || metadata.Protocol != "srt" {
+		t.Errorf("Stream has wrong description: %v", metadata)
+	}
+	if metadata.StartTime.IsZero() {
+		t.Errorf("Stream has no start time")
+	}
+	if metadata.VideoCodec != "h264" || metadata.AudioCodec != "aac" {
+		t.Errorf("Detected codecs are wrong: %s, %s", metadata.VideoCodec, metadata.AudioCodec)
+	}
+	if metadata.Width != 1920 || metadata.Height != 1080 {
+		t.Errorf("Detected resolution is wrong: %dx%d", metadata.Width, metadata.Height)
+	}
+	if metadata.VideoProfile != "42c028" {
+		t.Errorf("Detected profile is wrong: %s", metadata.VideoProfile)
+	}
+
+	// MPEG-TS stream with the same H.264 keyframe and AAC audio
+	stream, _ = streams.Create("ts")
+	quality, _ = stream.CreateQuality("source")
+	quality.Register(output, Policy{})
+	buff := &bytes.Buffer{}
+	muxer := mpegts.NewMuxer(buff)
+	videoPID := muxer.AddStream(mpegts.StreamTypeH264, nil)
+	muxer.AddStream(mpegts.StreamTypeADTSAAC, nil)
+	keyframe := append([]byte{0, 0, 0, 1}, sps...)
+	keyframe = append(keyframe, 0, 0, 0, 1, 0x65, 0x88)
+	if err := muxer.WritePES(videoPID, 9000, 9000, true, keyframe); err != nil {
+		t.Fatalf("Failed to mux keyframe: %s", err)
+	}
+	quality.Broadcast <- buff.Bytes()
+	<-output
+
+	metadata = stream.Metadata()
+	if metadata.VideoCodec != "h264" || metadata.AudioCodec != "aac" {
+		t.Errorf("Detected codecs in MPEG-TS are wrong: %s, %s", metadata.VideoCodec, metadata.AudioCodec)
+	}
+	if metadata.Width != 1920 || metadata.Height != 1080 {
+		t.Errorf("Detected resolution in MPEG-TS is wrong: %dx%d", metadata.Width, metadata.Height)
+	}
+	if metadata.VideoProfile != "42c028" {
+		t.Errorf("Detected profile in MPEG-TS is wrong: %s", metadata.VideoProfile)
+	}
+}
+
+func TestGracePeriod(t *testing.T) {
+	streams := New(&Options{GracePeriod: 100 * time.Millisecond})
+	event := make(chan Event, 8)
+	streams.Subscribe(event, Filter{Types: []EventType{StreamDeleted}})
+	stream, _ := streams.Create("demo")
+	quality, _ := stream.CreateQuality("source")
+	output := make(chan []byte, 8)
+	quality.Register(output, Policy{})
+
+	// Stream with a publisher cannot be reclaimed
+	if _, err := streams.Reclaim("demo"); err == nil {
+		t.Errorf("Reclaimed a stream which has a publisher")
+	}
+
+	// Publisher leaves then comes back
+	streams.Release("demo")
+	if s, err := streams.Reclaim("demo"); err != nil || s != stream {
+		t.Fatalf("Failed to reclaim stream: %s", err)
+	}
+	quality.Reset()
+
+	// Output waits for a keyframe of the new publisher
+	keyframe := []byte("keyframe")
+	quality.Broadcast <- keyframe
+	if msg := <-output; !bytes.Equal(msg, keyframe) {
+		t.Errorf("Output received %v after reset, expected %v", msg, keyframe)
+	}
+
+	// Stream was not deleted during the grace period
+	time.Sleep(200 * time.Millisecond)
+	if _, err := streams.Get("demo"); err != nil {
+		t.Errorf("Reclaimed stream was deleted")
+	}
+
+	// Publisher leaves for good
+	streams.Release("demo")
+	if e := <-event; e.Stream != "demo" {
+		t.Errorf("Received deletion of stream %s, expected demo", e.Stream)
+	}
+	if _, ok := <-output; ok {
+		t.Errorf("Output was not closed after grace period")
+	}
+}
+
+func TestReclaimAtExpiry(t *testing.T) {
+	streams := New(&Options{GracePeriod: time.Millisecond})
+	_, quality, err := streams.Publish("demo", Metadata{})
+	if err != nil {
+		t.Fatalf("Failed to publish: %s", err)
+	}
+
+	// Publisher comes back when the grace period expires, it gets either
+	// the released stream or a new one, never a deleted stream
+	for i := 0; i < 200; i++ {
+		streams.Release("demo")
+		time.Sleep(time.Millisecond)
+		if _, quality, err = streams.Publish("demo", Metadata{}); err != nil {
+			t.Fatalf("Failed to publish again: %s", err)
+		}
+		quality.Broadcast <- []byte("data")
+	}
+	streams.Delete("demo")
+}
+
+func TestResetHeader(t *testing.T) {
+	streams := New(&Options{})
+	stream, _ := streams.Create("demo")
+	quality, _ := stream.CreateQuality("source")
+	output := make(chan []byte, 8)
+	quality.Register(output, Policy{})
+
+	// FLV tags of a publisher, sequence headers differ by their level
+	fileHeader := []byte{'F', 'L', 'V', 1, 5, 0, 0, 0, 9, 0, 0, 0, 0}
+	videoHeader := func(level byte) []byte {
+		return []byte{9, 0, 0, 9, 0, 0, 0, 0, 0, 0, 0, 0x17, 0, 0, 0, 0, 1, 0x42, 0xc0, level, 0, 0, 0, 20}
+	}
+	audioHeader := []byte{8, 0, 0, 4, 0, 0, 0, 0, 0, 0, 0, 0xaf, 0, 0x12, 0x10, 0, 0, 0, 15}
+	keyframe := []byte{9, 0, 0, 6, 0, 0, 0, 0, 0, 0, 0, 0x17, 1, 0, 0, 0, 0x65, 0, 0, 0, 17}
+	publish := func(level byte) {
+		for _, msg := range [][]byte{fileHeader, videoHeader(level), audioHeader, keyframe} {
+			quality.Broadcast <- msg
+		}
+	}
+	publish(0x1e)
+	for i := 0; i < 4; i++ {
+		<-output
+	}
+
+	// New publisher sends its header in other messages than its keyframe,
+	// output resumes on the keyframe and gets the new header first
+	quality.Reset()
+	publish(0x28)
+	expected := append(append(append(append([]byte{}, fileHeader...), videoHeader(0x28)...), audioHeader...), keyframe...)
+	if msg := <-output; !bytes.Equal(msg, expected) {
+		t.Errorf("Output received %v after reset, expected %v", msg, expected)
+	}
+
+	// Header is sent once
+	quality.Broadcast <- keyframe
+	if msg := <-output; !bytes.Equal(msg, keyframe) {
+		t.Errorf("Output received %v, expected %v", msg, keyframe)
+	}
 }
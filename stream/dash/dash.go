@@ -0,0 +1,43 @@
+// Package dash packages streams in MPEG-DASH fragmented MP4 segments and manifests
+package dash
+
+import (
+	"log"
+	"time"
+
+	"gitlab.crans.org/nounous/ghostream/internal/packaging"
+	"gitlab.crans.org/nounous/ghostream/messaging"
+)
+
+// Options holds dash package configuration
+type Options struct {
+	Enabled bool
+
+	// Segments are cut on the first keyframe after this duration
+	SegmentDuration time.Duration
+
+	// Number of segments in manifest
+	WindowSize int
+}
+
+// Packagers by stream then quality
+var packagers = packaging.NewRegistry("dash")
+
+// Serve packages each new quality
+func Serve(streams *messaging.Streams, cfg *Options) {
+	if !cfg.Enabled {
+		// DASH is not enabled, ignore
+		return
+	}
+
+	log.Printf("DASH packager initialized")
+	packagers.Serve(streams, func(quality *messaging.Quality) packaging.Packager {
+		return newPackager(quality, cfg)
+	})
+}
+
+// getPackager returns the packager of a stream quality, or nil
+func getPackager(name, qualityName string) *packager {
+	p, _ := packagers.Get(name, qualityName).(*packager)
+	return p
+}
@@ -0,0 +1,190 @@
+package dash
+
+import (
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.crans.org/nounous/ghostream/internal/packaging/packagingtest"
+	"gitlab.crans.org/nounous/ghostream/messaging"
+)
+
+// mpd holds the manifest attributes checked by tests
+type mpd struct {
+	Type                  string `xml:"type,attr"`
+	AvailabilityStartTime string `xml:"availabilityStartTime,attr"`
+	MinimumUpdatePeriod   string `xml:"minimumUpdatePeriod,attr"`
+	TimeShiftBufferDepth  string `xml:"timeShiftBufferDepth,attr"`
+	MaxSegmentDuration    string `xml:"maxSegmentDuration,attr"`
+	AdaptationSets        []struct {
+		ContentType     string `xml:"contentType,attr"`
+		Representations []struct {
+			ID       string `xml:"id,attr"`
+			Codecs   string `xml:"codecs,attr"`
+			Template struct {
+				Timescale      int64  `xml:"timescale,attr"`
+				Initialization string `xml:"initialization,attr"`
+				Media          string `xml:"media,attr"`
+				StartNumber    int    `xml:"startNumber,attr"`
+				Timeline       []struct {
+					T int64 `xml:"t,attr"`
+					D int64 `xml:"d,attr"`
+				} `xml:"SegmentTimeline>S"`
+			} `xml:"SegmentTemplate"`
+		} `xml:"Representation"`
+	} `xml:"Period>AdaptationSet"`
+}
+
+func get(url string) (int, string) {
+	return packagingtest.Get(Handle, url)
+}
+
+// publish packages a stream of given duration and returns its packager
+func publish(streams *messaging.Streams, seconds int) *packager {
+	stream, _ := streams.Create("demo")
+	quality, _ := stream.CreateQuality("source")
+	for getPackager("demo", "source") == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	quality.Broadcast <- packagingtest.Stream(seconds)
+
+	// Wait for last video segment, the one in progress is not finished
+	p := getPackager("demo", "source")
+	for ready := false; !ready; {
+		time.Sleep(10 * time.Millisecond)
+		p.lock.Lock()
+		ready = p.video != nil && len(p.video.segments) == seconds-1
+		p.lock.Unlock()
+	}
+	return p
+}
+
+func TestManifest(t *testing.T) {
+	cfg := Options{Enabled: true, SegmentDuration: time.Second, WindowSize: 3}
+	streams := messaging.New(&messaging.Options{})
+	go Serve(streams, &cfg)
+	time.Sleep(10 * time.Millisecond)
+	start := time.Now()
+	publish(streams, 6)
+	defer streams.Delete("demo")
+
+	code, body := get("/dash/demo/manifest.mpd")
+	var manifest mpd
+	if err := xml.Unmarshal([]byte(body), &manifest); code != http.StatusOK || err != nil {
+		t.Fatalf("Invalid manifest (%d, %v): %s", code, err, body)
+	}
+
+	// Live manifest, refreshed each segment, with a window of 3 segments
+	if manifest.Type != "dynamic" || manifest.AvailabilityStartTime != "1970-01-01T00:00:00Z" ||
+		manifest.MinimumUpdatePeriod != "PT1.000S" || manifest.TimeShiftBufferDepth != "PT3.000S" ||
+		manifest.MaxSegmentDuration != "PT2.000S" {
+		t.Errorf("Wrong manifest timing: %+v", manifest)
+	}
+	if len(manifest.AdaptationSets) != 2 || manifest.AdaptationSets[0].ContentType != "video" ||
+		manifest.AdaptationSets[1].ContentType != "audio" {
+		t.Fatalf("Wrong adaptation sets: %s", body)
+	}
+	video := manifest.AdaptationSets[0].Representations[0]
+	audio := manifest.AdaptationSets[1].Representations[0]
+	if video.ID != "source-video" || video.Codecs != "avc1.42c028" ||
+		audio.ID != "source-audio" || audio.Codecs != "mp4a.40.2" {
+		t.Errorf("Wrong representations: %s", body)
+	}
+
+	// Video timeline lists the last segments, one second long and contiguous.
+	// Media time counts from Unix epoch, in 90 kHz units.
+	template := video.Template
+	if template.Timescale != timescale || template.StartNumber != 2 || len(template.Timeline) != 3 {
+		t.Fatalf("Wrong video segment template: %+v", template)
+	}
+	first := time.Unix(template.Timeline[0].T/timescale, 0)
+	if first.Before(start.Add(-time.Second)) || first.After(start.Add(5*time.Second)) {
+		t.Errorf("Video timeline starts at %v, published at %v", first, start)
+	}
+	for i, s := range template.Timeline {
+		if s.D != timescale {
+			t.Errorf("Video segment %d lasts %d", i, s.D)
+		}
+		if i > 0 && s.T != template.Timeline[i-1].T+template.Timeline[i-1].D {
+			t.Errorf("Video segment %d starts at %d, previous ends at %d", i, s.T,
+				template.Timeline[i-1].T+template.Timeline[i-1].D)
+		}
+	}
+
+	// Audio is cut at most one audio frame after video, test audio frames
+	// are 80 ms long
+	for i, s := range audio.Template.Timeline {
+		if i >= len(template.Timeline) {
+			break
+		}
+		if v := template.Timeline[i].T; s.T < v || s.T > v+7200 {
+			t.Errorf("Audio segment %d starts at %d, video at %d", i, s.T, v)
+		}
+	}
+}
+
+func TestSegmentTemplate(t *testing.T) {
+	cfg := Options{Enabled: true, SegmentDuration: time.Second, WindowSize: 3}
+	streams := messaging.New(&messaging.Options{})
+	go Serve(streams, &cfg)
+	time.Sleep(10 * time.Millisecond)
+	publish(streams, 6)
+
+	_, body := get("/dash/demo/manifest.mpd")
+	var manifest mpd
+	if err := xml.Unmarshal([]byte(body), &manifest); err != nil || len(manifest.AdaptationSets) != 2 {
+		t.Fatalf("Invalid manifest (%v): %s", err, body)
+	}
+	video := manifest.AdaptationSets[0].Representations[0].Template
+	audio := manifest.AdaptationSets[1].Representations[0].Template
+	if video.Initialization != "source/video/init.mp4" || video.Media != "source/video/$Number$.m4s" ||
+		audio.Initialization != "source/audio/init.mp4" || audio.Media != "source/audio/$Number$.m4s" {
+		t.Errorf("Wrong segment template URLs: %+v %+v", video, audio)
+	}
+
+	// Initialization segments, relative to manifest
+	code, segment := get("/dash/demo/" + video.Initialization)
+	if code != http.StatusOK || segment[4:8] != "ftyp" || !strings.Contains(segment, "avcC") {
+		t.Errorf("Wrong video initialization segment (%d)", code)
+	}
+	code, segment = get("/dash/demo/" + audio.Initialization)
+	if code != http.StatusOK || !strings.Contains(segment, "mp4a") || !strings.Contains(segment, "esds") {
+		t.Errorf("Wrong audio initialization segment (%d)", code)
+	}
+
+	// Each listed segment is served, decode time is the one of timeline
+	for i, s := range video.Timeline {
+		url := "/dash/demo/" + strings.Replace(video.Media, "$Number$", fmt.Sprint(video.StartNumber+i), 1)
+		code, segment := get(url)
+		tfdt := strings.Index(segment, "tfdt")
+		if code != http.StatusOK || segment[4:8] != "moof" || tfdt < 0 {
+			t.Errorf("Wrong video segment %s (%d)", url, code)
+			continue
+		}
+		if decodeTime := int64(binary.BigEndian.Uint64([]byte(segment[tfdt+8:]))); decodeTime != s.T {
+			t.Errorf("Segment %s starts at %d, manifest says %d", url, decodeTime, s.T)
+		}
+	}
+
+	// Segment in progress and unknown segments are not served
+	for _, url := range []string{"/dash/demo/source/video/5.m4s", "/dash/demo/source/video/-1.m4s",
+		"/dash/demo/source/video/first.m4s", "/dash/demo/other/video/init.mp4",
+		"/dash/demo/source/text/init.mp4", "/dash/other/manifest.mpd"} {
+		if code, _ := get(url); code != http.StatusNotFound {
+			t.Errorf("%s returned %d instead of 404", url, code)
+		}
+	}
+
+	// Packager is removed with stream
+	streams.Delete("demo")
+	for getPackager("demo", "source") != nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if code, _ := get("/dash/demo/manifest.mpd"); code != http.StatusNotFound {
+		t.Errorf("Manifest of deleted stream returned %d", code)
+	}
+}
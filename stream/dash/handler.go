@@ -0,0 +1,179 @@
+// Package dash packages streams in MPEG-DASH fragmented MP4 segments and manifests
+package dash
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.crans.org/nounous/ghostream/internal/packaging"
+)
+
+// Bitrate announced for audio representations
+const audioBandwidth = 128000
+
+// Handle serves manifests and segments under /dash/<stream>/
+var Handle = packaging.Handler("/dash/", route)
+
+func route(w http.ResponseWriter, r *http.Request, path []string) {
+	switch {
+	case len(path) == 2 && path[1] == "manifest.mpd":
+		serveManifest(w, r, path[0])
+	case len(path) == 4 && (path[2] == "video" || path[2] == "audio"):
+		p := getPackager(path[0], path[1])
+		if p == nil {
+			http.NotFound(w, r)
+			return
+		}
+		p.serveSegment(w, r, path[2], path[3])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// representation is a track of a quality listed in manifest
+type representation struct {
+	quality   string
+	bandwidth int
+	width     int
+	height    int
+	track     track
+}
+
+// serveManifest lists the qualities of a stream, with video and audio
+// in separate adaptation sets
+func serveManifest(w http.ResponseWriter, r *http.Request, name string) {
+	var videos, audios []representation
+	var cfg *Options
+	for q, v := range packagers.Qualities(name) {
+		p := v.(*packager)
+		media := p.quality.MediaInfo()
+		bandwidth := media.Bitrate
+		if bandwidth == 0 {
+			// Bitrate is not measured yet
+			bandwidth = 1000000
+		}
+		cfg = p.cfg
+
+		// Copy tracks, segments are never modified once listed
+		p.lock.Lock()
+		if p.video != nil && len(p.video.segments) > 0 {
+			videos = append(videos, representation{q, bandwidth, media.Width, media.Height, *p.video})
+		}
+		if p.audio != nil && len(p.audio.segments) > 0 {
+			audios = append(audios, representation{quality: q, bandwidth: audioBandwidth, track: *p.audio})
+		}
+		p.lock.Unlock()
+	}
+	if len(videos) == 0 && len(audios) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Highest quality first
+	sort.Slice(videos, func(i, j int) bool {
+		return videos[i].bandwidth > videos[j].bandwidth
+	})
+	sort.Slice(audios, func(i, j int) bool {
+		return audios[i].quality < audios[j].quality
+	})
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	fmt.Fprintf(&b, `<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" profiles="urn:mpeg:dash:profile:isoff-live:2011" type="dynamic"`+
+		` availabilityStartTime="1970-01-01T00:00:00Z" publishTime="%s" minimumUpdatePeriod="%s" minBufferTime="%s"`+
+		` timeShiftBufferDepth="%s" suggestedPresentationDelay="%s" maxSegmentDuration="%s">`+"\n",
+		now, duration(cfg.SegmentDuration), duration(cfg.SegmentDuration),
+		duration(time.Duration(cfg.WindowSize)*cfg.SegmentDuration), duration(3*cfg.SegmentDuration),
+		duration(2*cfg.SegmentDuration))
+	b.WriteString(`  <Period id="0" start="PT0S">` + "\n")
+	if len(videos) > 0 {
+		b.WriteString(`    <AdaptationSet contentType="video" mimeType="video/mp4" segmentAlignment="true" startWithSAP="1">` + "\n")
+		for _, v := range videos {
+			fmt.Fprintf(&b, `      <Representation id="%s-video" bandwidth="%d" codecs="%s"`, v.quality, v.bandwidth, v.track.codecs)
+			if v.width > 0 && v.height > 0 {
+				fmt.Fprintf(&b, ` width="%d" height="%d"`, v.width, v.height)
+			}
+			b.WriteString(">\n")
+			writeSegmentTemplate(&b, v.quality+"/video", &v.track, cfg.WindowSize)
+			b.WriteString("      </Representation>\n")
+		}
+		b.WriteString("    </AdaptationSet>\n")
+	}
+	if len(audios) > 0 {
+		b.WriteString(`    <AdaptationSet contentType="audio" mimeType="audio/mp4" segmentAlignment="true" startWithSAP="1">` + "\n")
+		for _, a := range audios {
+			fmt.Fprintf(&b, `      <Representation id="%s-audio" bandwidth="%d" codecs="%s" audioSamplingRate="%d">`+"\n",
+				a.quality, a.bandwidth, a.track.codecs, a.track.sampleRate)
+			fmt.Fprintf(&b, `        <AudioChannelConfiguration schemeIdUri="urn:mpeg:dash:23003:3:audio_channel_configuration:2011" value="%d"/>`+"\n",
+				a.track.channels)
+			writeSegmentTemplate(&b, a.quality+"/audio", &a.track, cfg.WindowSize)
+			b.WriteString("      </Representation>\n")
+		}
+		b.WriteString("    </AdaptationSet>\n")
+	}
+	b.WriteString("  </Period>\n")
+
+	// Players synchronize their clock with the server
+	fmt.Fprintf(&b, `  <UTCTiming schemeIdUri="urn:mpeg:dash:utc:direct:2014" value="%s"/>`+"\n", now)
+	b.WriteString("</MPD>\n")
+
+	w.Header().Set("Content-Type", "application/dash+xml")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(b.String()))
+}
+
+// writeSegmentTemplate lists the last segments of a track
+func writeSegmentTemplate(b *strings.Builder, path string, t *track, windowSize int) {
+	segments := t.segments
+	if len(segments) > windowSize {
+		segments = segments[len(segments)-windowSize:]
+	}
+	fmt.Fprintf(b, `        <SegmentTemplate timescale="%d" initialization="%s/init.mp4" media="%s/$Number$.m4s" startNumber="%d">`+"\n",
+		timescale, path, path, segments[0].number)
+	b.WriteString("          <SegmentTimeline>\n")
+	for _, s := range segments {
+		fmt.Fprintf(b, `            <S t="%d" d="%d"/>`+"\n", s.start, s.duration)
+	}
+	b.WriteString("          </SegmentTimeline>\n")
+	b.WriteString("        </SegmentTemplate>\n")
+}
+
+// duration formats a xs:duration
+func duration(d time.Duration) string {
+	return fmt.Sprintf("PT%.3fS", d.Seconds())
+}
+
+// serveSegment serves the initialization segment "init.mp4" or
+// a media segment "<number>.m4s" of a track
+func (p *packager) serveSegment(w http.ResponseWriter, r *http.Request, kind, name string) {
+	var data []byte
+	p.lock.Lock()
+	t := p.audio
+	if kind == "video" {
+		t = p.video
+	}
+	if t != nil {
+		if name == "init.mp4" {
+			data = t.init
+		} else if number, err := strconv.Atoi(strings.TrimSuffix(name, ".m4s")); err == nil && strings.HasSuffix(name, ".m4s") {
+			for _, s := range t.segments {
+				if s.number == number {
+					data = s.data
+				}
+			}
+		}
+	}
+	p.lock.Unlock()
+
+	if data == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", kind+"/mp4")
+	w.Write(data)
+}
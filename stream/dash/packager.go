@@ -0,0 +1,348 @@
+// Package dash packages streams in MPEG-DASH fragmented MP4 segments and manifests
+package dash
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"gitlab.crans.org/nounous/ghostream/internal/demux"
+	"gitlab.crans.org/nounous/ghostream/internal/h264"
+	"gitlab.crans.org/nounous/ghostream/internal/mp4"
+	"gitlab.crans.org/nounous/ghostream/messaging"
+)
+
+const (
+	// Tracks are detected during this duration before packaging starts
+	startDelay = 90000
+
+	// Frames kept while detecting tracks
+	maxPendingFrames = 1024
+
+	// A timestamp jump larger than this is removed from media timeline
+	maxTimestampJump = 10 * 90000
+
+	// Segments kept after they leave the manifest, for late clients
+	extraSegments = 2
+
+	// Timescale of media timeline, as in demuxed frames
+	timescale = 90000
+)
+
+// segment is a fragmented MP4 media segment
+type segment struct {
+	number   int
+	start    int64
+	duration int64
+	data     []byte
+}
+
+// track packages one elementary stream of a quality as a representation
+type track struct {
+	codecs string
+	init   []byte
+
+	// Audio sampling rate and channels, as listed in manifest
+	sampleRate int
+	channels   int
+
+	// Last frame, its duration is known once next frame is received
+	held     *demux.Frame
+	interval int64
+
+	// Samples of current segment
+	samples []mp4.Sample
+	start   int64
+
+	// Non-driving track is cut at first frame after this time, -1 if none
+	cutAt int64
+
+	segments   []*segment
+	nextNumber int
+}
+
+// packager cuts a quality in segments
+type packager struct {
+	quality *messaging.Quality
+	cfg     *Options
+
+	demuxer *demux.Demuxer
+
+	lock sync.Mutex
+
+	// Tracks are created once detected, video drives segmentation
+	video *track
+	audio *track
+
+	// Frames received while detecting tracks
+	pending    []demux.Frame
+	hasVideo   bool
+	audioCodec string
+	audioConf  []byte
+
+	// Media time is frame timestamp plus offset, in 90 kHz units since
+	// Unix epoch, so that qualities share the same timeline
+	offset       int64
+	started      bool
+	segmentStart int64
+	lastTime     int64
+}
+
+func newPackager(quality *messaging.Quality, cfg *Options) *packager {
+	return &packager{
+		quality: quality,
+		cfg:     cfg,
+		demuxer: demux.New(),
+	}
+}
+
+// Write demuxes incoming data and packages its frames
+func (p *packager) Write(data []byte) {
+	frames := p.demuxer.Write(data)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, f := range frames {
+		p.frame(f)
+	}
+}
+
+// frame packages one frame, packager lock must be held
+func (p *packager) frame(f demux.Frame) {
+	if p.video == nil && p.audio == nil {
+		p.wait(f)
+		return
+	}
+
+	t := p.audio
+	if f.IsVideo() {
+		t = p.video
+	}
+	if t == nil || (f.IsVideo() && f.Codec != "h264") || (!f.IsVideo() && f.Codec != p.audioCodec) {
+		return
+	}
+	driving := t == p.video || p.video == nil
+
+	// Publisher reconnected or timestamps wrapped, media timeline continues
+	if driving && p.started {
+		dts := f.DTS + p.offset
+		if dts < p.lastTime-maxTimestampJump || dts > p.lastTime+maxTimestampJump {
+			end := p.lastTime + t.interval
+			for _, t := range p.tracks() {
+				t.finish(end, p.cfg.WindowSize)
+				t.cutAt = -1
+			}
+			p.offset = end - f.DTS
+			p.started = false
+		}
+	}
+	f.DTS += p.offset
+	f.PTS += p.offset
+
+	segmentDuration := int64(p.cfg.SegmentDuration * timescale / time.Second)
+	if driving {
+		independent := f.Keyframe || p.video == nil
+		switch {
+		case !p.started:
+			if !independent {
+				return
+			}
+			p.started = true
+			p.segmentStart = f.DTS
+		case independent && f.DTS-p.segmentStart >= segmentDuration:
+			t.finish(f.DTS, p.cfg.WindowSize)
+			if t == p.video && p.audio != nil {
+				p.audio.cutAt = f.DTS
+			}
+			p.segmentStart = f.DTS
+		}
+		p.lastTime = f.DTS
+	} else {
+		if !p.started {
+			return
+		}
+		if t.cutAt >= 0 && f.DTS >= t.cutAt {
+			t.finish(f.DTS, p.cfg.WindowSize)
+			t.cutAt = -1
+		}
+	}
+	t.add(f)
+}
+
+// tracks returns existing tracks, packager lock must be held
+func (p *packager) tracks() []*track {
+	var tracks []*track
+	for _, t := range []*track{p.video, p.audio} {
+		if t != nil {
+			tracks = append(tracks, t)
+		}
+	}
+	return tracks
+}
+
+// wait keeps frames until tracks are detected, then starts packaging.
+// Packaging starts on a video keyframe, or on audio if there is no video.
+func (p *packager) wait(f demux.Frame) {
+	switch f.Codec {
+	case "h264":
+		p.hasVideo = true
+	case "aac", "opus":
+		p.audioCodec, p.audioConf = f.Codec, f.Config
+	default:
+		// Unsupported codec
+		return
+	}
+	startsVideo := len(p.pending) > 0 && p.pending[0].IsVideo()
+	if f.IsVideo() && f.Keyframe && !startsVideo {
+		// Start from this keyframe
+		p.pending = p.pending[:0]
+	} else if p.hasVideo && !startsVideo {
+		// Wait for a keyframe
+		p.pending = p.pending[:0]
+		return
+	}
+	p.pending = append(p.pending, f)
+	if len(p.pending) > maxPendingFrames {
+		p.pending = p.pending[:0]
+		return
+	}
+
+	// Wait for audio a bit
+	first := p.pending[0]
+	waited := f.DTS - first.DTS
+	if first.IsVideo() && p.audioCodec == "" && waited < startDelay {
+		return
+	}
+	if !first.IsVideo() && waited < startDelay {
+		return
+	}
+
+	var err error
+	if first.IsVideo() {
+		if p.video, err = newVideoTrack(first.Data); err != nil {
+			log.Printf("Failed to package DASH video: %s", err)
+		}
+	}
+	if p.audioCodec != "" {
+		if p.audio, err = newAudioTrack(p.audioCodec, p.audioConf); err != nil {
+			log.Printf("Failed to package DASH audio: %s", err)
+		}
+	}
+	now := time.Now()
+	p.offset = now.Unix()*timescale + int64(now.Nanosecond())*timescale/int64(time.Second) - first.DTS
+
+	// Package waiting frames
+	pending := p.pending
+	p.pending = nil
+	for _, f := range pending {
+		p.frame(f)
+	}
+}
+
+// newVideoTrack describes H.264 video from a keyframe
+func newVideoTrack(keyframe []byte) (*track, error) {
+	sps, pps := h264.ParameterSets(keyframe)
+	if sps == nil {
+		return nil, errors.New("keyframe has no SPS")
+	}
+	info, err := h264.ParseSPS(sps)
+	if err != nil {
+		return nil, err
+	}
+	init, err := mp4.InitSegment(mp4.Track{
+		Codec:     "h264",
+		Timescale: timescale,
+		Width:     info.Width,
+		Height:    info.Height,
+		SPS:       sps,
+		PPS:       pps,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &track{
+		codecs: fmt.Sprintf("avc1.%02x%02x%02x", sps[1], sps[2], sps[3]),
+		init:   init,
+		cutAt:  -1,
+	}, nil
+}
+
+// newAudioTrack describes AAC or Opus audio
+func newAudioTrack(codec string, config []byte) (*track, error) {
+	t := &track{codecs: "opus", sampleRate: 48000, channels: 2, cutAt: -1}
+	if codec == "aac" {
+		if len(config) < 2 {
+			return nil, errors.New("missing AAC configuration")
+		}
+		t.sampleRate, t.channels = demux.AACConfig(config)
+		t.codecs = fmt.Sprintf("mp4a.40.%d", config[0]>>3)
+	}
+	var err error
+	t.init, err = mp4.InitSegment(mp4.Track{
+		Codec:      codec,
+		Timescale:  timescale,
+		SampleRate: t.sampleRate,
+		Channels:   t.channels,
+		Config:     config,
+	})
+	return t, err
+}
+
+// add appends a frame to current segment
+func (t *track) add(f demux.Frame) {
+	if t.held != nil {
+		if f.DTS < t.held.DTS {
+			// Out of order
+			return
+		}
+		t.interval = f.DTS - t.held.DTS
+		t.push(*t.held, t.interval)
+	}
+	t.held = &f
+}
+
+func (t *track) push(f demux.Frame, duration int64) {
+	if len(t.samples) == 0 {
+		t.start = f.DTS
+	}
+	data := f.Data
+	if f.Codec == "h264" {
+		data = h264.ToAVCC(f.Data)
+	}
+	t.samples = append(t.samples, mp4.Sample{
+		Duration:          uint32(duration),
+		CompositionOffset: int32(f.PTS - f.DTS),
+		Keyframe:          f.Keyframe || !f.IsVideo(),
+		Data:              data,
+	})
+}
+
+// finish completes current segment at end time
+func (t *track) finish(end int64, windowSize int) {
+	if t.held != nil {
+		duration := end - t.held.DTS
+		if duration <= 0 {
+			duration = t.interval
+		}
+		t.push(*t.held, duration)
+		t.held = nil
+	}
+	if len(t.samples) == 0 {
+		return
+	}
+
+	s := &segment{number: t.nextNumber, start: t.start}
+	for _, sample := range t.samples {
+		s.duration += int64(sample.Duration)
+	}
+	s.data = mp4.Fragment(uint32(s.number+1), uint64(s.start), t.samples)
+	t.segments = append(t.segments, s)
+	t.nextNumber++
+	t.samples = nil
+
+	// Remove old segments
+	if max := windowSize + extraSegments; len(t.segments) > max {
+		t.segments = t.segments[len(t.segments)-max:]
+	}
+}
@@ -23,13 +23,19 @@ func Serve(streams *messaging.Streams, cfg Options) {
 		return
 	}
 
-	// Subscribe to new stream event
-	event := make(chan string, 8)
-	streams.Subscribe(event)
+	// Subscribe to new quality event
+	event := make(chan messaging.Event, 8)
+	streams.Subscribe(event, messaging.Filter{Types: []messaging.EventType{messaging.QualityCreated}})
 	log.Printf("Stream forwarding initialized")
 
-	// For each new stream
-	for name := range event {
+	// For each new source quality
+	for e := range event {
+		// FIXME: make it possible to forward other qualities
+		if e.Quality != "source" {
+			continue
+		}
+		name, qualityName := e.Stream, e.Quality
+
 		streamCfg, ok := cfg[name]
 		if !ok {
 			// Not configured
@@ -40,15 +46,14 @@ func Serve(streams *messaging.Streams, cfg Options) {
 		stream, err := streams.Get(name)
 		if err != nil {
 			log.Printf("Failed to get stream '%s'", name)
-			return
+			continue
 		}
 
 		// Get specific quality
-		// FIXME: make it possible to forward other qualities
-		qualityName := "source"
 		quality, err := stream.GetQuality(qualityName)
 		if err != nil {
 			log.Printf("Failed to get quality '%s'", qualityName)
+			continue
 		}
 
 		// Start forwarding
@@ -60,7 +65,7 @@ func Serve(streams *messaging.Streams, cfg Options) {
 // Start a FFMPEG instance and redirect stream output to forwarded streams
 func forward(streamName string, q *messaging.Quality, fwdCfg []string) {
 	output := make(chan []byte, 1024)
-	q.Register(output)
+	q.Register(output, messaging.Policy{Name: "forwarding", Mode: messaging.DropUntilKeyframe})
 
 	// Launch FFMPEG instance
 	params := []string{"-hide_banner", "-loglevel", "error", "-i", "pipe:0"}
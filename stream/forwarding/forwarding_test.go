@@ -35,7 +35,7 @@ func TestForwardStream(t *testing.T) {
 	cfg["demo"] = []string{"rtmp://127.0.0.1:1936/live/app"}
 
 	// Register forwarding stream list
-	streams := messaging.New()
+	streams := messaging.New(&messaging.Options{})
 	go Serve(streams, cfg)
 
 	// Serve SRT Server without authentification backend
@@ -0,0 +1,302 @@
+// Package hls packages streams in HTTP Live Streaming segments and playlists
+package hls
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.crans.org/nounous/ghostream/internal/packaging"
+)
+
+// Segments after the current one that a blocking request can ask for
+const maxSequenceAhead = 2
+
+// Handle serves playlists and segments under /hls/<stream>/
+var Handle = packaging.Handler("/hls/", route)
+
+func route(w http.ResponseWriter, r *http.Request, path []string) {
+	switch {
+	case len(path) == 2 && path[1] == "index.m3u8":
+		serveMultivariantPlaylist(w, r, path[0])
+	case len(path) == 3 && path[2] == "index.m3u8":
+		p := getPackager(path[0], path[1])
+		if p == nil {
+			http.NotFound(w, r)
+			return
+		}
+		p.servePlaylist(w, r)
+	case len(path) == 3 && strings.HasSuffix(path[2], ".ts"):
+		p := getPackager(path[0], path[1])
+		if p == nil {
+			http.NotFound(w, r)
+			return
+		}
+		p.serveSegment(w, r, strings.TrimSuffix(path[2], ".ts"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveMultivariantPlaylist lists the qualities of a stream
+func serveMultivariantPlaylist(w http.ResponseWriter, r *http.Request, name string) {
+	type variant struct {
+		name      string
+		bandwidth int
+		info      string
+	}
+	var variants []variant
+	for q, v := range packagers.Qualities(name) {
+		p := v.(*packager)
+		p.lock.Lock()
+		codecs := p.codecs
+		p.lock.Unlock()
+		if codecs == "" {
+			// Not packaged yet
+			continue
+		}
+		media := p.quality.MediaInfo()
+		v := variant{name: q, bandwidth: media.Bitrate}
+		if v.bandwidth == 0 {
+			// Bitrate is not measured yet
+			v.bandwidth = 1000000
+		}
+		if media.Width > 0 && media.Height > 0 {
+			v.info += fmt.Sprintf(",RESOLUTION=%dx%d", media.Width, media.Height)
+		}
+		v.info += fmt.Sprintf(",CODECS=\"%s\"", codecs)
+		variants = append(variants, v)
+	}
+	if len(variants) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Highest quality first
+	sort.Slice(variants, func(i, j int) bool {
+		return variants[i].bandwidth > variants[j].bandwidth
+	})
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	for _, v := range variants {
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d%s\n%s/index.m3u8\n", v.bandwidth, v.info, v.name)
+	}
+	writePlaylist(w, b.String())
+}
+
+func writePlaylist(w http.ResponseWriter, playlist string) {
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(playlist))
+}
+
+// timeout returns how long a blocking request can wait
+func (p *packager) timeout() time.Duration {
+	return 3 * p.cfg.SegmentDuration
+}
+
+// waitFor waits until ready returns true, the packager is closed or timeout.
+// It returns with packager lock held and the last ready result.
+func (p *packager) waitFor(ready func() bool) bool {
+	deadline := time.After(p.timeout())
+	p.lock.Lock()
+	for !ready() && !p.closed {
+		updated := p.updated
+		p.lock.Unlock()
+		select {
+		case <-updated:
+		case <-deadline:
+			p.lock.Lock()
+			return ready()
+		}
+		p.lock.Lock()
+	}
+	return ready()
+}
+
+// available returns true if a segment, or one of its parts if part is not
+// negative, can be served. Packager lock must be held.
+func (p *packager) available(sequence, part int) bool {
+	for _, s := range p.segments {
+		if s.sequence != sequence {
+			continue
+		}
+		if part < 0 {
+			return s.complete
+		}
+		return part < len(s.parts)
+	}
+	return false
+}
+
+// servePlaylist serves the media playlist, blocking reload is supported
+// with _HLS_msn and _HLS_part query parameters
+func (p *packager) servePlaylist(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if msn := query.Get("_HLS_msn"); msn != "" {
+		sequence, err := strconv.Atoi(msn)
+		if err != nil {
+			http.Error(w, "Invalid _HLS_msn.", http.StatusBadRequest)
+			return
+		}
+		part := -1
+		if s := query.Get("_HLS_part"); s != "" {
+			if part, err = strconv.Atoi(s); err != nil || part < 0 {
+				http.Error(w, "Invalid _HLS_part.", http.StatusBadRequest)
+				return
+			}
+		}
+
+		p.lock.Lock()
+		tooFar := sequence > p.nextSequence+maxSequenceAhead
+		p.lock.Unlock()
+		if tooFar {
+			http.Error(w, "Segment is too far in the future.", http.StatusBadRequest)
+			return
+		}
+		p.waitFor(func() bool {
+			// Segments that left the playlist are available
+			return sequence < p.nextSequence-len(p.segments) || p.available(sequence, part)
+		})
+	} else {
+		p.lock.Lock()
+	}
+	playlist := p.playlist()
+	p.lock.Unlock()
+	writePlaylist(w, playlist)
+}
+
+// serveSegment serves a segment "<sequence>" or a part "<sequence>.<part>".
+// Request for the next part waits for it, as announced by preload hint.
+func (p *packager) serveSegment(w http.ResponseWriter, r *http.Request, name string) {
+	split := strings.SplitN(name, ".", 2)
+	sequence, err := strconv.Atoi(split[0])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	part := -1
+	if len(split) > 1 {
+		if part, err = strconv.Atoi(split[1]); err != nil || part < 0 {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	p.lock.Lock()
+	waiting := sequence == p.nextSequence-1 || sequence == p.nextSequence
+	p.lock.Unlock()
+	var data []byte
+	if waiting {
+		p.waitFor(func() bool { return p.available(sequence, part) })
+	} else {
+		p.lock.Lock()
+	}
+	for _, s := range p.segments {
+		if s.sequence != sequence {
+			continue
+		}
+		if part < 0 && s.complete {
+			data = s.data
+		} else if part >= 0 && part < len(s.parts) {
+			data = s.parts[part].data
+		}
+	}
+	p.lock.Unlock()
+
+	if data == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "video/mp2t")
+	w.Write(data)
+}
+
+// playlist returns the media playlist, packager lock must be held
+func (p *packager) playlist() string {
+	lowLatency := p.cfg.PartDuration > 0
+	partTarget := p.cfg.PartDuration.Seconds()
+
+	// Complete segments in playlist
+	var segments []*segment
+	for _, s := range p.segments {
+		if s.complete {
+			segments = append(segments, s)
+		}
+	}
+	if len(segments) > p.cfg.PlaylistSize {
+		segments = segments[len(segments)-p.cfg.PlaylistSize:]
+	}
+
+	targetDuration := p.cfg.SegmentDuration.Seconds()
+	for _, s := range segments {
+		targetDuration = math.Max(targetDuration, s.duration)
+	}
+	firstSequence := p.nextSequence
+	if len(segments) > 0 {
+		firstSequence = segments[0].sequence
+	} else if p.current != nil {
+		firstSequence = p.current.sequence
+	}
+	discontinuitySequence := p.discontinuitySequence
+	for _, s := range p.segments {
+		if s.sequence >= firstSequence {
+			break
+		}
+		if s.discontinuity {
+			discontinuitySequence++
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	if lowLatency {
+		b.WriteString("#EXT-X-VERSION:9\n")
+	} else {
+		b.WriteString("#EXT-X-VERSION:3\n")
+	}
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(targetDuration)))
+	if lowLatency {
+		fmt.Fprintf(&b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", 3*partTarget)
+		fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", partTarget)
+	}
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", firstSequence)
+	if discontinuitySequence > 0 {
+		fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", discontinuitySequence)
+	}
+
+	for i, s := range segments {
+		if s.discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		// Parts are only listed for last segments
+		if lowLatency && i >= len(segments)-2 {
+			writeParts(&b, s)
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%d.ts\n", s.duration, s.sequence)
+	}
+
+	// Current segment is only announced with its parts
+	if lowLatency && p.current != nil && !p.current.complete {
+		if p.current.discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		writeParts(&b, p.current)
+		fmt.Fprintf(&b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%d.%d.ts\"\n", p.current.sequence, len(p.current.parts))
+	}
+	return b.String()
+}
+
+func writeParts(b *strings.Builder, s *segment) {
+	for i, part := range s.parts {
+		fmt.Fprintf(b, "#EXT-X-PART:DURATION=%.3f,URI=\"%d.%d.ts\"", part.duration, s.sequence, i)
+		if part.independent {
+			b.WriteString(",INDEPENDENT=YES")
+		}
+		b.WriteString("\n")
+	}
+}
@@ -0,0 +1,51 @@
+// Package hls packages streams in HTTP Live Streaming segments and playlists
+package hls
+
+import (
+	"log"
+	"time"
+
+	"gitlab.crans.org/nounous/ghostream/internal/packaging"
+	"gitlab.crans.org/nounous/ghostream/messaging"
+)
+
+// Options holds hls package configuration
+type Options struct {
+	Enabled bool
+
+	// Segments are cut on the first keyframe after this duration
+	SegmentDuration time.Duration
+
+	// Low-Latency HLS partial segments duration, 0 disables partial segments
+	PartDuration time.Duration
+
+	// Number of segments in playlists
+	PlaylistSize int
+}
+
+// Packagers by stream then quality
+var packagers = packaging.NewRegistry("hls")
+
+// Serve packages each new quality
+func Serve(streams *messaging.Streams, cfg *Options) {
+	if !cfg.Enabled {
+		// HLS is not enabled, ignore
+		return
+	}
+
+	log.Printf("HLS packager initialized")
+	packagers.Serve(streams, func(quality *messaging.Quality) packaging.Packager {
+		return newPackager(quality, cfg)
+	})
+}
+
+// Packaged returns true if a stream quality is served in HLS.
+func Packaged(name, qualityName string) bool {
+	return getPackager(name, qualityName) != nil
+}
+
+// getPackager returns the packager of a stream quality, or nil
+func getPackager(name, qualityName string) *packager {
+	p, _ := packagers.Get(name, qualityName).(*packager)
+	return p
+}
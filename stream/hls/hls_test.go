@@ -0,0 +1,91 @@
+package hls
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.crans.org/nounous/ghostream/internal/demux"
+	"gitlab.crans.org/nounous/ghostream/internal/mpegts"
+	"gitlab.crans.org/nounous/ghostream/internal/packaging/packagingtest"
+	"gitlab.crans.org/nounous/ghostream/messaging"
+)
+
+func get(url string) (int, string) {
+	return packagingtest.Get(Handle, url)
+}
+
+func TestHLS(t *testing.T) {
+	cfg := Options{Enabled: true, SegmentDuration: time.Second, PartDuration: 200 * time.Millisecond, PlaylistSize: 3}
+	streams := messaging.New(&messaging.Options{})
+	go Serve(streams, &cfg)
+	time.Sleep(10 * time.Millisecond)
+
+	stream, _ := streams.Create("demo")
+	quality, _ := stream.CreateQuality("source")
+	for getPackager("demo", "source") == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	data := packagingtest.Stream(9)
+	for len(data) > 0 {
+		n := 7 * mpegts.PacketSize
+		if n > len(data) {
+			n = len(data)
+		}
+		quality.Broadcast <- data[:n]
+		data = data[n:]
+	}
+
+	// Wait for last segments, timestamps go up to 9s
+	p := getPackager("demo", "source")
+	p.waitFor(func() bool { return p.available(7, -1) })
+	p.lock.Unlock()
+
+	code, body := get("/hls/demo/index.m3u8")
+	if code != http.StatusOK || !strings.Contains(body, "BANDWIDTH=") ||
+		!strings.Contains(body, `CODECS="avc1.42c028,mp4a.40.2"`) || !strings.Contains(body, "source/index.m3u8") {
+		t.Errorf("Wrong multivariant playlist (%d): %s", code, body)
+	}
+
+	code, body = get("/hls/demo/source/index.m3u8")
+	for _, line := range []string{"#EXT-X-TARGETDURATION:1", "#EXT-X-MEDIA-SEQUENCE:5", "#EXTINF:1.000,\n7.ts",
+		"#EXT-X-PART:DURATION=0.200,URI=\"7.0.ts\",INDEPENDENT=YES", "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"8."} {
+		if !strings.Contains(body, line) {
+			t.Errorf("Media playlist (%d) does not contain %q: %s", code, line, body)
+		}
+	}
+
+	// Segments start with tables, then a keyframe
+	code, body = get("/hls/demo/source/7.ts")
+	if code != http.StatusOK || len(body) == 0 || len(body)%mpegts.PacketSize != 0 || body[0] != mpegts.SyncByte {
+		t.Errorf("Wrong segment (%d), %d bytes", code, len(body))
+	}
+	frames := demux.New().Write([]byte(body))
+	if len(frames) == 0 || !frames[0].Keyframe {
+		t.Errorf("Segment does not start with a keyframe")
+	}
+	if code, _ := get("/hls/demo/source/7.1.ts"); code != http.StatusOK {
+		t.Errorf("Part was not served (%d)", code)
+	}
+
+	// Blocking reload
+	code, body = get("/hls/demo/source/index.m3u8?_HLS_msn=100")
+	if code != http.StatusBadRequest {
+		t.Errorf("Blocking reload far in the future returned %d", code)
+	}
+
+	// Unknown
+	if code, _ := get("/hls/demo/source/0.ts"); code != http.StatusNotFound {
+		t.Errorf("Removed segment returned %d", code)
+	}
+	if code, _ := get("/hls/other/index.m3u8"); code != http.StatusNotFound {
+		t.Errorf("Unknown stream returned %d", code)
+	}
+
+	// Quality is removed with stream
+	streams.Delete("demo")
+	for getPackager("demo", "source") != nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,330 @@
+// Package hls packages streams in HTTP Live Streaming segments and playlists
+package hls
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.crans.org/nounous/ghostream/internal/demux"
+	"gitlab.crans.org/nounous/ghostream/internal/h264"
+	"gitlab.crans.org/nounous/ghostream/internal/mpegts"
+	"gitlab.crans.org/nounous/ghostream/messaging"
+)
+
+const (
+	// Tracks are detected during this duration before packaging starts
+	startDelay = 90000
+
+	// Frames kept while detecting tracks
+	maxPendingFrames = 1024
+
+	// A timestamp jump larger than this starts a discontinuity
+	maxTimestampJump = 10 * 90000
+
+	// Segments kept after they leave the playlist, for late clients
+	extraSegments = 2
+)
+
+// part is a Low-Latency HLS partial segment
+type part struct {
+	data        []byte
+	duration    float64
+	independent bool
+}
+
+// segment is a MPEG-TS media segment
+type segment struct {
+	sequence      int
+	parts         []*part
+	data          []byte
+	duration      float64
+	complete      bool
+	discontinuity bool
+}
+
+// packager cuts a quality in segments
+type packager struct {
+	quality *messaging.Quality
+	cfg     *Options
+
+	demuxer *demux.Demuxer
+
+	// Muxer is created once tracks are known
+	muxer      *mpegts.Muxer
+	buffer     bytes.Buffer
+	videoPID   uint16
+	audioPID   uint16
+	audioCodec string
+	audioConf  []byte
+
+	// Codecs of the quality, as listed in multivariant playlist
+	codecs string
+
+	// Frames received while detecting tracks
+	pending  []demux.Frame
+	hasVideo bool
+
+	lock sync.Mutex
+
+	// Closed and replaced each time a part is available
+	updated chan struct{}
+	closed  bool
+
+	// Segments from oldest to current one
+	segments []*segment
+	current  *segment
+
+	// Clock of the track which cuts segments
+	segmentStart  int64
+	partStart     int64
+	lastClock     int64
+	lastInterval  int64
+	discontinuity bool
+
+	discontinuitySequence int
+	nextSequence          int
+}
+
+func newPackager(quality *messaging.Quality, cfg *Options) *packager {
+	return &packager{
+		quality: quality,
+		cfg:     cfg,
+		demuxer: demux.New(),
+		updated: make(chan struct{}),
+	}
+}
+
+// Write demuxes incoming data and packages its frames
+func (p *packager) Write(data []byte) {
+	frames := p.demuxer.Write(data)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, f := range frames {
+		p.frame(f)
+	}
+}
+
+// Close wakes up waiting clients
+func (p *packager) Close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.closed = true
+	p.notify()
+}
+
+func (p *packager) notify() {
+	close(p.updated)
+	if !p.closed {
+		p.updated = make(chan struct{})
+	}
+}
+
+// frame packages one frame, packager lock must be held
+func (p *packager) frame(f demux.Frame) {
+	if p.muxer == nil {
+		p.wait(f)
+		return
+	}
+
+	video := f.IsVideo()
+	if video && (p.videoPID == 0 || f.Codec != "h264") {
+		return
+	}
+	if !video && (p.audioPID == 0 || f.Codec != p.audioCodec) {
+		return
+	}
+
+	// Video drives segmentation, or audio for audio-only streams
+	if video == (p.videoPID != 0) {
+		if !p.cut(f) {
+			return
+		}
+	} else if p.current == nil {
+		// Wait for segment start
+		return
+	}
+
+	var err error
+	if video {
+		err = p.muxer.WritePES(p.videoPID, f.PTS, f.DTS, f.Keyframe, f.Data)
+	} else {
+		err = p.muxer.WritePES(p.audioPID, f.PTS, f.DTS, false, p.audioPayload(f))
+	}
+	if err != nil {
+		log.Printf("Failed to mux HLS segment: %s", err)
+	}
+}
+
+// wait keeps frames until tracks are detected, then starts packaging.
+// Packaging starts on a video keyframe, or on audio if there is no video.
+func (p *packager) wait(f demux.Frame) {
+	switch f.Codec {
+	case "h264":
+		p.hasVideo = true
+	case "aac", "mp3", "opus":
+		p.audioCodec, p.audioConf = f.Codec, f.Config
+	default:
+		// Unsupported codec
+		return
+	}
+	startsVideo := len(p.pending) > 0 && p.pending[0].IsVideo()
+	if f.IsVideo() && f.Keyframe && !startsVideo {
+		// Start from this keyframe
+		p.pending = p.pending[:0]
+	} else if p.hasVideo && !startsVideo {
+		// Wait for a keyframe
+		p.pending = p.pending[:0]
+		return
+	}
+	p.pending = append(p.pending, f)
+	if len(p.pending) > maxPendingFrames {
+		p.pending = p.pending[:0]
+		return
+	}
+
+	// Wait for audio a bit
+	first := p.pending[0]
+	waited := f.DTS - first.DTS
+	if first.IsVideo() && p.audioCodec == "" && waited < startDelay {
+		return
+	}
+	if !first.IsVideo() && waited < startDelay {
+		return
+	}
+
+	p.muxer = mpegts.NewMuxer(&p.buffer)
+	var codecs []string
+	if first.IsVideo() {
+		p.videoPID = p.muxer.AddStream(mpegts.StreamTypeH264, nil)
+		codecs = append(codecs, avcCodec(first.Data))
+	}
+	switch p.audioCodec {
+	case "aac":
+		p.audioPID = p.muxer.AddStream(mpegts.StreamTypeADTSAAC, nil)
+		objectType := 2
+		if len(p.audioConf) > 0 {
+			objectType = int(p.audioConf[0] >> 3)
+		}
+		codecs = append(codecs, fmt.Sprintf("mp4a.40.%d", objectType))
+	case "mp3":
+		p.audioPID = p.muxer.AddStream(mpegts.StreamTypeMPEG1Audio, nil)
+		codecs = append(codecs, "mp4a.40.34")
+	case "opus":
+		p.audioPID = p.muxer.AddStream(mpegts.StreamTypePrivate, mpegts.OpusDescriptors(2))
+		codecs = append(codecs, "opus")
+	}
+	p.codecs = strings.Join(codecs, ",")
+
+	// Package waiting frames
+	pending := p.pending
+	p.pending = nil
+	for _, f := range pending {
+		p.frame(f)
+	}
+}
+
+// audioPayload returns the PES payload of an audio frame.
+func (p *packager) audioPayload(f demux.Frame) []byte {
+	switch f.Codec {
+	case "aac":
+		return append(demux.ADTSHeader(f.Config, len(f.Data)), f.Data...)
+	case "opus":
+		return append(mpegts.OpusControlHeader(len(f.Data)), f.Data...)
+	}
+	return f.Data
+}
+
+// cut starts new segments and parts before a frame of the track driving
+// segmentation. It returns false if the frame must be dropped.
+func (p *packager) cut(f demux.Frame) bool {
+	independent := f.Keyframe || p.videoPID == 0
+
+	// Publisher reconnected or timestamps wrapped
+	if p.current != nil && (f.DTS < p.lastClock || f.DTS-p.lastClock > maxTimestampJump) {
+		p.finishSegment(p.lastClock + p.lastInterval)
+		p.current = nil
+		p.discontinuity = true
+	}
+
+	segmentDuration := int64(p.cfg.SegmentDuration * 90000 / time.Second)
+	partDuration := int64(p.cfg.PartDuration * 90000 / time.Second)
+	switch {
+	case p.current == nil:
+		if !independent {
+			return false
+		}
+		p.newSegment(f.DTS)
+	case independent && f.DTS-p.segmentStart >= segmentDuration:
+		p.finishSegment(f.DTS)
+		p.newSegment(f.DTS)
+	case partDuration > 0 && f.DTS+p.lastInterval-p.partStart > partDuration:
+		// Next frame would make the part too long
+		p.finishPart(f.DTS)
+		p.partStart = f.DTS
+	}
+
+	if p.lastClock != 0 && f.DTS > p.lastClock {
+		p.lastInterval = f.DTS - p.lastClock
+	}
+	p.lastClock = f.DTS
+	return true
+}
+
+// newSegment starts a segment at a keyframe
+func (p *packager) newSegment(dts int64) {
+	p.current = &segment{sequence: p.nextSequence, discontinuity: p.discontinuity}
+	p.nextSequence++
+	p.discontinuity = false
+	p.segments = append(p.segments, p.current)
+	p.segmentStart, p.partStart = dts, dts
+	if p.videoPID == 0 {
+		// Video keyframes already write tables
+		if err := p.muxer.WriteTables(); err != nil {
+			log.Printf("Failed to mux HLS segment: %s", err)
+		}
+	}
+
+	// Remove old segments
+	max := p.cfg.PlaylistSize + extraSegments + 1
+	for len(p.segments) > max {
+		if p.segments[0].discontinuity {
+			p.discontinuitySequence++
+		}
+		p.segments = p.segments[1:]
+	}
+}
+
+// finishPart publishes muxed data as a partial segment
+func (p *packager) finishPart(dts int64) {
+	data := make([]byte, p.buffer.Len())
+	copy(data, p.buffer.Bytes())
+	p.buffer.Reset()
+	p.current.parts = append(p.current.parts, &part{
+		data:        data,
+		duration:    float64(dts-p.partStart) / 90000,
+		independent: len(p.current.parts) == 0 || p.videoPID == 0,
+	})
+	p.current.data = append(p.current.data, data...)
+	p.notify()
+}
+
+// finishSegment completes current segment
+func (p *packager) finishSegment(dts int64) {
+	p.finishPart(dts)
+	p.current.duration = float64(dts-p.segmentStart) / 90000
+	p.current.complete = true
+}
+
+// avcCodec returns the RFC 6381 codec of H.264 video from its parameter set
+func avcCodec(annexB []byte) string {
+	for _, nalu := range h264.SplitAnnexB(annexB) {
+		if len(nalu) >= 4 && nalu[0]&0x1f == h264.NALUTypeSPS {
+			return fmt.Sprintf("avc1.%02x%02x%02x", nalu[1], nalu[2], nalu[3])
+		}
+	}
+	return "avc1.42e01e"
+}
@@ -29,24 +29,29 @@ func Serve(streams *messaging.Streams, c *Options) {
 		return
 	}
 
-	// Subscribe to new stream event
-	event := make(chan string, 8)
-	streams.Subscribe(event)
+	// Subscribe to new quality event
+	event := make(chan messaging.Event, 8)
+	streams.Subscribe(event, messaging.Filter{Types: []messaging.EventType{messaging.QualityCreated}})
 	log.Printf("Stream forwarding to OME initialized")
 
-	// For each new stream
-	for name := range event {
+	// For each new source quality
+	for e := range event {
+		if e.Quality != "source" {
+			continue
+		}
+		name, qualityName := e.Stream, e.Quality
+
 		// Get stream
 		stream, err := streams.Get(name)
 		if err != nil {
 			log.Printf("Failed to get stream '%s'", name)
-			return
+			continue
 		}
 
-		qualityName := "source"
 		quality, err := stream.GetQuality(qualityName)
 		if err != nil {
 			log.Printf("Failed to get quality '%s'", qualityName)
+			continue
 		}
 
 		// Start forwarding
@@ -58,7 +63,7 @@ func Serve(streams *messaging.Streams, c *Options) {
 // Start a FFMPEG instance and redirect stream output to OME
 func forward(name string, q *messaging.Quality) {
 	output := make(chan []byte, 1024)
-	q.Register(output)
+	q.Register(output, messaging.Policy{Name: "ovenmediaengine", Mode: messaging.DropUntilKeyframe})
 
 	// TODO When a new OME version got released with SRT support, directly forward SRT packets, without using unwanted RTMP transport
 	// Launch FFMPEG instance
@@ -0,0 +1,130 @@
+// Package pull fetches streams from remote sources
+package pull
+
+import (
+	"log"
+	"net/url"
+	"time"
+
+	"gitlab.crans.org/nounous/ghostream/internal/monitoring"
+	"gitlab.crans.org/nounous/ghostream/messaging"
+)
+
+// Options to configure pulled streams.
+// For each stream name, user provides the URL of the source, such as
+// "srt://encoder:9000?streamid=live", "udp://239.0.0.1:1234" or "rtp://:5004".
+type Options map[string]string
+
+const (
+	// Reconnection delay is doubled after each failure, up to maxBackoff
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
+
+	// Source is considered lost if nothing is received during this time
+	readTimeout = 5 * time.Second
+)
+
+// Connection states of a source
+const (
+	stateConnecting = iota
+	stateConnected
+	stateDisconnected
+)
+
+var stateNames = map[int]string{
+	stateConnecting:   "connecting",
+	stateConnected:    "connected",
+	stateDisconnected: "disconnected",
+}
+
+// Serve pulls each configured source and publishes it
+func Serve(streams *messaging.Streams, cfg Options) {
+	if len(cfg) < 1 {
+		// No source, ignore
+		return
+	}
+
+	for name, rawURL := range cfg {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			log.Printf("Invalid pull source for stream %s: %s", name, err)
+			continue
+		}
+		go pull(streams, name, u)
+	}
+}
+
+// pull reads a source forever, reconnecting with backoff
+func pull(streams *messaging.Streams, name string, u *url.URL) {
+	backoff := minBackoff
+	for {
+		setState(name, u, stateConnecting)
+		received, err := pullOnce(streams, name, u)
+		if received {
+			// Source worked, reconnect quickly
+			backoff = minBackoff
+		}
+		setState(name, u, stateDisconnected)
+		log.Printf("Pulling stream %s from %s failed: %s, retrying in %s", name, address(u), err, backoff)
+
+		time.Sleep(backoff)
+		backoff = nextBackoff(backoff)
+	}
+}
+
+// pullOnce opens the source and publishes it until an error occurs.
+// It returns true if data was received.
+func pullOnce(streams *messaging.Streams, name string, u *url.URL) (bool, error) {
+	src, err := open(u)
+	if err != nil {
+		return false, err
+	}
+	defer src.Close()
+
+	// Stream is created when source sends its first packet
+	buff := make([]byte, 2048)
+	n, err := src.Read(buff)
+	if err != nil {
+		return false, err
+	}
+
+	metadata := messaging.Metadata{Protocol: u.Scheme + "-pull", RemoteAddr: u.Host}
+	_, q, err := streams.Publish(name, metadata)
+	if err != nil {
+		return true, err
+	}
+	defer streams.Release(name)
+	setState(name, u, stateConnected)
+
+	for {
+		data := make([]byte, n)
+		copy(data, buff[:n])
+		q.Broadcast <- data
+		n, err = src.Read(buff)
+		if err != nil {
+			return true, err
+		}
+	}
+}
+
+func setState(name string, u *url.URL, state int) {
+	log.Printf("Pull source %s for stream %s is %s", address(u), name, stateNames[state])
+	connected := 0.0
+	if state == stateConnected {
+		connected = 1
+	}
+	monitoring.PullConnected.WithLabelValues(name).Set(connected)
+}
+
+// address describes a source without its query, which may contain a passphrase
+func address(u *url.URL) string {
+	return u.Scheme + "://" + u.Host
+}
+
+func nextBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	return backoff
+}
@@ -0,0 +1,88 @@
+package pull
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"gitlab.crans.org/nounous/ghostream/messaging"
+)
+
+// receive sends packets to a pulled address until the stream is published,
+// then returns the first received message
+func receive(t *testing.T, streams *messaging.Streams, name, address string, packet []byte) []byte {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		t.Fatalf("Failed to dial %s: %s", address, err)
+	}
+	defer conn.Close()
+
+	// Source is listening asynchronously, send until stream exists
+	var stream *messaging.Stream
+	for i := 0; i < 50 && stream == nil; i++ {
+		conn.Write(packet)
+		time.Sleep(20 * time.Millisecond)
+		stream, _ = streams.Get(name)
+	}
+	if stream == nil {
+		t.Fatalf("Stream %s was not published", name)
+	}
+	if m := stream.Metadata(); m.RemoteAddr != address {
+		t.Errorf("Stream has wrong remote address %s", m.RemoteAddr)
+	}
+
+	quality, _ := stream.GetQuality("source")
+	output := make(chan []byte, 64)
+	quality.Register(output, messaging.Policy{})
+	defer quality.Unregister(output)
+	conn.Write(packet)
+	select {
+	case data := <-output:
+		return data
+	case <-time.After(time.Second):
+		t.Fatalf("Nothing received from %s", address)
+	}
+	return nil
+}
+
+func TestPullUDP(t *testing.T) {
+	streams := messaging.New(&messaging.Options{})
+	Serve(streams, Options{"udp": "udp://127.0.0.1:9721", "rtp": "rtp://127.0.0.1:9722"})
+
+	// Raw MPEG-TS
+	packet := bytes.Repeat([]byte{0x47, 0x1f, 0xff, 0x10}, 47)
+	if data := receive(t, streams, "udp", "127.0.0.1:9721", packet); !bytes.Equal(data, packet) {
+		t.Errorf("Received wrong UDP data")
+	}
+
+	// MPEG-TS in RTP
+	r := &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 33}, Payload: packet}
+	raw, _ := r.Marshal()
+
+	// Invalid packet neither publishes the stream nor is broadcasted
+	conn, err := net.Dial("udp", "127.0.0.1:9722")
+	if err != nil {
+		t.Fatalf("Failed to dial: %s", err)
+	}
+	conn.Write([]byte{0x00})
+	conn.Close()
+	time.Sleep(50 * time.Millisecond)
+	if _, err := streams.Get("rtp"); err == nil {
+		t.Errorf("Invalid RTP packet published the stream")
+	}
+	if data := receive(t, streams, "rtp", "127.0.0.1:9722", raw); !bytes.Equal(data, packet) {
+		t.Errorf("RTP header was not removed")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	backoff := minBackoff
+	for i := 0; i < 10; i++ {
+		backoff = nextBackoff(backoff)
+	}
+	if backoff != maxBackoff {
+		t.Errorf("Backoff is %s, not limited to %s", backoff, maxBackoff)
+	}
+}
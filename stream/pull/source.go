@@ -0,0 +1,142 @@
+// Package pull fetches streams from remote sources
+package pull
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/haivision/srtgo"
+	"github.com/pion/rtp"
+)
+
+// errTimeout is returned when a source sends nothing during readTimeout
+var errTimeout = errors.New("no data received")
+
+// source is a connected remote source sending MPEG-TS
+type source interface {
+	// Read returns received data, it is empty only on error
+	Read(b []byte) (int, error)
+	Close()
+}
+
+// open connects to a source depending on URL scheme
+func open(u *url.URL) (source, error) {
+	switch u.Scheme {
+	case "srt":
+		return openSRT(u)
+	case "udp":
+		return openUDP(u, false)
+	case "rtp":
+		return openUDP(u, true)
+	}
+	return nil, fmt.Errorf("unsupported scheme %s", u.Scheme)
+}
+
+// srtSource calls a SRT listener
+type srtSource struct {
+	socket *srtgo.SrtSocket
+}
+
+func openSRT(u *url.URL) (source, error) {
+	host, portS, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portS, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	// Query parameters are given to libsrt, such as streamid or passphrase
+	options := make(map[string]string)
+	for key := range u.Query() {
+		options[key] = u.Query().Get(key)
+	}
+	options["blocking"] = "0"
+	options["transtype"] = "live"
+	options["mode"] = "caller"
+
+	socket := srtgo.NewSrtSocket(host, uint16(port), options)
+	if socket == nil {
+		return nil, fmt.Errorf("failed to create SRT socket")
+	}
+	if err := socket.Connect(); err != nil {
+		// srtgo closes socket on failure
+		return nil, err
+	}
+	return &srtSource{socket: socket}, nil
+}
+
+func (s *srtSource) Read(b []byte) (int, error) {
+	n, err := s.socket.Read(b, int(readTimeout/time.Millisecond))
+	if err == nil && n == 0 {
+		// Read timed out or listener closed connection
+		return 0, errTimeout
+	}
+	return n, err
+}
+
+func (s *srtSource) Close() {
+	s.socket.Close()
+}
+
+// udpSource receives MPEG-TS over UDP, optionally in RTP packets
+type udpSource struct {
+	conn *net.UDPConn
+	rtp  bool
+}
+
+func openUDP(u *url.URL, withRTP bool) (source, error) {
+	addr, err := net.ResolveUDPAddr("udp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn *net.UDPConn
+	if addr.IP != nil && addr.IP.IsMulticast() {
+		conn, err = net.ListenMulticastUDP("udp", nil, addr)
+	} else {
+		conn, err = net.ListenUDP("udp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &udpSource{conn: conn, rtp: withRTP}, nil
+}
+
+func (s *udpSource) Read(b []byte) (int, error) {
+	// Invalid packets do not postpone the timeout
+	if err := s.conn.SetReadDeadline(time.Now().Add(readTimeout)); err != nil {
+		return 0, err
+	}
+	for {
+		n, err := s.conn.Read(b)
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				return 0, errTimeout
+			}
+			return 0, err
+		}
+		if !s.rtp {
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+
+		// Keep only RTP payload, invalid and empty packets are skipped
+		packet := &rtp.Packet{}
+		if err := packet.Unmarshal(b[:n]); err != nil || len(packet.Payload) == 0 {
+			continue
+		}
+		return copy(b, packet.Payload), nil
+	}
+}
+
+func (s *udpSource) Close() {
+	s.conn.Close()
+}
@@ -0,0 +1,206 @@
+// Package rtmp serves a RTMP server
+package rtmp
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+)
+
+// AMF0 type markers
+const (
+	amfNumber      = 0x00
+	amfBoolean     = 0x01
+	amfString      = 0x02
+	amfObject      = 0x03
+	amfNull        = 0x05
+	amfUndefined   = 0x06
+	amfECMAArray   = 0x08
+	amfObjectEnd   = 0x09
+	amfStrictArray = 0x0a
+	amfDate        = 0x0b
+	amfLongString  = 0x0c
+)
+
+// Objects and arrays nested deeper are rejected
+const amfMaxDepth = 32
+
+var (
+	errAMFTruncated = errors.New("truncated AMF0 value")
+	errAMFTooDeep   = errors.New("AMF0 value is nested too deeply")
+)
+
+// amfDecode decodes one AMF0 value and returns the number of bytes read.
+// Numbers are float64, objects and ECMA arrays are map[string]interface{},
+// null and undefined are nil.
+func amfDecode(b []byte) (v interface{}, n int, err error) {
+	return amfDecodeDepth(b, 0)
+}
+
+// amfDecodeDepth decodes a value nested in depth objects or arrays.
+func amfDecodeDepth(b []byte, depth int) (v interface{}, n int, err error) {
+	if depth > amfMaxDepth {
+		return nil, 0, errAMFTooDeep
+	}
+	if len(b) < 1 {
+		return nil, 0, errAMFTruncated
+	}
+	switch b[0] {
+	case amfNumber:
+		if len(b) < 9 {
+			return nil, 0, errAMFTruncated
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b[1:9])), 9, nil
+	case amfBoolean:
+		if len(b) < 2 {
+			return nil, 0, errAMFTruncated
+		}
+		return b[1] != 0, 2, nil
+	case amfString:
+		s, n, err := amfDecodeString(b[1:])
+		return s, 1 + n, err
+	case amfLongString:
+		if len(b) < 5 {
+			return nil, 0, errAMFTruncated
+		}
+		size := int(binary.BigEndian.Uint32(b[1:5]))
+		if len(b) < 5+size {
+			return nil, 0, errAMFTruncated
+		}
+		return string(b[5 : 5+size]), 5 + size, nil
+	case amfObject:
+		obj, n, err := amfDecodeProperties(b[1:], depth+1)
+		return obj, 1 + n, err
+	case amfECMAArray:
+		if len(b) < 5 {
+			return nil, 0, errAMFTruncated
+		}
+		obj, n, err := amfDecodeProperties(b[5:], depth+1)
+		return obj, 5 + n, err
+	case amfStrictArray:
+		if len(b) < 5 {
+			return nil, 0, errAMFTruncated
+		}
+		count := int(binary.BigEndian.Uint32(b[1:5]))
+		n = 5
+		values := make([]interface{}, 0)
+		for i := 0; i < count; i++ {
+			v, m, err := amfDecodeDepth(b[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			values = append(values, v)
+			n += m
+		}
+		return values, n, nil
+	case amfDate:
+		if len(b) < 11 {
+			return nil, 0, errAMFTruncated
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b[1:9])), 11, nil
+	case amfNull, amfUndefined:
+		return nil, 1, nil
+	}
+	return nil, 0, errors.New("unsupported AMF0 type")
+}
+
+func amfDecodeString(b []byte) (string, int, error) {
+	if len(b) < 2 {
+		return "", 0, errAMFTruncated
+	}
+	size := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+size {
+		return "", 0, errAMFTruncated
+	}
+	return string(b[2 : 2+size]), 2 + size, nil
+}
+
+// amfDecodeProperties decodes object properties until object end marker.
+func amfDecodeProperties(b []byte, depth int) (map[string]interface{}, int, error) {
+	obj := make(map[string]interface{})
+	n := 0
+	for {
+		key, m, err := amfDecodeString(b[n:])
+		if err != nil {
+			return nil, 0, err
+		}
+		n += m
+		if key == "" && n < len(b) && b[n] == amfObjectEnd {
+			return obj, n + 1, nil
+		}
+		v, m, err := amfDecodeDepth(b[n:], depth)
+		if err != nil {
+			return nil, 0, err
+		}
+		obj[key] = v
+		n += m
+	}
+}
+
+// amfDecodeAll decodes all values of a command or data message.
+func amfDecodeAll(b []byte) ([]interface{}, error) {
+	values := make([]interface{}, 0)
+	for len(b) > 0 {
+		v, n, err := amfDecode(b)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+		b = b[n:]
+	}
+	return values, nil
+}
+
+// amfEncode appends AMF0 encoded values to b.
+// Supported types are float64, int, bool, string, map[string]interface{} and nil.
+func amfEncode(b []byte, values ...interface{}) []byte {
+	for _, v := range values {
+		switch v := v.(type) {
+		case float64:
+			b = append(b, amfNumber)
+			b = appendUint64(b, math.Float64bits(v))
+		case int:
+			b = append(b, amfNumber)
+			b = appendUint64(b, math.Float64bits(float64(v)))
+		case bool:
+			b = append(b, amfBoolean)
+			if v {
+				b = append(b, 1)
+			} else {
+				b = append(b, 0)
+			}
+		case string:
+			b = append(b, amfString)
+			b = appendString(b, v)
+		case map[string]interface{}:
+			b = append(b, amfObject)
+
+			// Sort keys to get a deterministic output
+			keys := make([]string, 0, len(v))
+			for key := range v {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				b = appendString(b, key)
+				b = amfEncode(b, v[key])
+			}
+			b = append(b, 0, 0, amfObjectEnd)
+		default:
+			b = append(b, amfNull)
+		}
+	}
+	return b
+}
+
+func appendString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
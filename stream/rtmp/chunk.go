@@ -0,0 +1,234 @@
+// Package rtmp serves a RTMP server
+package rtmp
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Message types
+const (
+	msgSetChunkSize     = 1
+	msgAbort            = 2
+	msgAck              = 3
+	msgUserControl      = 4
+	msgWindowAckSize    = 5
+	msgSetPeerBandwidth = 6
+	msgAudio            = 8
+	msgVideo            = 9
+	msgDataAMF3         = 15
+	msgCommandAMF3      = 17
+	msgDataAMF0         = 18
+	msgCommandAMF0      = 20
+)
+
+// Chunk stream identifiers used when sending
+const (
+	csidControl = 2
+	csidCommand = 3
+	csidStatus  = 5
+)
+
+const (
+	// Chunk size at the beginning of a connection
+	defaultChunkSize = 128
+
+	// Timestamps above this value are sent in an extended field
+	extendedTimestamp = 0xffffff
+
+	// Limits of chunk streams and message size before publishing, commands
+	// are small and use few chunk streams
+	unauthChunkStreams = 8
+	unauthMessageSize  = 64 * 1024
+
+	// Limits of chunk streams and message size while publishing
+	maxChunkStreams = 64
+	maxMessageSize  = 0xffffff
+)
+
+// message is a complete RTMP message
+type message struct {
+	typeID    byte
+	streamID  uint32
+	timestamp uint32
+	payload   []byte
+}
+
+// chunkStream holds the state of a chunk stream, as chunk headers only send
+// what changed since previous chunk
+type chunkStream struct {
+	timestamp uint32
+	delta     uint32
+	length    int
+	typeID    byte
+	streamID  uint32
+	extended  bool
+
+	// Message being received
+	payload []byte
+}
+
+// chunkReader reassembles messages from chunks
+type chunkReader struct {
+	r         io.Reader
+	chunkSize int
+	streams   map[uint32]*chunkStream
+
+	// Maximum number of chunk streams and message size
+	maxStreams int
+	maxLength  int
+
+	// Total bytes read, for acknowledgements
+	bytesRead uint32
+}
+
+func newChunkReader(r io.Reader) *chunkReader {
+	return &chunkReader{
+		r:          r,
+		chunkSize:  defaultChunkSize,
+		streams:    make(map[uint32]*chunkStream),
+		maxStreams: unauthChunkStreams,
+		maxLength:  unauthMessageSize,
+	}
+}
+
+func (c *chunkReader) readFull(b []byte) error {
+	n, err := io.ReadFull(c.r, b)
+	c.bytesRead += uint32(n)
+	return err
+}
+
+// readMessage reads chunks until a message is complete.
+func (c *chunkReader) readMessage() (*message, error) {
+	var buf [11]byte
+	for {
+		// Basic header
+		if err := c.readFull(buf[:1]); err != nil {
+			return nil, err
+		}
+		format := buf[0] >> 6
+		csid := uint32(buf[0] & 0x3f)
+		switch csid {
+		case 0:
+			if err := c.readFull(buf[:1]); err != nil {
+				return nil, err
+			}
+			csid = 64 + uint32(buf[0])
+		case 1:
+			if err := c.readFull(buf[:2]); err != nil {
+				return nil, err
+			}
+			csid = 64 + uint32(buf[0]) + uint32(buf[1])<<8
+		}
+		cs, ok := c.streams[csid]
+		if !ok {
+			if format != 0 {
+				return nil, errors.New("chunk stream does not start with a full header")
+			}
+			if len(c.streams) >= c.maxStreams {
+				return nil, errors.New("too many chunk streams")
+			}
+			cs = &chunkStream{}
+			c.streams[csid] = cs
+		}
+
+		// Message header
+		headerSizes := [4]int{11, 7, 3, 0}
+		header := buf[:headerSizes[format]]
+		if err := c.readFull(header); err != nil {
+			return nil, err
+		}
+		if format < 3 {
+			ts := uint32(header[0])<<16 | uint32(header[1])<<8 | uint32(header[2])
+			cs.extended = ts == extendedTimestamp
+			if format == 0 {
+				cs.timestamp = 0
+			}
+			cs.delta = ts
+		}
+		if format < 2 {
+			cs.length = int(header[3])<<16 | int(header[4])<<8 | int(header[5])
+			cs.typeID = header[6]
+			if cs.length > c.maxLength {
+				return nil, errors.New("message is too large")
+			}
+		}
+		if format == 0 {
+			cs.streamID = binary.LittleEndian.Uint32(header[7:11])
+		}
+		if cs.extended {
+			if err := c.readFull(buf[:4]); err != nil {
+				return nil, err
+			}
+			if format < 3 {
+				cs.delta = binary.BigEndian.Uint32(buf[:4])
+			}
+		}
+
+		// Timestamp changes on each new message
+		if len(cs.payload) == 0 {
+			cs.timestamp += cs.delta
+		}
+
+		// Chunk data
+		n := cs.length - len(cs.payload)
+		if n > c.chunkSize {
+			n = c.chunkSize
+		}
+		start := len(cs.payload)
+		cs.payload = append(cs.payload, make([]byte, n)...)
+		if err := c.readFull(cs.payload[start:]); err != nil {
+			return nil, err
+		}
+		if len(cs.payload) < cs.length {
+			continue
+		}
+
+		msg := &message{
+			typeID:    cs.typeID,
+			streamID:  cs.streamID,
+			timestamp: cs.timestamp,
+			payload:   cs.payload,
+		}
+		cs.payload = nil
+		return msg, nil
+	}
+}
+
+// chunkWriter splits messages in chunks
+type chunkWriter struct {
+	w         io.Writer
+	chunkSize int
+}
+
+// writeMessage sends a message with a full header then continuation chunks.
+func (c *chunkWriter) writeMessage(csid byte, msg *message) error {
+	header := make([]byte, 0, 16)
+	header = append(header, csid&0x3f)
+	header = append(header, byte(msg.timestamp>>16), byte(msg.timestamp>>8), byte(msg.timestamp))
+	length := len(msg.payload)
+	header = append(header, byte(length>>16), byte(length>>8), byte(length), msg.typeID)
+	header = append(header, byte(msg.streamID), byte(msg.streamID>>8), byte(msg.streamID>>16), byte(msg.streamID>>24))
+	if _, err := c.w.Write(header); err != nil {
+		return err
+	}
+
+	payload := msg.payload
+	for {
+		n := len(payload)
+		if n > c.chunkSize {
+			n = c.chunkSize
+		}
+		if _, err := c.w.Write(payload[:n]); err != nil {
+			return err
+		}
+		payload = payload[n:]
+		if len(payload) == 0 {
+			return nil
+		}
+		if _, err := c.w.Write([]byte{0xc0 | csid&0x3f}); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,281 @@
+// Package rtmp serves a RTMP server
+package rtmp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"gitlab.crans.org/nounous/ghostream/auth"
+	"gitlab.crans.org/nounous/ghostream/internal/flv"
+	"gitlab.crans.org/nounous/ghostream/messaging"
+)
+
+const (
+	// Chunk size and window sizes announced to publishers
+	serverChunkSize  = 4096
+	serverWindowSize = 2500000
+
+	// Publisher is disconnected if nothing is received during this time
+	readTimeout = 10 * time.Second
+
+	// Stream ID given to the publisher by createStream
+	publishStreamID = 1
+)
+
+// conn is a RTMP connection from a publisher
+type conn struct {
+	socket net.Conn
+	reader *chunkReader
+	writer *chunkWriter
+
+	// Acknowledgement window of the publisher, 0 if not set
+	ackWindow uint32
+	ackSent   uint32
+
+	streams     *messaging.Streams
+	authBackend auth.Backend
+
+	// Set once publishing started
+	name    string
+	quality *messaging.Quality
+	remuxer *remuxer
+}
+
+func handleStreamer(socket net.Conn, streams *messaging.Streams, authBackend auth.Backend) {
+	c := &conn{
+		socket:      socket,
+		reader:      newChunkReader(bufio.NewReader(socket)),
+		writer:      &chunkWriter{w: socket, chunkSize: defaultChunkSize},
+		streams:     streams,
+		authBackend: authBackend,
+	}
+
+	if err := c.serve(); err != nil {
+		log.Printf("Closing RTMP connection from %s: %s", socket.RemoteAddr(), err)
+	}
+
+	// Close stream, it is kept a bit in case the publisher reconnects
+	if c.quality != nil {
+		log.Printf("RTMP streamer left stream '%s'", c.name)
+		c.streams.Release(c.name)
+	}
+	socket.Close()
+}
+
+// serve handles messages until the publisher leaves.
+func (c *conn) serve() error {
+	if err := c.socket.SetDeadline(time.Now().Add(readTimeout)); err != nil {
+		return err
+	}
+	if err := handshake(c.socket); err != nil {
+		return fmt.Errorf("handshake failed, %s", err)
+	}
+
+	for {
+		if err := c.socket.SetDeadline(time.Now().Add(readTimeout)); err != nil {
+			return err
+		}
+		msg, err := c.reader.readMessage()
+		if err != nil {
+			return err
+		}
+		if err := c.acknowledge(); err != nil {
+			return err
+		}
+
+		switch msg.typeID {
+		case msgSetChunkSize:
+			if len(msg.payload) < 4 {
+				return errors.New("invalid set chunk size message")
+			}
+			size := int(binary.BigEndian.Uint32(msg.payload) & 0x7fffffff)
+			if size < 1 {
+				return errors.New("invalid chunk size")
+			}
+			c.reader.chunkSize = size
+		case msgWindowAckSize:
+			if len(msg.payload) < 4 {
+				return errors.New("invalid window acknowledgement size message")
+			}
+			c.ackWindow = binary.BigEndian.Uint32(msg.payload)
+		case msgCommandAMF3, msgCommandAMF0:
+			payload := msg.payload
+			if msg.typeID == msgCommandAMF3 && len(payload) > 0 {
+				// Skip AMF3 format selector
+				payload = payload[1:]
+			}
+			done, err := c.handleCommand(payload)
+			if err != nil || done {
+				return err
+			}
+		case msgAudio, msgVideo:
+			c.broadcastTag(msg.typeID, msg.timestamp, msg.payload)
+		}
+	}
+}
+
+// acknowledge sends an acknowledgement each time the publisher window is received.
+func (c *conn) acknowledge() error {
+	if c.ackWindow == 0 || c.reader.bytesRead-c.ackSent < c.ackWindow {
+		return nil
+	}
+	c.ackSent = c.reader.bytesRead
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, c.ackSent)
+	return c.writer.writeMessage(csidControl, &message{typeID: msgAck, payload: payload})
+}
+
+// handleCommand answers publisher commands.
+// It returns true when the publisher stops publishing.
+func (c *conn) handleCommand(payload []byte) (bool, error) {
+	values, err := amfDecodeAll(payload)
+	if err != nil {
+		return false, err
+	}
+	if len(values) < 2 {
+		return false, errors.New("invalid command message")
+	}
+	name, _ := values[0].(string)
+	transactionID, _ := values[1].(float64)
+
+	switch name {
+	case "connect":
+		return false, c.connect(transactionID)
+	case "createStream":
+		return false, c.sendCommand(csidCommand, 0, "_result", transactionID, nil, publishStreamID)
+	case "publish":
+		if len(values) < 4 {
+			return false, errors.New("invalid publish command")
+		}
+		key, _ := values[3].(string)
+		return false, c.publish(key)
+	case "FCUnpublish", "deleteStream", "closeStream":
+		return c.quality != nil, nil
+	}
+
+	// Other commands such as releaseStream and FCPublish need no answer
+	return false, nil
+}
+
+func (c *conn) connect(transactionID float64) error {
+	// Announce window and chunk sizes
+	if err := c.sendControl(msgWindowAckSize, uint32(serverWindowSize)); err != nil {
+		return err
+	}
+	if err := c.sendControl(msgSetPeerBandwidth, uint32(serverWindowSize), 2); err != nil {
+		return err
+	}
+	if err := c.sendControl(msgSetChunkSize, uint32(serverChunkSize)); err != nil {
+		return err
+	}
+	c.writer.chunkSize = serverChunkSize
+
+	return c.sendCommand(csidCommand, 0, "_result", transactionID, map[string]interface{}{
+		"fmsVer":       "FMS/3,0,1,123",
+		"capabilities": 31,
+	}, map[string]interface{}{
+		"level":          "status",
+		"code":           "NetConnection.Connect.Success",
+		"description":    "Connection succeeded.",
+		"objectEncoding": 0,
+	})
+}
+
+// publish authenticates the stream key then creates the stream.
+// Stream key is "name:password", like SRT stream id.
+func (c *conn) publish(key string) error {
+	if c.quality != nil {
+		return errors.New("already publishing")
+	}
+
+	// Remove query parameters added by some clients
+	key = strings.SplitN(key, "?", 2)[0]
+	split := strings.SplitN(key, ":", 2)
+	name, password := split[0], ""
+	if len(split) > 1 {
+		password = split[1]
+	}
+
+	if c.authBackend != nil {
+		// check password
+		if ok, err := c.authBackend.Login(name, password); !ok || err != nil {
+			log.Printf("Failed to authenticate for stream %s", name)
+			c.sendStatus("error", "NetStream.Publish.BadName", "Authentication failed.")
+			return errors.New("authentication failed")
+		}
+	}
+
+	// Describe stream with publisher information
+	info := auth.Info(c.authBackend, name)
+	metadata := messaging.Metadata{
+		Title:       info.DisplayName,
+		Description: info.Description,
+		Publisher:   info.Username,
+		Protocol:    "rtmp",
+		RemoteAddr:  c.socket.RemoteAddr().String(),
+	}
+
+	// Create stream and source quality
+	_, q, err := c.streams.Publish(name, metadata)
+	if err != nil {
+		c.sendStatus("error", "NetStream.Publish.BadName", "Stream is already published.")
+		return err
+	}
+	c.name = name
+	c.quality = q
+	c.remuxer = newRemuxer()
+
+	// Media need larger messages than commands
+	c.reader.maxStreams = maxChunkStreams
+	c.reader.maxLength = maxMessageSize
+	log.Printf("New RTMP streamer for stream '%s' quality 'source'", name)
+
+	// Stream begin user control event then publish status
+	event := make([]byte, 6)
+	binary.BigEndian.PutUint32(event[2:], publishStreamID)
+	if err := c.writer.writeMessage(csidControl, &message{typeID: msgUserControl, payload: event}); err != nil {
+		return err
+	}
+	return c.sendStatus("status", "NetStream.Publish.Start", "Start publishing.")
+}
+
+// broadcastTag remuxes an audio or video message in MPEG-TS.
+// Metadata messages are ignored, media information is found in the streams.
+func (c *conn) broadcastTag(tagType byte, timestamp uint32, data []byte) {
+	if c.quality == nil || len(data) == 0 {
+		// Not publishing yet
+		return
+	}
+	if msg := c.remuxer.write(flv.Tag(tagType, timestamp, data)); msg != nil {
+		c.quality.Broadcast <- msg
+	}
+}
+
+func (c *conn) sendControl(typeID byte, value uint32, extra ...byte) error {
+	payload := make([]byte, 4, 4+len(extra))
+	binary.BigEndian.PutUint32(payload, value)
+	payload = append(payload, extra...)
+	return c.writer.writeMessage(csidControl, &message{typeID: typeID, payload: payload})
+}
+
+func (c *conn) sendCommand(csid byte, streamID uint32, values ...interface{}) error {
+	return c.writer.writeMessage(csid, &message{
+		typeID:   msgCommandAMF0,
+		streamID: streamID,
+		payload:  amfEncode(nil, values...),
+	})
+}
+
+func (c *conn) sendStatus(level, code, description string) error {
+	return c.sendCommand(csidStatus, publishStreamID, "onStatus", 0, nil, map[string]interface{}{
+		"level":       level,
+		"code":        code,
+		"description": description,
+	})
+}
@@ -0,0 +1,46 @@
+// Package rtmp serves a RTMP server
+package rtmp
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+)
+
+const (
+	// RTMP version sent in C0 and S0
+	rtmpVersion = 3
+
+	// Size of C1, C2, S1 and S2
+	handshakeSize = 1536
+)
+
+// handshake runs the server side of the simple handshake.
+// Publishers do not check the digest of the complex handshake,
+// so S1 is random data and S2 echoes C1.
+func handshake(rw io.ReadWriter) error {
+	// Read C0 and C1
+	c0c1 := make([]byte, 1+handshakeSize)
+	if _, err := io.ReadFull(rw, c0c1); err != nil {
+		return err
+	}
+	if c0c1[0] != rtmpVersion {
+		return errors.New("unsupported RTMP version")
+	}
+
+	// Send S0, S1 and S2
+	s0s1s2 := make([]byte, 1+2*handshakeSize)
+	s0s1s2[0] = rtmpVersion
+	if _, err := rand.Read(s0s1s2[9 : 1+handshakeSize]); err != nil {
+		return err
+	}
+	copy(s0s1s2[1+handshakeSize:], c0c1[1:])
+	if _, err := rw.Write(s0s1s2); err != nil {
+		return err
+	}
+
+	// Read C2, its content does not matter
+	c2 := make([]byte, handshakeSize)
+	_, err := io.ReadFull(rw, c2)
+	return err
+}
@@ -0,0 +1,66 @@
+// Package rtmp serves a RTMP server
+package rtmp
+
+import (
+	"bytes"
+	"log"
+
+	"gitlab.crans.org/nounous/ghostream/internal/demux"
+	"gitlab.crans.org/nounous/ghostream/internal/flv"
+	"gitlab.crans.org/nounous/ghostream/internal/mpegts"
+)
+
+// Stream types of the codecs carried by RTMP
+var streamTypes = map[string]byte{
+	"h264": mpegts.StreamTypeH264,
+	"aac":  mpegts.StreamTypeADTSAAC,
+	"mp3":  mpegts.StreamTypeMPEG1Audio,
+}
+
+// remuxer converts the FLV tags of a publisher in MPEG-TS, like other
+// sources, so SRT and MPEG-TS outputs forward it as is
+type remuxer struct {
+	demuxer *demux.Demuxer
+	muxer   *mpegts.Muxer
+	buffer  bytes.Buffer
+
+	// PID of each stream by codec
+	pids map[string]uint16
+}
+
+func newRemuxer() *remuxer {
+	r := &remuxer{demuxer: demux.New(), pids: make(map[string]uint16)}
+	r.muxer = mpegts.NewMuxer(&r.buffer)
+	r.demuxer.Write(flv.Header(true, true))
+	return r
+}
+
+// write remuxes a FLV tag, it returns the MPEG-TS data to broadcast or nil
+func (r *remuxer) write(tag []byte) []byte {
+	for _, f := range r.demuxer.Write(tag) {
+		// Streams are declared once their sequence header is received
+		for _, codec := range r.demuxer.Codecs() {
+			if _, ok := r.pids[codec]; !ok && streamTypes[codec] != 0 {
+				r.pids[codec] = r.muxer.AddStream(streamTypes[codec], nil)
+			}
+		}
+		pid, ok := r.pids[f.Codec]
+		if !ok {
+			continue
+		}
+		data := f.Data
+		if f.Codec == "aac" {
+			data = append(demux.ADTSHeader(f.Config, len(f.Data)), f.Data...)
+		}
+		if err := r.muxer.WritePES(pid, f.PTS, f.DTS, f.Keyframe, data); err != nil {
+			log.Printf("Failed to remux RTMP stream: %s", err)
+		}
+	}
+	if r.buffer.Len() == 0 {
+		return nil
+	}
+	msg := make([]byte, r.buffer.Len())
+	copy(msg, r.buffer.Bytes())
+	r.buffer.Reset()
+	return msg
+}
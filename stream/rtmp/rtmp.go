@@ -0,0 +1,42 @@
+// Package rtmp serves a RTMP server
+package rtmp
+
+import (
+	"log"
+	"net"
+
+	"gitlab.crans.org/nounous/ghostream/auth"
+	"gitlab.crans.org/nounous/ghostream/messaging"
+)
+
+// Options holds rtmp package configuration
+type Options struct {
+	Enabled       bool
+	ListenAddress string
+}
+
+// Serve RTMP server
+func Serve(streams *messaging.Streams, authBackend auth.Backend, cfg *Options) {
+	if !cfg.Enabled {
+		// RTMP is not enabled, ignore
+		return
+	}
+
+	// Start TCP server
+	listener, err := net.Listen("tcp", cfg.ListenAddress)
+	if err != nil {
+		log.Fatalf("Error while listening to the address %s: %s", cfg.ListenAddress, err)
+	}
+	log.Printf("RTMP server listening on %s", cfg.ListenAddress)
+
+	// Handle each new publisher
+	for {
+		socket, err := listener.Accept()
+		if err != nil {
+			log.Printf("Error while accepting TCP socket: %s", err)
+			continue
+		}
+
+		go handleStreamer(socket, streams, authBackend)
+	}
+}
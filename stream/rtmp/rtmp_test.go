@@ -0,0 +1,192 @@
+package rtmp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"gitlab.crans.org/nounous/ghostream/internal/demux"
+	"gitlab.crans.org/nounous/ghostream/internal/mpegts"
+	"gitlab.crans.org/nounous/ghostream/messaging"
+)
+
+func TestAMF(t *testing.T) {
+	obj := map[string]interface{}{"app": "live", "objectEncoding": 0.0, "fpad": false}
+	b := amfEncode(nil, "connect", 1, obj, nil)
+	values, err := amfDecodeAll(b)
+	if err != nil {
+		t.Fatalf("Failed to decode AMF0 values: %s", err)
+	}
+	if len(values) != 4 || values[0] != "connect" || values[1] != 1.0 || values[3] != nil {
+		t.Errorf("Decoded wrong AMF0 values: %v", values)
+	}
+	decoded, ok := values[2].(map[string]interface{})
+	if !ok || decoded["app"] != "live" || decoded["objectEncoding"] != 0.0 || decoded["fpad"] != false {
+		t.Errorf("Decoded wrong AMF0 object: %v", values[2])
+	}
+
+	// Truncated value
+	if _, err := amfDecodeAll(b[:len(b)-3]); err == nil {
+		t.Errorf("Decoded truncated AMF0 values")
+	}
+
+	// Nested arrays, the limit is accepted
+	nested := func(depth int) []byte {
+		b := make([]byte, 0)
+		for i := 0; i < depth; i++ {
+			b = append(b, amfStrictArray, 0, 0, 0, 1)
+		}
+		return append(b, amfNull)
+	}
+	if _, err := amfDecodeAll(nested(amfMaxDepth)); err != nil {
+		t.Errorf("Failed to decode nested AMF0 arrays: %s", err)
+	}
+	if _, err := amfDecodeAll(nested(100000)); err != errAMFTooDeep {
+		t.Errorf("Decoded AMF0 arrays nested too deeply, got %v", err)
+	}
+}
+
+func TestChunkLimits(t *testing.T) {
+	var buf bytes.Buffer
+	writer := &chunkWriter{w: &buf, chunkSize: defaultChunkSize}
+	for csid := byte(3); csid < 4+unauthChunkStreams; csid++ {
+		writer.writeMessage(csid, &message{typeID: msgCommandAMF0, payload: []byte{amfNull}})
+	}
+	reader := newChunkReader(&buf)
+	for i := 0; i < unauthChunkStreams; i++ {
+		if _, err := reader.readMessage(); err != nil {
+			t.Fatalf("Failed to read message %d: %s", i, err)
+		}
+	}
+	if _, err := reader.readMessage(); err == nil {
+		t.Errorf("Read message from too many chunk streams")
+	}
+
+	// Large message
+	buf.Reset()
+	writer.writeMessage(3, &message{typeID: msgCommandAMF0, payload: make([]byte, unauthMessageSize+1)})
+	if _, err := newChunkReader(&buf).readMessage(); err == nil {
+		t.Errorf("Read message larger than limit")
+	}
+}
+
+// TestPublish publishes video and checks it is remuxed in MPEG-TS
+func TestPublish(t *testing.T) {
+	streams := messaging.New(&messaging.Options{})
+	event := make(chan messaging.Event, 8)
+	streams.Subscribe(event, messaging.Filter{Types: []messaging.EventType{messaging.QualityCreated}})
+
+	client, server := net.Pipe()
+	go handleStreamer(server, streams, nil)
+
+	// Handshake
+	c0c1 := make([]byte, 1+handshakeSize)
+	c0c1[0] = rtmpVersion
+	if _, err := client.Write(c0c1); err != nil {
+		t.Fatalf("Failed to send C0 and C1: %s", err)
+	}
+	s0s1s2 := make([]byte, 1+2*handshakeSize)
+	if _, err := io.ReadFull(client, s0s1s2); err != nil {
+		t.Fatalf("Failed to receive S0, S1 and S2: %s", err)
+	}
+	if _, err := client.Write(s0s1s2[1 : 1+handshakeSize]); err != nil {
+		t.Fatalf("Failed to send C2: %s", err)
+	}
+
+	// Read server messages
+	statuses := make(chan string, 8)
+	go func() {
+		reader := newChunkReader(client)
+		for {
+			msg, err := reader.readMessage()
+			if err != nil {
+				close(statuses)
+				return
+			}
+			switch msg.typeID {
+			case msgSetChunkSize:
+				reader.chunkSize = serverChunkSize
+			case msgCommandAMF0:
+				values, _ := amfDecodeAll(msg.payload)
+				if len(values) > 3 {
+					if status, ok := values[3].(map[string]interface{}); ok {
+						statuses <- status["code"].(string)
+						continue
+					}
+				}
+				statuses <- values[0].(string)
+			}
+		}
+	}()
+
+	writer := &chunkWriter{w: client, chunkSize: defaultChunkSize}
+	command := func(streamID uint32, values ...interface{}) {
+		msg := &message{typeID: msgCommandAMF0, streamID: streamID, payload: amfEncode(nil, values...)}
+		if err := writer.writeMessage(csidCommand, msg); err != nil {
+			t.Fatalf("Failed to send command: %s", err)
+		}
+	}
+	command(0, "connect", 1, map[string]interface{}{"app": "live"})
+	if s := <-statuses; s != "NetConnection.Connect.Success" {
+		t.Errorf("Connect returned %s", s)
+	}
+	command(0, "createStream", 2, nil)
+	if s := <-statuses; s != "_result" {
+		t.Errorf("Create stream returned %s", s)
+	}
+	command(publishStreamID, "publish", 3, nil, "demo:password", "live")
+	if s := <-statuses; s != "NetStream.Publish.Start" {
+		t.Errorf("Publish returned %s", s)
+	}
+
+	// Stream was created
+	e := <-event
+	if e.Stream != "demo" || e.Quality != "source" {
+		t.Fatalf("Created wrong stream %s quality %s", e.Stream, e.Quality)
+	}
+	stream, _ := streams.Get("demo")
+	if m := stream.Metadata(); m.Protocol != "rtmp" || m.Publisher != "demo" {
+		t.Errorf("Stream has wrong metadata: %v", m)
+	}
+	quality, _ := stream.GetQuality("source")
+	output := make(chan []byte, 8)
+	quality.Register(output, messaging.Policy{})
+
+	// Send an AVC sequence header, then frames larger than chunk size
+	sps := []byte{0x67, 0x42, 0xc0, 0x28, 0xf4, 0x03, 0xc0, 0x11, 0x3f, 0x2a}
+	header := append([]byte{0x17, 0, 0, 0, 0, 1, 0x42, 0xc0, 0x28, 0xff, 0xe1, 0, byte(len(sps))}, sps...)
+	header = append(header, 1, 0, 2, 0x68, 0xce)
+	idr := append([]byte{0x65}, bytes.Repeat([]byte{42}, 300)...)
+	keyframe := append([]byte{0x17, 1, 0, 0, 0, 0, 0, byte(len(idr) >> 8), byte(len(idr))}, idr...)
+	next := append([]byte{0x27, 1, 0, 0, 0, 0, 0, byte(len(idr) >> 8), byte(len(idr)), 0x41}, idr[1:]...)
+	for i, payload := range [][]byte{header, keyframe, next} {
+		msg := &message{typeID: msgVideo, streamID: publishStreamID, timestamp: uint32(40 * i), payload: payload}
+		if err := writer.writeMessage(6, msg); err != nil {
+			t.Fatalf("Failed to send video: %s", err)
+		}
+	}
+
+	// Keyframe is remuxed in MPEG-TS, with parameter sets
+	demuxer := demux.New()
+	var frames []demux.Frame
+	for i := 0; i < 2; i++ {
+		data := <-output
+		if data[0] != mpegts.SyncByte {
+			t.Fatalf("Video was not remuxed in MPEG-TS")
+		}
+		frames = append(frames, demuxer.Write(data)...)
+	}
+	if len(frames) != 1 || frames[0].Codec != "h264" || !frames[0].Keyframe || frames[0].PTS != 40*90 {
+		t.Fatalf("Wrong frames were remuxed: %v", frames)
+	}
+	if !bytes.Contains(frames[0].Data, sps) || !bytes.HasSuffix(frames[0].Data, idr) {
+		t.Errorf("Keyframe was not remuxed with parameter sets")
+	}
+
+	// Publisher leaves
+	client.Close()
+	if _, ok := <-output; ok {
+		t.Errorf("Output was not closed after publisher left")
+	}
+}
@@ -3,28 +3,22 @@ package srt
 
 import (
 	"log"
+	"strings"
 
 	"github.com/haivision/srtgo"
 	"gitlab.crans.org/nounous/ghostream/messaging"
 )
 
-func handleStreamer(socket *srtgo.SrtSocket, streams *messaging.Streams, name string) {
-	// Create stream
-	stream, err := streams.Create(name)
+func handleStreamer(socket *srtgo.SrtSocket, streams *messaging.Streams, name string, metadata messaging.Metadata) {
+	// Create stream and source quality
+	_, q, err := streams.Publish(name, metadata)
 	if err != nil {
-		log.Printf("Error on stream creating: %s", err)
-		socket.Close()
-		return
-	}
-
-	// Create source quality
-	q, err := stream.CreateQuality("source")
-	if err != nil {
-		log.Printf("Error on quality creating: %s", err)
+		log.Printf("Error on stream publishing: %s", err)
 		socket.Close()
 		return
 	}
 	log.Printf("New SRT streamer for stream '%s' quality 'source'", name)
+	stopMonitoring := monitorLink(socket, name, rolePublisher, metadata.RemoteAddr)
 
 	// Read RTP packets forever and send them to the WebRTC Client
 	for {
@@ -50,26 +44,26 @@ func handleStreamer(socket *srtgo.SrtSocket, streams *messaging.Streams, name st
 		q.Broadcast <- buff
 	}
 
-	// Close stream
-	streams.Delete(name)
+	// Close stream, it is kept a bit in case the publisher reconnects
+	stopMonitoring()
+	streams.Release(name)
 	socket.Close()
 }
 
-func handleViewer(socket *srtgo.SrtSocket, streams *messaging.Streams, name string) {
+func handleViewer(socket *srtgo.SrtSocket, streams *messaging.Streams, name, qualityName, remoteAddr string) {
 	// Get requested stream
 	stream, err := streams.Get(name)
 	if err != nil {
-		log.Printf("Failed to get stream: %s", err)
+		log.Printf("Rejecting SRT viewer for stream %s: %s", name, err)
 		socket.Close()
 		return
 	}
 
 	// Get requested quality
-	// FIXME: make qualities available
-	qualityName := "source"
 	q, err := stream.GetQuality(qualityName)
 	if err != nil {
-		log.Printf("Failed to get quality: %s", err)
+		log.Printf("Rejecting SRT viewer for stream %s: quality %s does not exist, available qualities are %s",
+			name, qualityName, strings.Join(stream.Qualities(), ", "))
 		socket.Close()
 		return
 	}
@@ -77,8 +71,9 @@ func handleViewer(socket *srtgo.SrtSocket, streams *messaging.Streams, name stri
 
 	// Register new output
 	c := make(chan []byte, 1024)
-	q.Register(c)
+	q.Register(c, messaging.Policy{Name: "srt", Mode: messaging.DropUntilKeyframe})
 	stream.IncrementClientCount()
+	stopMonitoring := monitorLink(socket, name, roleViewer, remoteAddr)
 
 	// Receive data and send them
 	for data := range c {
@@ -87,16 +82,35 @@ func handleViewer(socket *srtgo.SrtSocket, streams *messaging.Streams, name stri
 			break
 		}
 
-		// Send data
-		_, err := socket.Write(data, 1000)
-		if err != nil {
+		// Send data, cached data can be larger than a SRT packet
+		if err := writeChunks(socket, data); err != nil {
 			log.Printf("Remove SRT viewer because of sending error, %s", err)
 			break
 		}
 	}
 
 	// Close output
+	stopMonitoring()
 	q.Unregister(c)
 	stream.DecrementClientCount()
 	socket.Close()
 }
+
+// SRT live mode cannot send messages larger than payload size,
+// 1316 bytes is 7 MPEG-TS packets
+const maxPayloadSize = 1316
+
+// writeChunks sends data in several SRT packets if needed
+func writeChunks(socket *srtgo.SrtSocket, data []byte) error {
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxPayloadSize {
+			n = maxPayloadSize
+		}
+		if _, err := socket.Write(data[:n], 1000); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
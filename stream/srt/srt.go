@@ -2,10 +2,11 @@
 package srt
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"net"
 	"strconv"
-	"strings"
 
 	"github.com/haivision/srtgo"
 	"gitlab.crans.org/nounous/ghostream/auth"
@@ -17,6 +18,48 @@ type Options struct {
 	Enabled       bool
 	ListenAddress string
 	MaxClients    int
+
+	// AES encryption of all connections on ListenAddress,
+	// disabled when passphrase is empty
+	Passphrase string
+	PbKeyLen   int
+
+	// Streams served on their own listener with their own encryption.
+	// These streams are refused on ListenAddress.
+	Streams map[string]StreamOptions
+}
+
+// StreamOptions holds the listener configuration of a stream
+type StreamOptions struct {
+	ListenAddress string
+	Passphrase    string
+	PbKeyLen      int
+}
+
+// socketOptions returns srtgo options of a listener,
+// accepted sockets inherit encryption settings.
+func socketOptions(passphrase string, pbKeyLen int) (map[string]string, error) {
+	options := make(map[string]string)
+	options["blocking"] = "0"
+	options["transtype"] = "live"
+	if passphrase == "" {
+		return options, nil
+	}
+
+	// libsrt refuses other lengths
+	if len(passphrase) < 10 || len(passphrase) > 79 {
+		return nil, errors.New("passphrase must be 10 to 79 characters long")
+	}
+	switch pbKeyLen {
+	case 0, 16, 24, 32:
+	default:
+		return nil, fmt.Errorf("invalid key length %d, must be 16, 24 or 32", pbKeyLen)
+	}
+	options["passphrase"] = passphrase
+	if pbKeyLen != 0 {
+		options["pbkeylen"] = strconv.Itoa(pbKeyLen)
+	}
+	return options, nil
 }
 
 // Split host and port from listen address
@@ -42,24 +85,52 @@ func Serve(streams *messaging.Streams, authBackend auth.Backend, cfg *Options) {
 		return
 	}
 
-	// Start SRT in listening mode
-	log.Printf("SRT server listening on %s", cfg.ListenAddress)
-	host, port, err := splitHostPort(cfg.ListenAddress)
+	// Start a listener for each stream with its own encryption
+	for name, streamCfg := range cfg.Streams {
+		if streamCfg.ListenAddress == "" {
+			log.Printf("SRT stream %s has no listen address, ignoring it", name)
+			continue
+		}
+		name := name
+		sck := listen(streamCfg.ListenAddress, streamCfg.Passphrase, streamCfg.PbKeyLen, cfg.MaxClients)
+		go accept(sck, streams, authBackend, func(stream string) bool {
+			return stream == name
+		})
+	}
+
+	// Main listener serves all other streams
+	sck := listen(cfg.ListenAddress, cfg.Passphrase, cfg.PbKeyLen, cfg.MaxClients)
+	accept(sck, streams, authBackend, func(stream string) bool {
+		_, ok := cfg.Streams[stream]
+		return !ok
+	})
+}
+
+// listen starts SRT in listening mode
+func listen(listenAddress, passphrase string, pbKeyLen, maxClients int) *srtgo.SrtSocket {
+	log.Printf("SRT server listening on %s", listenAddress)
+	host, port, err := splitHostPort(listenAddress)
 	if err != nil {
-		log.Fatalf("Failed to split host and port from %s", cfg.ListenAddress)
+		log.Fatalf("Failed to split host and port from %s", listenAddress)
 	}
 
-	options := make(map[string]string)
-	options["blocking"] = "0"
-	options["transtype"] = "live"
+	options, err := socketOptions(passphrase, pbKeyLen)
+	if err != nil {
+		log.Fatalf("Invalid SRT encryption for %s: %s", listenAddress, err)
+	}
 	sck := srtgo.NewSrtSocket(host, port, options)
-	if err := sck.Listen(cfg.MaxClients); err != nil {
+	if err := sck.Listen(maxClients); err != nil {
 		log.Fatal("Unable to listen for SRT clients:", err)
 	}
+	return sck
+}
 
+// accept handles new connections of a listener.
+// Connections to streams not allowed on this listener are closed.
+func accept(sck *srtgo.SrtSocket, streams *messaging.Streams, authBackend auth.Backend, allowed func(string) bool) {
 	for {
 		// Wait for new connection
-		s, _, err := sck.Accept()
+		s, addr, err := sck.Accept()
 		if err != nil {
 			// Something wrong happened
 			log.Println(err)
@@ -69,33 +140,62 @@ func Serve(streams *messaging.Streams, authBackend auth.Backend, cfg *Options) {
 		// FIXME: Flush socket
 		// Without this, the SRT buffer might get full before reading it
 
-		// streamid can be "name:password" for streamer or "name" for viewer
-		streamID, err := s.GetSockOptString(srtgo.SRTO_STREAMID)
+		// streamid can be "name:password" for streamer or "name" for viewer,
+		// or follow SRT Access Control syntax
+		sid, err := s.GetSockOptString(srtgo.SRTO_STREAMID)
 		if err != nil {
 			log.Print("Failed to get socket streamid")
+			s.Close()
 			continue
 		}
-		split := strings.Split(streamID, ":")
+		id, err := parseStreamID(sid)
+		if err != nil {
+			log.Printf("Failed to parse streamid: %s", err)
+			s.Close()
+			continue
+		}
+		if !allowed(id.Resource) {
+			log.Printf("Stream %s is not served on this SRT listener", id.Resource)
+			s.Close()
+			continue
+		}
+
+		remoteAddr := ""
+		if addr != nil {
+			remoteAddr = addr.String()
+		}
 
-		if len(split) > 1 {
-			// password was provided so it is a streamer
-			name, password := split[0], split[1]
+		if id.Mode == modePublish {
+			name := id.Resource
+			if id.User != name {
+				// Users can only publish their own stream
+				log.Printf("User %s is not allowed to publish stream %s", id.User, name)
+				s.Close()
+				continue
+			}
 			if authBackend != nil {
 				// check password
-				if ok, err := authBackend.Login(name, password); !ok || err != nil {
+				if ok, err := authBackend.Login(id.User, id.Session); !ok || err != nil {
 					log.Printf("Failed to authenticate for stream %s", name)
 					s.Close()
 					continue
 				}
 			}
 
-			go handleStreamer(s, streams, name)
-		} else {
-			// password was not provided so it is a viewer
-			name := split[0]
+			// Describe stream with publisher information
+			info := auth.Info(authBackend, id.User)
+			metadata := messaging.Metadata{
+				Title:       info.DisplayName,
+				Description: info.Description,
+				Publisher:   info.Username,
+				Protocol:    "srt",
+			}
+			metadata.RemoteAddr = remoteAddr
 
+			go handleStreamer(s, streams, name, metadata)
+		} else {
 			// Send stream
-			go handleViewer(s, streams, name)
+			go handleViewer(s, streams, id.Resource, id.Quality, remoteAddr)
 		}
 	}
 }
@@ -42,6 +42,65 @@ func TestSplitHostPort(t *testing.T) {
 	}
 }
 
+// TestSocketOptions checks encryption options given to libsrt
+func TestSocketOptions(t *testing.T) {
+	options, err := socketOptions("", 0)
+	if err != nil || options["passphrase"] != "" || options["transtype"] != "live" {
+		t.Errorf("Unencrypted options are wrong: %v, %v", options, err)
+	}
+
+	options, err = socketOptions("a very long secret", 32)
+	if err != nil || options["passphrase"] != "a very long secret" || options["pbkeylen"] != "32" {
+		t.Errorf("Encrypted options are wrong: %v, %v", options, err)
+	}
+
+	// libsrt limits
+	if _, err := socketOptions("short", 0); err == nil {
+		t.Errorf("Accepted a too short passphrase")
+	}
+	if _, err := socketOptions("a very long secret", 20); err == nil {
+		t.Errorf("Accepted an invalid key length")
+	}
+}
+
+// TestParseStreamID parses legacy and SRT Access Control stream ids
+func TestParseStreamID(t *testing.T) {
+	valid := map[string]streamID{
+		"demo":              {Resource: "demo", Quality: "source", Mode: modeRequest},
+		"demo:":             {Resource: "demo", Mode: modePublish, User: "demo"},
+		"demo:pa:ss":        {Resource: "demo", Mode: modePublish, User: "demo", Session: "pa:ss"},
+		"demo@720p":         {Resource: "demo", Quality: "720p", Mode: modeRequest},
+		"#!::r=demo@720p":   {Resource: "demo", Quality: "720p", Mode: modeRequest},
+		"#!::r=demo,q=720p": {Resource: "demo", Quality: "720p", Mode: modeRequest},
+		"#!::r=demo":        {Resource: "demo", Quality: "source", Mode: modeRequest},
+		"#!::r=demo,u=alice,s=secret,h=example.com": {Resource: "demo", Quality: "source", Mode: modeRequest, User: "alice", Session: "secret"},
+		"#!::m=publish,r=demo,s=pa:ss,t=stream":     {Resource: "demo", Mode: modePublish, User: "demo", Session: "pa:ss"},
+	}
+	for s, expected := range valid {
+		id, err := parseStreamID(s)
+		if err != nil {
+			t.Errorf("Failed to parse %q: %s", s, err)
+		}
+		if id != expected {
+			t.Errorf("Parsed %q as %+v, expected %+v", s, id, expected)
+		}
+	}
+
+	invalid := []string{
+		"#!::",
+		"#!::m=publish",
+		"#!::r=demo,m=bidirectional",
+		"#!::r=demo,m=play",
+		"#!::r=demo,t=file",
+		"#!::r=demo,s",
+	}
+	for _, s := range invalid {
+		if _, err := parseStreamID(s); err == nil {
+			t.Errorf("Parsed invalid stream id %q", s)
+		}
+	}
+}
+
 // TestServeSRT Serve a SRT server, stream content during 5 seconds and ensure that it is well received
 func TestServeSRT(t *testing.T) {
 	which := exec.Command("which", "ffmpeg")
@@ -58,7 +117,7 @@ func TestServeSRT(t *testing.T) {
 	}
 
 	// Init streams messaging and SRT server
-	streams := messaging.New()
+	streams := messaging.New(&messaging.Options{})
 	go Serve(streams, nil, &Options{Enabled: true, ListenAddress: ":9711", MaxClients: 2})
 
 	ffmpeg := exec.Command("ffmpeg", "-hide_banner", "-loglevel", "error",
@@ -0,0 +1,175 @@
+// Package srt serves a SRT server
+package srt
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/haivision/srtgo"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Roles of SRT links
+const (
+	rolePublisher = "publisher"
+	roleViewer    = "viewer"
+)
+
+// LinkStats holds network statistics of a SRT socket
+type LinkStats struct {
+	Stream string
+	Role   string
+
+	// Address of the peer, statistics are public so it is not encoded
+	RemoteAddr string `json:"-"`
+
+	// Round-trip time in milliseconds
+	RTT float64
+
+	// Lost packets, reported by receiver, and retransmitted packets since connection
+	PacketsLost          int
+	PacketsRetransmitted int
+
+	// Packets dropped because they arrived or were sent too late
+	PacketsDropped int
+
+	// Estimated link bandwidth in Mbit/s
+	Bandwidth float64
+
+	// Buffered duration in milliseconds, receiver buffer for publishers
+	// and sender buffer for viewers
+	BufferLatency int
+}
+
+// link is a monitored SRT socket
+type link struct {
+	id     string
+	socket *srtgo.SrtSocket
+	stats  LinkStats
+}
+
+var (
+	links     = make(map[*link]struct{})
+	linksLock sync.Mutex
+
+	// Identifier of the next link, to tell links of a stream apart in metrics
+	nextLinkID uint64
+)
+
+// Metrics of each SRT link
+var (
+	linkLabels = []string{"stream", "role", "link"}
+
+	srtRoundTripTime = prometheus.NewDesc("ghostream_srt_rtt_milliseconds",
+		"The round-trip time of SRT links in milliseconds", linkLabels, nil)
+	srtBandwidth = prometheus.NewDesc("ghostream_srt_bandwidth_mbps",
+		"The estimated bandwidth of SRT links in Mbit/s", linkLabels, nil)
+	srtBufferLatency = prometheus.NewDesc("ghostream_srt_buffer_latency_milliseconds",
+		"The buffered duration of SRT links in milliseconds", linkLabels, nil)
+	srtPacketsLost = prometheus.NewDesc("ghostream_srt_packets_lost_total",
+		"The total amount of packets lost on SRT links", linkLabels, nil)
+	srtPacketsRetransmitted = prometheus.NewDesc("ghostream_srt_packets_retransmitted_total",
+		"The total amount of packets retransmitted on SRT links", linkLabels, nil)
+	srtPacketsDropped = prometheus.NewDesc("ghostream_srt_packets_dropped_total",
+		"The total amount of packets dropped on SRT links because they were too late", linkLabels, nil)
+)
+
+func init() {
+	prometheus.MustRegister(statsCollector{})
+}
+
+// monitorLink registers a socket for statistics collection.
+// The returned function unregisters it.
+func monitorLink(socket *srtgo.SrtSocket, stream, role, remoteAddr string) func() {
+	linksLock.Lock()
+	nextLinkID++
+	l := &link{
+		id:     strconv.FormatUint(nextLinkID, 10),
+		socket: socket,
+		stats:  LinkStats{Stream: stream, Role: role, RemoteAddr: remoteAddr},
+	}
+	links[l] = struct{}{}
+	linksLock.Unlock()
+	return func() {
+		linksLock.Lock()
+		delete(links, l)
+		linksLock.Unlock()
+	}
+}
+
+// Statistics gives network statistics of SRT links to the web server
+type Statistics struct{}
+
+// Links returns the statistics of SRT sockets of a stream,
+// or of all streams if name is empty.
+func (Statistics) Links(name string) interface{} {
+	linksLock.Lock()
+	defer linksLock.Unlock()
+	result := make([]LinkStats, 0, len(links))
+	for l := range links {
+		if name == "" || l.stats.Stream == name {
+			// Keep last statistics if socket is being closed
+			l.update()
+			result = append(result, l.stats)
+		}
+	}
+	return result
+}
+
+// statsCollector exports metrics of each SRT link, sockets are queried
+// when metrics are collected
+type statsCollector struct{}
+
+// Describe implements prometheus.Collector
+func (statsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- srtRoundTripTime
+	ch <- srtBandwidth
+	ch <- srtBufferLatency
+	ch <- srtPacketsLost
+	ch <- srtPacketsRetransmitted
+	ch <- srtPacketsDropped
+}
+
+// Collect implements prometheus.Collector
+func (statsCollector) Collect(ch chan<- prometheus.Metric) {
+	linksLock.Lock()
+	defer linksLock.Unlock()
+	for l := range links {
+		if !l.update() {
+			continue
+		}
+		labels := []string{l.stats.Stream, l.stats.Role, l.id}
+		gauge := func(desc *prometheus.Desc, v float64) {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, v, labels...)
+		}
+		counter := func(desc *prometheus.Desc, v int) {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(v), labels...)
+		}
+		gauge(srtRoundTripTime, l.stats.RTT)
+		gauge(srtBandwidth, l.stats.Bandwidth)
+		gauge(srtBufferLatency, float64(l.stats.BufferLatency))
+		counter(srtPacketsLost, l.stats.PacketsLost)
+		counter(srtPacketsRetransmitted, l.stats.PacketsRetransmitted)
+		counter(srtPacketsDropped, l.stats.PacketsDropped)
+	}
+}
+
+// update queries socket statistics and returns false on failure.
+// Links lock must be held.
+func (l *link) update() bool {
+	s, err := l.socket.Stats()
+	if err != nil {
+		// Socket is being closed
+		return false
+	}
+	l.stats.RTT = s.MsRTT
+	l.stats.PacketsLost = s.PktRcvLossTotal + s.PktSndLossTotal
+	l.stats.PacketsRetransmitted = s.PktRetransTotal
+	l.stats.PacketsDropped = s.PktRcvDropTotal + s.PktSndDropTotal
+	l.stats.Bandwidth = s.MbpsBandwidth
+	l.stats.BufferLatency = s.MsSndBuf
+	if l.stats.Role == rolePublisher {
+		l.stats.BufferLatency = s.MsRcvBuf
+	}
+	return true
+}
@@ -0,0 +1,109 @@
+// Package srt serves a SRT server
+package srt
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Connection modes of SRT Access Control
+const (
+	modeRequest       = "request"
+	modePublish       = "publish"
+	modeBidirectional = "bidirectional"
+)
+
+// streamID holds the parsed SRTO_STREAMID of a connection.
+//
+// Standard form follows SRT Access Control convention,
+// "#!::r=name,m=publish,u=user,s=session", where session is used as password.
+// Legacy form is "name:password" for publishers and "name" for viewers.
+// Viewers select a quality with "name@quality" or with the "q" key.
+type streamID struct {
+	// Requested stream
+	Resource string
+
+	// Requested quality, for viewers
+	Quality string
+
+	// Connection mode, request for viewers and publish for publishers
+	Mode string
+
+	// User and session credentials, empty if not provided
+	User    string
+	Session string
+}
+
+// parseStreamID parses standard and legacy stream id forms.
+func parseStreamID(s string) (streamID, error) {
+	if !strings.HasPrefix(s, "#!::") {
+		// Legacy form, password may contain ':'
+		split := strings.SplitN(s, ":", 2)
+		if len(split) > 1 {
+			return streamID{Resource: split[0], Mode: modePublish, User: split[0], Session: split[1]}, nil
+		}
+		id := streamID{Resource: s, Mode: modeRequest}
+		id.splitQuality()
+		return id, nil
+	}
+
+	id := streamID{Mode: modeRequest}
+	for _, pair := range strings.Split(s[len("#!::"):], ",") {
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return id, fmt.Errorf("malformed stream id key %q", pair)
+		}
+		key, value := kv[0], kv[1]
+		switch key {
+		case "r":
+			id.Resource = value
+		case "m":
+			id.Mode = value
+		case "u":
+			id.User = value
+		case "s":
+			id.Session = value
+		case "q":
+			id.Quality = value
+		case "t":
+			if value != "stream" {
+				return id, fmt.Errorf("unsupported stream id type %q", value)
+			}
+		}
+		// Other keys, such as host, are ignored
+	}
+
+	if id.Resource == "" {
+		return id, errors.New("stream id has no resource")
+	}
+	switch id.Mode {
+	case modeRequest, modePublish:
+	case modeBidirectional:
+		return id, errors.New("bidirectional mode is not supported")
+	default:
+		return id, fmt.Errorf("unknown stream id mode %q", id.Mode)
+	}
+	if id.Mode == modePublish && id.User == "" {
+		// Publishers are authenticated with stream name by default
+		id.User = id.Resource
+	}
+	if id.Mode == modeRequest && id.Quality == "" {
+		id.splitQuality()
+	}
+	return id, nil
+}
+
+// splitQuality extracts the quality from a "name@quality" resource.
+// Viewers get source quality by default.
+func (id *streamID) splitQuality() {
+	if i := strings.LastIndex(id.Resource, "@"); i >= 0 {
+		id.Resource, id.Quality = id.Resource[:i], id.Resource[i+1:]
+	}
+	if id.Quality == "" {
+		id.Quality = "source"
+	}
+}
@@ -90,9 +90,19 @@ func handleViewer(s net.Conn, streams *messaging.Streams, cfg *Options) {
 	}
 	log.Printf("New Telnet viewer for stream %s quality %s", name, qualityName)
 
+	// Announce stream
+	metadata := stream.Metadata()
+	if metadata.Title != "" {
+		if _, err := s.Write([]byte(metadata.Title + "\n")); err != nil {
+			log.Printf("Error while writing to TCP socket: %s", err)
+			s.Close()
+			return
+		}
+	}
+
 	// Register new client
 	c := make(chan []byte, 128)
-	q.Register(c)
+	q.Register(c, messaging.Policy{Name: "telnet", Mode: messaging.DropOldest})
 	stream.IncrementClientCount()
 
 	// Hide terminal cursor
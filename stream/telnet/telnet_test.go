@@ -9,7 +9,7 @@ import (
 // TestTelnetOutput creates a TCP client that connects to the server and get one image.
 func TestTelnetOutput(t *testing.T) {
 	// Try to start Telnet server while it is disabled
-	streams := messaging.New()
+	streams := messaging.New(&messaging.Options{})
 	go Serve(streams, &Options{Enabled: false})
 
 	// FIXME test connect
@@ -0,0 +1,207 @@
+// Package webrtc provides the backend to simulate a WebRTC client to send stream
+package webrtc
+
+import (
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"gitlab.crans.org/nounous/ghostream/messaging"
+)
+
+// ErrNoCodec is returned when a viewer supports no video codec of the stream
+var ErrNoCodec = errors.New("your browser does not support any video codec of this stream")
+
+// Video codecs sent to viewers by name in media info, with their name in SDP
+var videoCodecs = map[string]string{
+	"h264": webrtc.MimeTypeH264,
+	"vp8":  webrtc.MimeTypeVP8,
+	"vp9":  webrtc.MimeTypeVP9,
+	"av1":  webrtc.MimeTypeAV1,
+}
+
+// newVideoPacketizer returns the packetizer of a video codec, or nil
+func newVideoPacketizer(codec string) *packetizer {
+	var payloader rtp.Payloader
+	switch codec {
+	case "h264":
+		payloader = &codecs.H264Payloader{}
+	case "vp8":
+		payloader = &codecs.VP8Payloader{EnablePictureID: true}
+	case "vp9":
+		payloader = &codecs.VP9Payloader{}
+	case "av1":
+		payloader = &av1Payloader{}
+	default:
+		return nil
+	}
+	return &packetizer{
+		packetizer: rtp.NewPacketizer(rtpMTU, 0, 0, payloader, rtp.NewRandomSequencer(), 90000),
+		clockRate:  90000,
+	}
+}
+
+// selectQuality returns the quality sent to a viewer and its video codec,
+// among those offered by the viewer.
+// Requested quality is preferred, then other qualities are tried in order.
+func selectQuality(stream *messaging.Stream, requested string, offered []webrtc.RTPCodecParameters) (string, *webrtc.RTPCodecParameters, error) {
+	names := []string{requested}
+	for _, name := range stream.Qualities() {
+		if name != requested {
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		q, err := stream.GetQuality(name)
+		if err != nil {
+			continue
+		}
+
+		if c := selectVideoCodec(q.MediaInfo(), offered); c != nil {
+			return name, c, nil
+		}
+	}
+	return "", nil, ErrNoCodec
+}
+
+// selectVideoCodec returns the offered codec able to play the video of a
+// quality, or nil
+func selectVideoCodec(info messaging.MediaInfo, offered []webrtc.RTPCodecParameters) *webrtc.RTPCodecParameters {
+	// Video codec is unknown until the first keyframe, sources are
+	// most likely H.264
+	codec := info.VideoCodec
+	if codec == "" {
+		codec = "h264"
+	}
+	if codec == "h264" {
+		return selectH264(info.VideoProfile, offered)
+	}
+	if mimeType, ok := videoCodecs[codec]; ok {
+		return selectCodec(mimeType, offered)
+	}
+	return nil
+}
+
+// selectH264 returns the first offered H.264 codec able to fragment frames
+// and to decode the profile of the source, or nil.
+// Profile is not checked if it is not known yet.
+func selectH264(profile string, offered []webrtc.RTPCodecParameters) *webrtc.RTPCodecParameters {
+	for i, c := range offered {
+		if !strings.EqualFold(c.MimeType, webrtc.MimeTypeH264) {
+			continue
+		}
+		params := fmtpParameters(c.SDPFmtpLine)
+		if params["packetization-mode"] != "1" {
+			continue
+		}
+		if profile == "" || decodesProfile(params["profile-level-id"], profile) {
+			return &offered[i]
+		}
+	}
+	return nil
+}
+
+// decodesProfile tells if a decoder of the offered H.264 profile-level-id
+// decodes a source of another profile-level-id. Levels are not negotiated.
+// Constrained baseline is a subset of baseline, main and high profiles,
+// main is a subset of high.
+func decodesProfile(offered, source string) bool {
+	if offered == "" {
+		// Default of RFC 6184 is baseline
+		offered = "42000a"
+	}
+	o, err := hex.DecodeString(offered)
+	if err != nil || len(o) != 3 {
+		return false
+	}
+	s, err := hex.DecodeString(source)
+	if err != nil || len(s) != 3 {
+		return false
+	}
+	constrainedBaseline := func(b []byte) bool {
+		return b[0] == 66 && b[1]&0x40 != 0 || b[0] == 77 && b[1]&0x80 != 0
+	}
+	switch {
+	case o[0] == 66 && constrainedBaseline(o):
+		return constrainedBaseline(s)
+	case o[0] == 66:
+		return s[0] == 66 || constrainedBaseline(s)
+	case o[0] == 77:
+		return s[0] == 77 || constrainedBaseline(s)
+	case o[0] == 100:
+		return s[0] == 100 || s[0] == 77 || constrainedBaseline(s)
+	}
+	return o[0] == s[0]
+}
+
+// selectCodec returns the first offered codec with this MIME type, or nil
+func selectCodec(mimeType string, offered []webrtc.RTPCodecParameters) *webrtc.RTPCodecParameters {
+	for i, c := range offered {
+		if strings.EqualFold(c.MimeType, mimeType) {
+			return &offered[i]
+		}
+	}
+	return nil
+}
+
+// fmtpParameters returns the parameters of a format line
+func fmtpParameters(line string) map[string]string {
+	params := make(map[string]string)
+	for _, param := range strings.Split(line, ";") {
+		split := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(split) == 2 {
+			params[strings.ToLower(split[0])] = split[1]
+		}
+	}
+	return params
+}
+
+// offeredCodecs returns the codecs of the first media of a kind in a
+// session description, with the payload types chosen by the peer
+func offeredCodecs(desc SessionDescription, kind webrtc.RTPCodecType) ([]webrtc.RTPCodecParameters, error) {
+	parsed, err := desc.Unmarshal()
+	if err != nil {
+		return nil, err
+	}
+	offered := []webrtc.RTPCodecParameters{}
+	for _, media := range parsed.MediaDescriptions {
+		if media.MediaName.Media != kind.String() {
+			continue
+		}
+		for _, format := range media.MediaName.Formats {
+			payloadType, err := strconv.ParseUint(format, 10, 8)
+			if err != nil {
+				continue
+			}
+			codec, err := parsed.GetCodecForPayloadType(uint8(payloadType))
+			if err != nil {
+				continue
+			}
+			channels, _ := strconv.ParseUint(codec.EncodingParameters, 10, 16)
+			feedback := []webrtc.RTCPFeedback{}
+			for _, fb := range codec.RTCPFeedback {
+				split := strings.SplitN(fb, " ", 2)
+				if len(split) == 1 {
+					split = append(split, "")
+				}
+				feedback = append(feedback, webrtc.RTCPFeedback{Type: split[0], Parameter: split[1]})
+			}
+			offered = append(offered, webrtc.RTPCodecParameters{
+				RTPCodecCapability: webrtc.RTPCodecCapability{
+					MimeType:     kind.String() + "/" + codec.Name,
+					ClockRate:    codec.ClockRate,
+					Channels:     uint16(channels),
+					SDPFmtpLine:  codec.Fmtp,
+					RTCPFeedback: feedback,
+				},
+				PayloadType: webrtc.PayloadType(payloadType),
+			})
+		}
+		break
+	}
+	return offered, nil
+}
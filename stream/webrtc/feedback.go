@@ -0,0 +1,120 @@
+// Package webrtc provides the backend to simulate a WebRTC client to send stream
+package webrtc
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"gitlab.crans.org/nounous/ghostream/internal/monitoring"
+)
+
+// Maximum number of video packets kept since last keyframe,
+// larger groups of pictures are not sent again
+const maxGOPPackets = 4096
+
+// Minimum time between two sendings of the group of pictures to a viewer
+const replayInterval = time.Second
+
+// Sessions are numbered in metrics, their identifier must stay secret
+var sessionCount uint64
+
+func nextSessionNumber() string {
+	return strconv.FormatUint(atomic.AddUint64(&sessionCount, 1), 10)
+}
+
+// readRTCP handles the RTCP feedback of a viewer about a track until the
+// session ends. Keyframe requests of source quality are forwarded to WHIP
+// publishers, others are answered by ingest on next frame. Lost packets are
+// sent again by the NACK responder of the peer connection.
+func (s *viewerSession) readRTCP(sender *webrtc.RTPSender, media string, clockRate uint32) {
+	ssrc := uint32(sender.GetParameters().Encodings[0].SSRC)
+	buff := make([]byte, 1500)
+	for {
+		n, _, err := sender.Read(buff)
+		if err != nil {
+			// Peer connection is closed
+			break
+		}
+		packets, err := rtcp.Unmarshal(buff[:n])
+		if err != nil {
+			continue
+		}
+		for _, packet := range packets {
+			switch p := packet.(type) {
+			case *rtcp.PictureLossIndication:
+				monitoring.WebRTCFeedback.WithLabelValues(s.stream, "pli").Inc()
+				s.requestKeyframe()
+			case *rtcp.FullIntraRequest:
+				monitoring.WebRTCFeedback.WithLabelValues(s.stream, "fir").Inc()
+				s.requestKeyframe()
+			case *rtcp.TransportLayerNack:
+				monitoring.WebRTCFeedback.WithLabelValues(s.stream, "nack").Inc()
+			case *rtcp.ReceiverReport:
+				for _, r := range p.Reports {
+					if r.SSRC != ssrc {
+						continue
+					}
+					monitoring.WebRTCFractionLost.WithLabelValues(s.stream, s.number, media).Set(float64(r.FractionLost) / 256)
+					monitoring.WebRTCJitter.WithLabelValues(s.stream, s.number, media).Set(float64(r.Jitter) / float64(clockRate))
+				}
+			}
+		}
+	}
+	monitoring.WebRTCFractionLost.DeleteLabelValues(s.stream, s.number, media)
+	monitoring.WebRTCJitter.DeleteLabelValues(s.stream, s.number, media)
+}
+
+// requestKeyframe asks the publisher for a keyframe if possible,
+// otherwise packets since last keyframe are sent again
+func (s *viewerSession) requestKeyframe() {
+	if s.quality == "source" && requestPublisherKeyframe(s.stream) {
+		return
+	}
+	atomic.StoreInt32(&s.keyframeRequested, 1)
+}
+
+// writeVideo sends video packets to the session. If a keyframe was
+// requested, packets since last keyframe are sent again before, at most
+// once per replayInterval. Until then, the request waits for next keyframe.
+func (s *viewerSession) writeVideo(packets, gop []*rtp.Packet) error {
+	if len(gop) == 0 {
+		// Packets start a keyframe, or there is nothing to send again
+		atomic.StoreInt32(&s.keyframeRequested, 0)
+	} else if time.Since(s.lastReplay) >= replayInterval && atomic.CompareAndSwapInt32(&s.keyframeRequested, 1, 0) {
+		s.lastReplay = time.Now()
+		if err := s.writeVideoPackets(gop, true); err != nil {
+			return err
+		}
+	}
+	return s.writeVideoPackets(packets, false)
+}
+
+// writeVideoPackets sends copies of packets with sequence numbers counting
+// packets sent again. Timestamps are shifted so that they do not go
+// backwards: frames sent again start one tick after the last frame sent and
+// keep their spacing, following frames are delayed as much.
+func (s *viewerSession) writeVideoPackets(packets []*rtp.Packet, again bool) error {
+	for i, packet := range packets {
+		if !s.videoStarted || packet.Timestamp != s.videoSource || again && i == 0 {
+			// First packet of a frame
+			timestamp := packet.Timestamp + s.videoOffset
+			if s.videoStarted && int32(timestamp-s.videoTimestamp) <= 0 {
+				s.videoOffset += s.videoTimestamp + 1 - timestamp
+				timestamp = s.videoTimestamp + 1
+			}
+			s.videoSource, s.videoTimestamp, s.videoStarted = packet.Timestamp, timestamp, true
+		}
+		p := *packet
+		p.Timestamp = s.videoTimestamp
+		p.SequenceNumber = s.videoSequence
+		s.videoSequence++
+		if err := s.videoTrack.WriteRTP(&p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -3,162 +3,194 @@ package webrtc
 
 import (
 	"bufio"
-	"fmt"
+	"io"
 	"log"
-	"math/rand"
-	"net"
 	"os/exec"
 
 	"github.com/pion/rtp"
-	"github.com/pion/webrtc/v3"
+	"gitlab.crans.org/nounous/ghostream/internal/demux"
 	"gitlab.crans.org/nounous/ghostream/messaging"
 )
 
-func ingest(name string, q *messaging.Quality) {
+// ingest sends a quality to its viewers.
+// Video and Opus audio are packetized as is,
+// other audio codecs are transcoded to Opus by ffmpeg.
+func ingest(name, quality string, q *messaging.Quality) {
 	// Register to get stream
-	videoInput := make(chan []byte, 1024)
-	q.Register(videoInput)
-
-	// FIXME Mux into RTP without having multiple UDP listeners
-	firstPort := int(rand.Int31n(63535)) + 2000
-
-	// Open UDP listeners for RTP Packets
-	audioListener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: firstPort})
-	if err != nil {
-		log.Printf("Faited to open UDP listener %s", err)
-		return
-	}
-	videoListener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: firstPort + 1})
-	if err != nil {
-		log.Printf("Faited to open UDP listener %s", err)
-		return
-	}
-
-	// Start ffmpag to convert videoInput to video and audio UDP
-	ffmpeg, err := startFFmpeg(videoInput, firstPort)
-	if err != nil {
-		log.Printf("Error while starting ffmpeg: %s", err)
-		return
-	}
-
-	// Receive video
-	go func() {
-		inboundRTPPacket := make([]byte, 1500) // UDP MTU
-		for {
-			n, _, err := videoListener.ReadFromUDP(inboundRTPPacket)
-			if err != nil {
-				log.Printf("Failed to read from UDP: %s", err)
-				break
-			}
-			packet := &rtp.Packet{}
-			if err := packet.Unmarshal(inboundRTPPacket[:n]); err != nil {
-				log.Printf("Failed to unmarshal RTP srtPacket: %s", err)
-				continue
-			}
-
-			if videoTracks[name] == nil {
-				videoTracks[name] = make([]*webrtc.Track, 0)
-			}
-
-			// Write RTP srtPacket to all video tracks
-			// Adapt payload and SSRC to match destination
-			for _, videoTrack := range videoTracks[name] {
-				packet.Header.PayloadType = videoTrack.PayloadType()
-				packet.Header.SSRC = videoTrack.SSRC()
-				if writeErr := videoTrack.WriteRTP(packet); writeErr != nil {
-					log.Printf("Failed to write to video track: %s", err)
+	input := make(chan []byte, 1024)
+	q.Register(input, messaging.Policy{Name: "webrtc", Mode: messaging.DropUntilKeyframe})
+
+	demuxer := demux.New()
+	var video *packetizer
+	audio := newOpusPacketizer()
+
+	// Video packets since last keyframe, for viewers requesting a keyframe.
+	// They are kept from a keyframe until they are too many.
+	var gop []*rtp.Packet
+	keepGOP := false
+	var transcoder *opusTranscoder
+	videoUnsupported, transcodeFailed := false, false
+	for data := range input {
+		for _, f := range demuxer.Write(data) {
+			switch {
+			case f.IsVideo():
+				if video == nil && !videoUnsupported {
+					if video = newVideoPacketizer(f.Codec); video == nil {
+						log.Printf("WebRTC can not send %s video of stream %s quality %s", f.Codec, name, quality)
+						videoUnsupported = true
+					}
+				}
+				if video == nil {
 					continue
 				}
+				packets := video.packetize(f)
+				if f.Keyframe {
+					gop, keepGOP = nil, true
+				}
+				writeRTP(name, quality, packets, gop, true)
+				if !keepGOP {
+					continue
+				}
+				if len(gop)+len(packets) > maxGOPPackets {
+					gop, keepGOP = nil, false
+				} else {
+					gop = append(gop, packets...)
+				}
+			case f.Codec == "opus":
+				writeRTP(name, quality, audio.packetize(f), nil, false)
+			case transcoder == nil && !transcodeFailed:
+				// Start transcoding on first audio frame in another codec
+				var err error
+				if transcoder, err = startTranscoder(name, quality); err != nil {
+					log.Printf("Failed to start audio transcoding for stream %s: %s", name, err)
+					transcodeFailed = true
+				}
 			}
 		}
-	}()
+		if transcoder != nil {
+			transcoder.write(data)
+		}
+	}
 
-	// Receive audio
-	go func() {
-		inboundRTPPacket := make([]byte, 1500) // UDP MTU
-		for {
-			n, _, err := audioListener.ReadFromUDP(inboundRTPPacket)
-			if err != nil {
-				log.Printf("Failed to read from UDP: %s", err)
-				break
-			}
-			packet := &rtp.Packet{}
-			if err := packet.Unmarshal(inboundRTPPacket[:n]); err != nil {
-				log.Printf("Failed to unmarshal RTP srtPacket: %s", err)
-				continue
-			}
+	// End of stream
+	if transcoder != nil {
+		transcoder.close()
+	}
+}
 
-			if audioTracks[name] == nil {
-				audioTracks[name] = make([]*webrtc.Track, 0)
+// writeRTP sends packets to the video or audio track of each viewer of
+// a quality. Tracks set the payload type and SSRC of each destination.
+// Video packets sent since last keyframe are given in gop, they are sent
+// again to viewers requesting a keyframe.
+func writeRTP(name, quality string, packets, gop []*rtp.Packet, video bool) {
+	viewers.forEach(name, func(s *viewerSession) {
+		if s.quality != quality {
+			return
+		}
+		if video {
+			if err := s.writeVideo(packets, gop); err != nil {
+				log.Printf("Failed to write to track: %s", err)
 			}
-
-			// Write RTP srtPacket to all audio tracks
-			// Adapt payload and SSRC to match destination
-			for _, audioTrack := range audioTracks[name] {
-				packet.Header.PayloadType = audioTrack.PayloadType()
-				packet.Header.SSRC = audioTrack.SSRC()
-				if writeErr := audioTrack.WriteRTP(packet); writeErr != nil {
-					log.Printf("Failed to write to audio track: %s", err)
-					continue
-				}
+			return
+		}
+		if s.audioTrack == nil {
+			return
+		}
+		for _, packet := range packets {
+			if err := s.audioTrack.WriteRTP(packet); err != nil {
+				log.Printf("Failed to write to track: %s", err)
+				return
 			}
 		}
-	}()
-
-	// Wait for stopped ffmpeg
-	if err = ffmpeg.Wait(); err != nil {
-		log.Printf("Faited to wait for ffmpeg: %s", err)
-	}
+	})
+}
 
-	// Close UDP listeners
-	if err = videoListener.Close(); err != nil {
-		log.Printf("Faited to close UDP listener: %s", err)
-	}
-	if err = audioListener.Close(); err != nil {
-		log.Printf("Faited to close UDP listener: %s", err)
-	}
-	q.Unregister(videoInput)
+// opusTranscoder converts audio of a stream to Opus using ffmpeg,
+// Opus is read back in MPEG-TS from its output.
+type opusTranscoder struct {
+	input chan []byte
 }
 
-func startFFmpeg(in <-chan []byte, listeningPort int) (ffmpeg *exec.Cmd, err error) {
-	ffmpegArgs := []string{"-hide_banner", "-loglevel", "error", "-i", "pipe:0",
-		// Audio
+func startTranscoder(name, quality string) (*opusTranscoder, error) {
+	ffmpeg := exec.Command("ffmpeg", "-hide_banner", "-loglevel", "error",
+		"-i", "pipe:0", "-copyts",
 		"-vn", "-c:a", "libopus", "-b:a", "96k",
-		"-f", "rtp", fmt.Sprintf("rtp://127.0.0.1:%d", listeningPort),
-		// Source
-		"-an", "-c:v", "copy",
-		"-f", "rtp", fmt.Sprintf("rtp://127.0.0.1:%d", listeningPort+1)}
-	ffmpeg = exec.Command("ffmpeg", ffmpegArgs...)
-
-	// Handle errors output
-	errOutput, err := ffmpeg.StderrPipe()
+		"-f", "mpegts", "-muxdelay", "0", "-flush_packets", "1", "pipe:1")
+	stdin, err := ffmpeg.StdinPipe()
 	if err != nil {
 		return nil, err
 	}
+	stdout, err := ffmpeg.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := ffmpeg.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := ffmpeg.Start(); err != nil {
+		return nil, err
+	}
+	t := &opusTranscoder{input: make(chan []byte, 1024)}
+
+	// Handle errors output
 	go func() {
-		scanner := bufio.NewScanner(errOutput)
+		scanner := bufio.NewScanner(stderr)
 		for scanner.Scan() {
-			log.Printf("[WEBRTC FFMPEG %s] %s", "demo", scanner.Text())
+			log.Printf("[WEBRTC FFMPEG %s] %s", name, scanner.Text())
 		}
 	}()
 
 	// Handle stream input
-	input, err := ffmpeg.StdinPipe()
-	if err != nil {
-		return nil, err
-	}
 	go func() {
-		for data := range in {
-			if _, err := input.Write(data); err != nil {
+		for data := range t.input {
+			if _, err := stdin.Write(data); err != nil {
 				log.Printf("Failed to write data to ffmpeg input: %s", err)
+				break
 			}
 		}
+		_ = stdin.Close()
+		for range t.input {
+			// Drain input until closed
+		}
+	}()
 
-		// End of stream
-		ffmpeg.Process.Kill()
+	// Send transcoded audio
+	go func() {
+		demuxer := demux.New()
+		audio := newOpusPacketizer()
+		buff := make([]byte, 188*7)
+		for {
+			n, err := stdout.Read(buff)
+			for _, f := range demuxer.Write(buff[:n]) {
+				if f.Codec == "opus" {
+					writeRTP(name, quality, audio.packetize(f), nil, false)
+				}
+			}
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				log.Printf("Failed to read ffmpeg output: %s", err)
+				break
+			}
+		}
+		if err := ffmpeg.Wait(); err != nil {
+			log.Printf("Failed to wait for ffmpeg: %s", err)
+		}
 	}()
+	return t, nil
+}
+
+// write sends stream data to ffmpeg, data is dropped if ffmpeg is too slow
+func (t *opusTranscoder) write(data []byte) {
+	select {
+	case t.input <- data:
+	default:
+		log.Printf("Audio transcoding is too slow, dropping data")
+	}
+}
 
-	// Start process
-	err = ffmpeg.Start()
-	return ffmpeg, err
+// close ends the input of ffmpeg, then it stops
+func (t *opusTranscoder) close() {
+	close(t.input)
 }
@@ -0,0 +1,99 @@
+// Package webrtc provides the backend to simulate a WebRTC client to send stream
+package webrtc
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+// ErrNoNetwork is returned when both UDP and ICE over TCP are disabled
+var ErrNoNetwork = errors.New("ICE over TCP must be enabled when UDP is disabled")
+
+var (
+	// ICE over UDP socket shared by all sessions
+	udpMux     *ice.UDPMuxDefault
+	udpMuxErr  error
+	udpMuxOnce sync.Once
+
+	// ICE over TCP listener shared by all sessions
+	tcpMux     *ice.TCPMuxDefault
+	tcpMuxErr  error
+	tcpMuxOnce sync.Once
+)
+
+// getUDPMux returns the ICE over UDP socket, it is opened on first call
+func getUDPMux(address string) (*ice.UDPMuxDefault, error) {
+	udpMuxOnce.Do(func() {
+		var conn net.PacketConn
+		if conn, udpMuxErr = net.ListenPacket("udp", address); udpMuxErr != nil {
+			return
+		}
+		udpMux = ice.NewUDPMuxDefault(ice.UDPMuxParams{UDPConn: conn})
+	})
+	return udpMux, udpMuxErr
+}
+
+// getTCPMux returns the ICE over TCP listener, it is opened on first call
+func getTCPMux(address string) (*ice.TCPMuxDefault, error) {
+	tcpMuxOnce.Do(func() {
+		var listener net.Listener
+		if listener, tcpMuxErr = net.Listen("tcp", address); tcpMuxErr != nil {
+			return
+		}
+		tcpMux = ice.NewTCPMuxDefault(ice.TCPMuxParams{Listener: listener, ReadBufferSize: 8})
+	})
+	return tcpMux, tcpMuxErr
+}
+
+// newSettingEngine configures the network used by a new peer connection
+func newSettingEngine(cfg *Options) (webrtc.SettingEngine, error) {
+	settingsEngine := webrtc.SettingEngine{}
+	networkTypes := []webrtc.NetworkType{}
+	if !cfg.ICETCPOnly {
+		// Candidates from STUN servers still use the port range
+		if err := settingsEngine.SetEphemeralUDPPortRange(cfg.MinPortUDP, cfg.MaxPortUDP); err != nil {
+			return settingsEngine, fmt.Errorf("failed to set min/max UDP ports, %s", err)
+		}
+		if cfg.ICEUDPListenAddress != "" {
+			mux, err := getUDPMux(cfg.ICEUDPListenAddress)
+			if err != nil {
+				return settingsEngine, fmt.Errorf("failed to listen for ICE over UDP, %s", err)
+			}
+			settingsEngine.SetICEUDPMux(mux)
+		}
+		networkTypes = append(networkTypes, webrtc.NetworkTypeUDP4, webrtc.NetworkTypeUDP6)
+	}
+	if cfg.ICETCPListenAddress != "" {
+		mux, err := getTCPMux(cfg.ICETCPListenAddress)
+		if err != nil {
+			return settingsEngine, fmt.Errorf("failed to listen for ICE over TCP, %s", err)
+		}
+		settingsEngine.SetICETCPMux(mux)
+		networkTypes = append(networkTypes, webrtc.NetworkTypeTCP4, webrtc.NetworkTypeTCP6)
+	}
+	if len(networkTypes) == 0 {
+		return settingsEngine, ErrNoNetwork
+	}
+	settingsEngine.SetNetworkTypes(networkTypes)
+
+	// Behind NAT 1:1, public addresses replace local ones in host candidates
+	if len(cfg.NAT1To1IPs) > 0 {
+		settingsEngine.SetNAT1To1IPs(cfg.NAT1To1IPs, webrtc.ICECandidateTypeHost)
+	}
+	if len(cfg.Interfaces) > 0 {
+		settingsEngine.SetInterfaceFilter(func(name string) bool {
+			for _, i := range cfg.Interfaces {
+				if i == name {
+					return true
+				}
+			}
+			return false
+		})
+	}
+	return settingsEngine, nil
+}
@@ -0,0 +1,91 @@
+// Package webrtc provides the backend to simulate a WebRTC client to send stream
+package webrtc
+
+import (
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/rtp/pkg/obu"
+	"gitlab.crans.org/nounous/ghostream/internal/demux"
+)
+
+// AV1 OBU header fields
+const (
+	obuTypeTemporalDelimiter = 2
+	obuExtensionFlag         = 0x04
+	obuHasSizeField          = 0x02
+)
+
+// Maximum size of RTP packets, to fit in UDP with SRTP overhead
+const rtpMTU = 1200
+
+// packetizer splits frames of one codec in RTP packets.
+// Payload type and SSRC are set for each viewer track.
+type packetizer struct {
+	packetizer rtp.Packetizer
+	clockRate  int64
+}
+
+func newOpusPacketizer() *packetizer {
+	return &packetizer{
+		packetizer: rtp.NewPacketizer(rtpMTU, 0, 0, &codecs.OpusPayloader{}, rtp.NewRandomSequencer(), 48000),
+		clockRate:  48000,
+	}
+}
+
+// packetize returns the RTP packets of a frame, timestamped from its PTS
+func (p *packetizer) packetize(f demux.Frame) []*rtp.Packet {
+	packets := p.packetizer.Packetize(f.Data, 0)
+	timestamp := uint32(f.PTS * p.clockRate / 90000)
+	for _, packet := range packets {
+		packet.Timestamp = timestamp
+	}
+	return packets
+}
+
+// av1Payloader sends each OBU of a temporal unit in its own packets, as the
+// payloader of the RTP library takes a single OBU
+type av1Payloader struct {
+	codecs.AV1Payloader
+}
+
+func (p *av1Payloader) Payload(mtu uint16, payload []byte) [][]byte {
+	var payloads [][]byte
+	for _, o := range splitOBUs(payload) {
+		payloads = append(payloads, p.AV1Payloader.Payload(mtu, o)...)
+	}
+	return payloads
+}
+
+// splitOBUs returns the OBUs of a temporal unit without their size field,
+// as RTP recommends. Temporal delimiters are removed.
+func splitOBUs(data []byte) [][]byte {
+	var obus [][]byte
+	for len(data) > 0 {
+		header := 1
+		if data[0]&obuExtensionFlag != 0 {
+			header = 2
+		}
+		if len(data) < header {
+			break
+		}
+		size := len(data) - header
+		sizeLength := 0
+		if data[0]&obuHasSizeField != 0 {
+			value, n, err := obu.ReadLeb128(data[header:])
+			if err != nil || int(value) > len(data)-header-int(n) {
+				// Truncated OBU
+				break
+			}
+			size, sizeLength = int(value), int(n)
+		}
+		if (data[0]>>3)&0x0f != obuTypeTemporalDelimiter {
+			o := make([]byte, 0, header+size)
+			o = append(o, data[0]&^obuHasSizeField)
+			o = append(o, data[1:header]...)
+			o = append(o, data[header+sizeLength:header+sizeLength+size]...)
+			obus = append(obus, o)
+		}
+		data = data[header+sizeLength+size:]
+	}
+	return obus
+}
@@ -0,0 +1,70 @@
+// Package webrtc provides the backend to simulate a WebRTC client to send stream
+package webrtc
+
+import (
+	"sync"
+
+	"gitlab.crans.org/nounous/ghostream/internal/monitoring"
+)
+
+// registry holds connected viewer sessions of each stream
+type registry struct {
+	lock     sync.RWMutex
+	sessions map[string]map[*viewerSession]struct{}
+}
+
+// Connected viewers, ingest sends them the stream
+var viewers = newRegistry()
+
+func newRegistry() *registry {
+	return &registry{sessions: make(map[string]map[*viewerSession]struct{})}
+}
+
+// add registers a connected session of a stream.
+// It returns false if the session was already registered.
+func (r *registry) add(stream string, s *viewerSession) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.sessions[stream][s]; ok {
+		return false
+	}
+	if r.sessions[stream] == nil {
+		r.sessions[stream] = make(map[*viewerSession]struct{})
+	}
+	r.sessions[stream][s] = struct{}{}
+	monitoring.WebRTCConnectedSessions.Inc()
+	return true
+}
+
+// remove unregisters a session of a stream.
+// It returns false if the session was not registered.
+func (r *registry) remove(stream string, s *viewerSession) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.sessions[stream][s]; !ok {
+		return false
+	}
+	delete(r.sessions[stream], s)
+	if len(r.sessions[stream]) == 0 {
+		delete(r.sessions, stream)
+	}
+	monitoring.WebRTCConnectedSessions.Dec()
+	return true
+}
+
+// count returns the number of connected sessions of a stream
+func (r *registry) count(stream string) int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return len(r.sessions[stream])
+}
+
+// forEach calls f with each connected session of a stream.
+// Sessions can not be added or removed until f returns, so it must not block.
+func (r *registry) forEach(stream string, f func(*viewerSession)) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	for s := range r.sessions[stream] {
+		f(s)
+	}
+}
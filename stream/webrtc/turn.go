@@ -0,0 +1,261 @@
+// Package webrtc provides the backend to simulate a WebRTC client to send stream
+package webrtc
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/turn/v2"
+)
+
+// Realm of the embedded TURN server
+const turnRealm = "ghostream"
+
+// Clients which stop refreshing their permissions for this time are forgotten,
+// permissions last 5 minutes without refresh
+const turnAllocationTimeout = 15 * time.Minute
+
+var (
+	// Address of the running TURN server, advertised to viewers
+	turnAddress string
+
+	// Last permission request of each client by address, such requests
+	// are authenticated. Clients keep using their credentials after
+	// expiration to refresh their allocation and permissions.
+	turnClients = make(map[string]time.Time)
+
+	turnLock sync.Mutex
+)
+
+// Secret signing TURN credentials, generated on startup
+var turnSecret = func() []byte {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return secret
+}()
+
+// ICEServer is a STUN or TURN server given to viewers
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// ICEServers returns the servers a new viewer should use.
+// TURN is given if the embedded server runs, credentials must be used
+// within TURNCredentialTTL.
+func ICEServers(cfg *Options) []ICEServer {
+	servers := []ICEServer{}
+	if len(cfg.STUNServers) > 0 {
+		servers = append(servers, ICEServer{URLs: cfg.STUNServers})
+	}
+	turnLock.Lock()
+	address := turnAddress
+	turnLock.Unlock()
+	if address == "" {
+		return servers
+	}
+
+	// Credentials follow the TURN REST API, username is
+	// "<expiration timestamp>:<session identifier>"
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		log.Printf("Failed to generate TURN credentials: %s", err)
+		return servers
+	}
+	expiration := time.Now().Add(cfg.TURNCredentialTTL).Unix()
+	username := fmt.Sprintf("%d:%s", expiration, hex.EncodeToString(id))
+	return append(servers, ICEServer{
+		URLs:       []string{"turn:" + address + "?transport=udp"},
+		Username:   username,
+		Credential: turnPassword(username),
+	})
+}
+
+// turnPassword returns the password of a TURN username
+func turnPassword(username string) string {
+	mac := hmac.New(sha1.New, turnSecret)
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// turnAuth accepts usernames given by ICEServers until they expire,
+// active clients keep refreshing their allocation.
+// It keeps no state, the request is not authenticated yet.
+func turnAuth(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+	split := strings.SplitN(username, ":", 2)
+	expiration, err := strconv.ParseInt(split[0], 10, 64)
+	if err != nil || len(split) != 2 {
+		log.Printf("Rejected TURN credentials from %s", srcAddr)
+		return nil, false
+	}
+
+	now := time.Now()
+	if now.Unix() > expiration {
+		turnLock.Lock()
+		seen, ok := turnClients[srcAddr.String()]
+		turnLock.Unlock()
+		if !ok || now.Sub(seen) > turnAllocationTimeout {
+			log.Printf("Rejected expired TURN credentials from %s", srcAddr)
+			return nil, false
+		}
+	}
+	return turn.GenerateAuthKey(username, realm, turnPassword(username)), true
+}
+
+// turnPermission is called on authenticated permission and channel
+// requests, it records the client as active
+func turnPermission(clientAddr net.Addr, peerIP net.IP) bool {
+	turnLock.Lock()
+	turnClients[clientAddr.String()] = time.Now()
+	turnLock.Unlock()
+	return true
+}
+
+// pruneTURNClients forgets clients which stopped refreshing their permissions
+func pruneTURNClients() {
+	for now := range time.Tick(turnAllocationTimeout) {
+		turnLock.Lock()
+		for c, seen := range turnClients {
+			if now.Sub(seen) > turnAllocationTimeout {
+				delete(turnClients, c)
+			}
+		}
+		turnLock.Unlock()
+	}
+}
+
+// relayAddressGenerator allocates relays which only reach the media
+// ports of this server, so the TURN server is not an open relay
+type relayAddressGenerator struct {
+	*turn.RelayAddressGeneratorStatic
+	allowed func(addr net.Addr) bool
+}
+
+func (g *relayAddressGenerator) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	conn, addr, err := g.RelayAddressGeneratorStatic.AllocatePacketConn(network, requestedPort)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &relayConn{PacketConn: conn, allowed: g.allowed}, addr, nil
+}
+
+// relayConn drops packets to and from peers which are not allowed
+type relayConn struct {
+	net.PacketConn
+	allowed func(addr net.Addr) bool
+}
+
+func (c *relayConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil || c.allowed(addr) {
+			return n, addr, err
+		}
+	}
+}
+
+func (c *relayConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if !c.allowed(addr) {
+		// Silently dropped, as UDP would
+		return len(p), nil
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+// mediaPeers returns a function telling if an address is a WebRTC media
+// port of this server
+func mediaPeers(cfg *Options) (func(addr net.Addr) bool, error) {
+	ips := []net.IP{net.ParseIP(cfg.TURNRelayIP)}
+	for _, ip := range cfg.NAT1To1IPs {
+		ips = append(ips, net.ParseIP(ip))
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	muxPort := -1
+	if cfg.ICEUDPListenAddress != "" {
+		_, port, err := net.SplitHostPort(cfg.ICEUDPListenAddress)
+		if err != nil {
+			return nil, err
+		}
+		if muxPort, err = net.LookupPort("udp", port); err != nil {
+			return nil, err
+		}
+	}
+	return func(addr net.Addr) bool {
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			return false
+		}
+		if udpAddr.Port != muxPort && (udpAddr.Port < int(cfg.MinPortUDP) || udpAddr.Port > int(cfg.MaxPortUDP)) {
+			return false
+		}
+		for _, ip := range ips {
+			if ip.Equal(udpAddr.IP) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// serveTURN runs the embedded TURN server
+func serveTURN(cfg *Options) (*turn.Server, error) {
+	relayIP := net.ParseIP(cfg.TURNRelayIP)
+	if relayIP == nil {
+		return nil, fmt.Errorf("invalid TURN relay IP address '%s'", cfg.TURNRelayIP)
+	}
+	allowed, err := mediaPeers(cfg)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenPacket("udp4", cfg.TURNListenAddress)
+	if err != nil {
+		return nil, err
+	}
+	_, port, _ := net.SplitHostPort(conn.LocalAddr().String())
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm:       turnRealm,
+		AuthHandler: turnAuth,
+		PacketConnConfigs: []turn.PacketConnConfig{{
+			PacketConn:        conn,
+			PermissionHandler: turnPermission,
+			RelayAddressGenerator: &relayAddressGenerator{
+				RelayAddressGeneratorStatic: &turn.RelayAddressGeneratorStatic{
+					RelayAddress: relayIP,
+					Address:      "0.0.0.0",
+				},
+				allowed: allowed,
+			},
+		}},
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	turnLock.Lock()
+	turnAddress = net.JoinHostPort(cfg.TURNRelayIP, port)
+	turnLock.Unlock()
+	go pruneTURNClients()
+	log.Printf("TURN server listening on %s", cfg.TURNListenAddress)
+	return server, nil
+}
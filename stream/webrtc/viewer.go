@@ -0,0 +1,291 @@
+// Package webrtc provides the backend to simulate a WebRTC client to send stream
+package webrtc
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"gitlab.crans.org/nounous/ghostream/messaging"
+)
+
+// ICECandidateInit is an ICE candidate exchanged with a viewer
+type ICECandidateInit = webrtc.ICECandidateInit
+
+// Time to wait for local candidates before answering viewers not
+// receiving candidates progressively
+const gatherTimeout = 500 * time.Millisecond
+
+// Time for a viewer to connect after the answer, the session ends otherwise
+const connectTimeout = 30 * time.Second
+
+var (
+	// Viewer sessions by identifier
+	viewerSessions = make(map[string]*viewerSession)
+	viewerLock     sync.Mutex
+)
+
+// viewerSession sends a stream to a viewer using websocket or WHEP
+type viewerSession struct {
+	id   string
+	name string
+
+	// Name is "stream" or "stream@quality"
+	stream  string
+	quality string
+
+	// Media identifier used in candidates
+	mid string
+
+	lock   sync.Mutex
+	pc     *webrtc.PeerConnection
+	closed bool
+
+	// Tracks sending the stream, set during negotiation
+	videoTrack *webrtc.TrackLocalStaticRTP
+	audioTrack *webrtc.TrackLocalStaticRTP
+
+	// Sequence number of next video packet, source and sent timestamps
+	// of last video frame, offset added to source timestamps and time of
+	// last frames sent again, written by ingest only
+	videoSequence  uint16
+	videoSource    uint32
+	videoTimestamp uint32
+	videoOffset    uint32
+	videoStarted   bool
+	lastReplay     time.Time
+
+	// Set to 1 when viewer requests a keyframe, it is read atomically
+	keyframeRequested int32
+
+	// Number of session in metrics
+	number string
+
+	// Local candidates, those not yet sent are returned by AddCandidates
+	candidates []ICECandidateInit
+	sent       int
+	gathered   chan struct{}
+	endSent    bool
+}
+
+// Play starts a session for a viewer of a stream from its offer.
+// It returns the answer and the identifier of the session.
+// If the viewer does not support the video codec of the requested quality,
+// another quality is sent, ErrNoCodec is returned if there is none.
+// Local ICE candidates are given to onCandidate as they are gathered,
+// then nil once gathering is complete.
+// If onCandidate is nil, the answer contains candidates gathered within
+// a short time and others are returned by AddCandidates.
+func Play(streams *messaging.Streams, name string, offer SessionDescription, cfg *Options, onCandidate func(*ICECandidateInit)) (SessionDescription, string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return SessionDescription{}, "", err
+	}
+	s := &viewerSession{
+		id:       hex.EncodeToString(id),
+		name:     name,
+		stream:   name,
+		quality:  "source",
+		mid:      firstMid(offer.SDP),
+		gathered: make(chan struct{}),
+		number:   nextSessionNumber(),
+	}
+	if split := strings.SplitN(name, "@", 2); len(split) == 2 {
+		s.stream, s.quality = split[0], split[1]
+	}
+
+	stream, err := streams.Get(s.stream)
+	if err != nil {
+		return SessionDescription{}, "", err
+	}
+	pc, err := s.negotiate(stream, offer, cfg, func(c *webrtc.ICECandidate) {
+		candidate := s.addLocalCandidate(c)
+		if onCandidate != nil {
+			onCandidate(candidate)
+		}
+	})
+	if err != nil {
+		return SessionDescription{}, "", err
+	}
+	if onCandidate == nil {
+		select {
+		case <-s.gathered:
+		case <-time.After(gatherTimeout):
+		}
+	}
+
+	// Local description waits for the ICE agent which may be sending
+	// a candidate to this session, so it is read without lock
+	sent := len(s.localCandidates())
+	answer := *pc.LocalDescription()
+	s.lock.Lock()
+	s.pc = pc
+	closed := s.closed
+	s.sent = sent
+	s.lock.Unlock()
+	if closed {
+		// Connection failed during negotiation
+		pc.Close()
+		return SessionDescription{}, "", ErrSessionNotFound
+	}
+
+	viewerLock.Lock()
+	viewerSessions[s.id] = s
+	viewerLock.Unlock()
+	log.Printf("New WebRTC viewer for stream %s", name)
+
+	// Forget viewers which never connect
+	time.AfterFunc(connectTimeout, func() {
+		switch pc.ICEConnectionState() {
+		case webrtc.ICEConnectionStateNew, webrtc.ICEConnectionStateChecking:
+			log.Printf("WebRTC viewer of stream %s did not connect", name)
+			s.close()
+		}
+	})
+	return answer, s.id, nil
+}
+
+// firstMid returns the identifier of the first media of a session description,
+// media are bundled so candidates are given for this one
+func firstMid(sdp string) string {
+	for _, line := range strings.Split(sdp, "\n") {
+		if strings.HasPrefix(line, "a=mid:") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "a=mid:"))
+		}
+	}
+	return "0"
+}
+
+// addLocalCandidate saves a gathered candidate, nil once gathering is complete
+func (s *viewerSession) addLocalCandidate(c *webrtc.ICECandidate) *ICECandidateInit {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if c == nil {
+		select {
+		case <-s.gathered:
+		default:
+			close(s.gathered)
+		}
+		return nil
+	}
+	candidate := c.ToJSON()
+	mid := s.mid
+	candidate.SDPMid = &mid
+	s.candidates = append(s.candidates, candidate)
+	return &candidate
+}
+
+// localCandidates returns the candidates gathered so far
+func (s *viewerSession) localCandidates() []ICECandidateInit {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.candidates
+}
+
+// getViewerSession returns a session of a stream, or nil
+func getViewerSession(name, id string) *viewerSession {
+	viewerLock.Lock()
+	defer viewerLock.Unlock()
+	if s, ok := viewerSessions[id]; ok && s.name == name {
+		return s
+	}
+	return nil
+}
+
+// AddCandidate adds a remote ICE candidate to the session of a stream.
+func AddCandidate(name, id string, candidate ICECandidateInit) error {
+	s := getViewerSession(name, id)
+	if s == nil {
+		return ErrSessionNotFound
+	}
+	return s.pc.AddICECandidate(candidate)
+}
+
+// AddCandidates adds the ICE candidates of a trickle ICE SDP fragment
+// to the session of a stream.
+// It returns a fragment with local candidates gathered since the last call,
+// or an empty string if there is none.
+func AddCandidates(name, id, fragment string) (string, error) {
+	s := getViewerSession(name, id)
+	if s == nil {
+		return "", ErrSessionNotFound
+	}
+
+	var mid *string
+	for _, line := range strings.Split(fragment, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "a=mid:"):
+			value := strings.TrimPrefix(line, "a=mid:")
+			mid = &value
+		case strings.HasPrefix(line, "a=candidate:"):
+			candidate := webrtc.ICECandidateInit{Candidate: strings.TrimPrefix(line, "a="), SDPMid: mid}
+			if err := s.pc.AddICECandidate(candidate); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	// Send back new local candidates
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	gathered := false
+	select {
+	case <-s.gathered:
+		gathered = true
+	default:
+	}
+	if s.sent == len(s.candidates) && (!gathered || s.endSent) {
+		return "", nil
+	}
+	local := "a=mid:" + s.mid + "\r\n"
+	for _, c := range s.candidates[s.sent:] {
+		local += "a=" + c.Candidate + "\r\n"
+	}
+	s.sent = len(s.candidates)
+	if gathered {
+		local += "a=end-of-candidates\r\n"
+		s.endSent = true
+	}
+	return local, nil
+}
+
+// Stop ends the session of a stream.
+func Stop(name, id string) error {
+	s := getViewerSession(name, id)
+	if s == nil {
+		return ErrSessionNotFound
+	}
+	s.close()
+	return nil
+}
+
+// close ends the session, the peer connection is closed if it exists
+func (s *viewerSession) close() {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return
+	}
+	s.closed = true
+	pc := s.pc
+	s.lock.Unlock()
+
+	viewers.remove(s.stream, s)
+	viewerLock.Lock()
+	delete(viewerSessions, s.id)
+	viewerLock.Unlock()
+	if pc != nil {
+		// This function may be called by a state change handler
+		go func() {
+			if err := pc.Close(); err != nil {
+				log.Printf("Failed to close WebRTC viewer peer connection: %s", err)
+			}
+		}()
+	}
+	log.Printf("WebRTC viewer left stream '%s'", s.name)
+}
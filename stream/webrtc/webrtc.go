@@ -2,12 +2,15 @@
 package webrtc
 
 import (
+	"fmt"
 	"log"
 	"math/rand"
-	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/nack"
 	"github.com/pion/webrtc/v3"
-	"gitlab.crans.org/nounous/ghostream/internal/monitoring"
 	"gitlab.crans.org/nounous/ghostream/messaging"
 )
 
@@ -17,165 +20,177 @@ type Options struct {
 	MinPortUDP  uint16
 	MaxPortUDP  uint16
 	STUNServers []string
+
+	// Accept publishers using WHIP on web server
+	WHIP bool
+
+	// ICE over UDP on one port shared by all sessions, instead of
+	// a port for each session in the UDP port range
+	ICEUDPListenAddress string
+
+	// ICE over TCP on one port shared by all sessions, disabled if empty.
+	// With ICETCPOnly, UDP port range is not used.
+	ICETCPListenAddress string
+	ICETCPOnly          bool
+
+	// Public IP addresses replacing local ones behind NAT 1:1,
+	// and network interfaces to use, all if empty
+	NAT1To1IPs []string
+	Interfaces []string
+
+	// Embedded TURN server for viewers behind symmetric NAT,
+	// relays are allocated on TURNRelayIP
+	TURN              bool
+	TURNListenAddress string
+	TURNRelayIP       string
+	TURNCredentialTTL time.Duration
 }
 
 // SessionDescription contains SDP data
 // to initiate a WebRTC connection between one client and this app
 type SessionDescription = webrtc.SessionDescription
 
-var (
-	videoTracks map[string][]*webrtc.Track
-	audioTracks map[string][]*webrtc.Track
-)
-
-// Helper to reslice tracks
-func removeTrack(tracks []*webrtc.Track, track *webrtc.Track) []*webrtc.Track {
-	for i, t := range tracks {
-		if t == track {
-			return append(tracks[:i], tracks[i+1:]...)
-		}
-	}
-	return nil
-}
+// SDPTypeOffer is the type of a session description sent by a publisher
+const SDPTypeOffer = webrtc.SDPTypeOffer
 
 // GetNumberConnectedSessions get the number of currently connected clients
 func GetNumberConnectedSessions(streamID string) int {
-	return len(videoTracks[streamID])
+	return viewers.count(streamID)
 }
 
-// newPeerHandler is called when server receive a new session description
-// this initiates a WebRTC connection and return server description
-func newPeerHandler(name string, localSdpChan chan webrtc.SessionDescription, remoteSdp webrtc.SessionDescription, cfg *Options) {
-	// Create media engine using client SDP
-	mediaEngine := webrtc.MediaEngine{}
-	if err := mediaEngine.PopulateFromSDP(remoteSdp); err != nil {
-		log.Println("Failed to create new media engine", err)
-		localSdpChan <- webrtc.SessionDescription{}
-		return
+// negotiate answers the offer of a viewer with a peer connection sending
+// the stream. Function onCandidate is called with each gathered local
+// candidate, then with nil.
+// The session is registered to get the stream once connected.
+func (s *viewerSession) negotiate(stream *messaging.Stream, remoteSdp webrtc.SessionDescription, cfg *Options, onCandidate func(*webrtc.ICECandidate)) (*webrtc.PeerConnection, error) {
+	// Choose a quality with a video codec supported by the viewer,
+	// audio is sent if the viewer supports Opus
+	videoOffered, err := offeredCodecs(remoteSdp, webrtc.RTPCodecTypeVideo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse offer, %s", err)
+	}
+	audioOffered, err := offeredCodecs(remoteSdp, webrtc.RTPCodecTypeAudio)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse offer, %s", err)
+	}
+	quality, videoCodec, err := selectQuality(stream, s.quality, videoOffered)
+	if err != nil {
+		return nil, err
+	}
+	if quality != s.quality {
+		log.Printf("Viewer of stream %s does not support quality %s, sending %s", s.stream, s.quality, quality)
+		s.quality = quality
+	}
+	audioCodec := selectCodec(webrtc.MimeTypeOpus, audioOffered)
+
+	// Create media engine with the codecs sent to the viewer
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterCodec(*videoCodec, webrtc.RTPCodecTypeVideo); err != nil {
+		return nil, fmt.Errorf("failed to create new media engine, %s", err)
+	}
+	if audioCodec != nil {
+		if err := mediaEngine.RegisterCodec(*audioCodec, webrtc.RTPCodecTypeAudio); err != nil {
+			return nil, fmt.Errorf("failed to create new media engine, %s", err)
+		}
 	}
 
 	// Create a new PeerConnection
-	settingsEngine := webrtc.SettingEngine{}
-	if err := settingsEngine.SetEphemeralUDPPortRange(cfg.MinPortUDP, cfg.MaxPortUDP); err != nil {
-		log.Println("Failed to set min/max UDP ports", err)
-		localSdpChan <- webrtc.SessionDescription{}
-		return
+	settingsEngine, err := newSettingEngine(cfg)
+	if err != nil {
+		return nil, err
 	}
+
+	// Lost packets are sent again on viewer request
+	interceptors := &interceptor.Registry{}
+	responder, err := nack.NewResponderInterceptor()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create NACK responder, %s", err)
+	}
+	interceptors.Add(responder)
 	api := webrtc.NewAPI(
 		webrtc.WithMediaEngine(mediaEngine),
 		webrtc.WithSettingEngine(settingsEngine),
+		webrtc.WithInterceptorRegistry(interceptors),
 	)
 	peerConnection, err := api.NewPeerConnection(webrtc.Configuration{
 		ICEServers: []webrtc.ICEServer{{URLs: cfg.STUNServers}},
 	})
 	if err != nil {
-		log.Println("Failed to initiate peer connection", err)
-		localSdpChan <- webrtc.SessionDescription{}
-		return
+		return nil, fmt.Errorf("failed to initiate peer connection, %s", err)
+	}
+	fail := func(format string, err error) (*webrtc.PeerConnection, error) {
+		peerConnection.Close()
+		return nil, fmt.Errorf(format, err)
 	}
 
 	// Create video track
-	codec, payloadType := getPayloadType(mediaEngine, webrtc.RTPCodecTypeVideo, "H264")
-	videoTrack, err := webrtc.NewTrack(payloadType, rand.Uint32(), "video", "pion", codec)
+	videoTrack, err := webrtc.NewTrackLocalStaticRTP(videoCodec.RTPCodecCapability, "video", "pion")
 	if err != nil {
-		log.Println("Failed to create new video track", err)
-		localSdpChan <- webrtc.SessionDescription{}
-		return
+		return fail("failed to create new video track, %s", err)
 	}
-	if _, err = peerConnection.AddTrack(videoTrack); err != nil {
-		log.Println("Failed to add video track", err)
-		localSdpChan <- webrtc.SessionDescription{}
-		return
+	videoSender, err := peerConnection.AddTrack(videoTrack)
+	if err != nil {
+		return fail("failed to add video track, %s", err)
 	}
 
 	// Create audio track
-	codec, payloadType = getPayloadType(mediaEngine, webrtc.RTPCodecTypeAudio, "opus")
-	audioTrack, err := webrtc.NewTrack(payloadType, rand.Uint32(), "audio", "pion", codec)
-	if err != nil {
-		log.Println("Failed to create new audio track", err)
-		localSdpChan <- webrtc.SessionDescription{}
-		return
-	}
-	if _, err = peerConnection.AddTrack(audioTrack); err != nil {
-		log.Println("Failed to add audio track", err)
-		localSdpChan <- webrtc.SessionDescription{}
-		return
+	var audioTrack *webrtc.TrackLocalStaticRTP
+	if audioCodec != nil {
+		audioTrack, err = webrtc.NewTrackLocalStaticRTP(audioCodec.RTPCodecCapability, "audio", "pion")
+		if err != nil {
+			return fail("failed to create new audio track, %s", err)
+		}
+		audioSender, err := peerConnection.AddTrack(audioTrack)
+		if err != nil {
+			return fail("failed to add audio track, %s", err)
+		}
+		go s.readRTCP(audioSender, "audio", audioCodec.ClockRate)
 	}
+	go s.readRTCP(videoSender, "video", videoCodec.ClockRate)
 
 	// Set the remote SessionDescription
 	if err = peerConnection.SetRemoteDescription(remoteSdp); err != nil {
-		log.Println("Failed to set remote description", err)
-		localSdpChan <- webrtc.SessionDescription{}
-		return
+		return fail("failed to set remote description, %s", err)
 	}
 
-	streamID := name
-	split := strings.SplitN(streamID, "@", 2)
-	streamID = split[0]
-	quality := "source"
-	if len(split) == 2 {
-		quality = split[1]
-	}
-	log.Printf("New WebRTC session for stream %s, quality %s", streamID, quality)
-	// TODO Consider the quality
+	log.Printf("New WebRTC session for stream %s, quality %s, codec %s", s.stream, s.quality, videoCodec.MimeType)
+	s.videoTrack, s.audioTrack = videoTrack, audioTrack
+	s.videoSequence = uint16(rand.Uint32())
 
 	// Set the handler for ICE connection state
 	// This will notify you when the peer has connected/disconnected
 	peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
 		log.Printf("Connection State has changed %s \n", connectionState.String())
-		if videoTracks[streamID] == nil {
-			videoTracks[streamID] = make([]*webrtc.Track, 0, 1)
-		}
-		if audioTracks[streamID] == nil {
-			audioTracks[streamID] = make([]*webrtc.Track, 0, 1)
-		}
-		if connectionState == webrtc.ICEConnectionStateConnected {
-			// Register tracks
-			videoTracks[streamID] = append(videoTracks[streamID], videoTrack)
-			audioTracks[streamID] = append(audioTracks[streamID], audioTrack)
-			monitoring.WebRTCConnectedSessions.Inc()
-		} else if connectionState == webrtc.ICEConnectionStateDisconnected {
-			// Unregister tracks
-			videoTracks[streamID] = removeTrack(videoTracks[streamID], videoTrack)
-			audioTracks[streamID] = removeTrack(audioTracks[streamID], audioTrack)
-			monitoring.WebRTCConnectedSessions.Dec()
+		switch connectionState {
+		case webrtc.ICEConnectionStateConnected:
+			// Closed sessions must not be registered again,
+			// new viewers get packets since last keyframe
+			atomic.StoreInt32(&s.keyframeRequested, 1)
+			s.lock.Lock()
+			if !s.closed {
+				viewers.add(s.stream, s)
+			}
+			s.lock.Unlock()
+		case webrtc.ICEConnectionStateDisconnected:
+			// Disconnected viewers may reconnect
+			viewers.remove(s.stream, s)
+		case webrtc.ICEConnectionStateFailed, webrtc.ICEConnectionStateClosed:
+			s.close()
 		}
 	})
 
 	// Create answer
 	answer, err := peerConnection.CreateAnswer(nil)
 	if err != nil {
-		log.Println("Failed to create answer", err)
-		localSdpChan <- webrtc.SessionDescription{}
-		return
+		return fail("failed to create answer, %s", err)
 	}
 
-	// Sets the LocalDescription
-	// Using GatheringCompletePromise disable trickle ICE
-	// FIXME: https://github.com/pion/webrtc/wiki/Release-WebRTC@v3.0.0
-	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+	// Sets the LocalDescription, this starts gathering candidates
+	peerConnection.OnICECandidate(onCandidate)
 	if err = peerConnection.SetLocalDescription(answer); err != nil {
-		log.Println("Failed to set local description", err)
-		localSdpChan <- webrtc.SessionDescription{}
-		return
-	}
-	<-gatherComplete
-
-	// Send answer to client
-	localSdpChan <- *peerConnection.LocalDescription()
-}
-
-// Search for Codec PayloadType
-//
-// Since we are answering we need to match the remote PayloadType
-func getPayloadType(m webrtc.MediaEngine, codecType webrtc.RTPCodecType, codecName string) (*webrtc.RTPCodec, uint8) {
-	for _, codec := range m.GetCodecsByKind(codecType) {
-		if codec.Name == codecName {
-			return codec, codec.PayloadType
-		}
+		return fail("failed to set local description, %s", err)
 	}
-	log.Printf("Remote peer does not support %s", codecName)
-	return nil, 0
+	return peerConnection, nil
 }
 
 // Serve WebRTC media streaming server
@@ -185,44 +200,41 @@ func Serve(streams *messaging.Streams, cfg *Options) {
 		return
 	}
 
-	log.Printf("WebRTC server using UDP from port %d to %d", cfg.MinPortUDP, cfg.MaxPortUDP)
+	if cfg.ICEUDPListenAddress != "" {
+		log.Printf("WebRTC server using UDP on %s", cfg.ICEUDPListenAddress)
+	} else {
+		log.Printf("WebRTC server using UDP from port %d to %d", cfg.MinPortUDP, cfg.MaxPortUDP)
+	}
+	if cfg.TURN {
+		if _, err := serveTURN(cfg); err != nil {
+			log.Printf("Failed to start TURN server: %s", err)
+		}
+	}
 
-	// WebRTC ingested tracks
-	videoTracks = make(map[string][]*webrtc.Track)
-	audioTracks = make(map[string][]*webrtc.Track)
+	// Subscribe to new quality event
+	event := make(chan messaging.Event, 8)
+	streams.Subscribe(event, messaging.Filter{Types: []messaging.EventType{messaging.QualityCreated}})
 
-	// Subscribe to new stream event
-	event := make(chan string, 8)
-	streams.Subscribe(event)
+	// For each new quality
+	for e := range event {
+		name, qualityName := e.Stream, e.Quality
 
-	// For each new stream
-	for name := range event {
 		// Get stream
 		stream, err := streams.Get(name)
 		if err != nil {
 			log.Printf("Failed to get stream '%s'", name)
+			continue
 		}
 
 		// Get specific quality
-		// FIXME: make it possible to forward other qualities
-		qualityName := "source"
 		quality, err := stream.GetQuality(qualityName)
 		if err != nil {
 			log.Printf("Failed to get quality '%s'", qualityName)
+			continue
 		}
 
 		// Start forwarding
 		log.Printf("Starting webrtc for '%s' quality '%s'", name, qualityName)
-		go ingest(name, quality)
-		go listenSdp(name, quality.WebRtcLocalSdp, quality.WebRtcRemoteSdp, cfg)
-	}
-}
-
-func listenSdp(name string, localSdp, remoteSdp chan webrtc.SessionDescription, cfg *Options) {
-	// Handle new connections
-	for {
-		// Wait for incoming session description
-		// then send the local description to browser
-		newPeerHandler(name, localSdp, <-remoteSdp, cfg)
+		go ingest(name, qualityName, quality)
 	}
 }
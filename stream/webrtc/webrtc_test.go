@@ -1,16 +1,27 @@
 package webrtc
 
 import (
-	"math/rand"
+	"bytes"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/turn/v2"
 	"github.com/pion/webrtc/v3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gitlab.crans.org/nounous/ghostream/internal/demux"
+	"gitlab.crans.org/nounous/ghostream/internal/monitoring"
 	"gitlab.crans.org/nounous/ghostream/messaging"
 )
 
 func TestServe(t *testing.T) {
 	// Init streams messaging and WebRTC server
-	streams := messaging.New()
+	streams := messaging.New(&messaging.Options{})
 	cfg := Options{
 		Enabled:     true,
 		MinPortUDP:  10000,
@@ -20,14 +31,13 @@ func TestServe(t *testing.T) {
 	go Serve(streams, &cfg)
 
 	// New client connection
-	mediaEngine := webrtc.MediaEngine{}
+	mediaEngine := &webrtc.MediaEngine{}
 	mediaEngine.RegisterDefaultCodecs()
 	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine))
 	peerConnection, _ := api.NewPeerConnection(webrtc.Configuration{})
 
 	// Create video track
-	codec, payloadType := getPayloadType(mediaEngine, webrtc.RTPCodecTypeVideo, "H264")
-	videoTrack, err := webrtc.NewTrack(payloadType, rand.Uint32(), "video", "pion", codec)
+	videoTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", "pion")
 	if err != nil {
 		t.Error("Failed to create new video track", err)
 	}
@@ -36,8 +46,7 @@ func TestServe(t *testing.T) {
 	}
 
 	// Create audio track
-	codec, payloadType = getPayloadType(mediaEngine, webrtc.RTPCodecTypeAudio, "opus")
-	audioTrack, err := webrtc.NewTrack(payloadType, rand.Uint32(), "audio", "pion", codec)
+	audioTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "pion")
 	if err != nil {
 		t.Error("Failed to create new audio track", err)
 	}
@@ -56,3 +65,787 @@ func TestServe(t *testing.T) {
 	// FIXME: Send offer to server
 	// FIXME: verify connection did work
 }
+
+// TestWHIP publishes an offer and checks that a stream is created
+func TestWHIP(t *testing.T) {
+	streams := messaging.New(&messaging.Options{})
+	cfg := Options{MinPortUDP: 10010, MaxPortUDP: 10015, WHIP: true}
+
+	// Publisher with a video track
+	mediaEngine := &webrtc.MediaEngine{}
+	mediaEngine.RegisterDefaultCodecs()
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine))
+	peerConnection, _ := api.NewPeerConnection(webrtc.Configuration{})
+	defer peerConnection.Close()
+	videoTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", "pion")
+	if err != nil {
+		t.Fatal("Failed to create new video track", err)
+	}
+	if _, err = peerConnection.AddTrack(videoTrack); err != nil {
+		t.Fatal("Failed to add video track", err)
+	}
+	offer, _ := peerConnection.CreateOffer(nil)
+	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+	peerConnection.SetLocalDescription(offer)
+	<-gatherComplete
+
+	// Start session
+	answer, id, err := Publish(streams, "demo", *peerConnection.LocalDescription(), messaging.Metadata{}, &cfg)
+	if err != nil {
+		t.Fatalf("Failed to publish: %s", err)
+	}
+	if err := peerConnection.SetRemoteDescription(answer); err != nil {
+		t.Errorf("Publisher rejected answer: %s", err)
+	}
+	stream, err := streams.Get("demo")
+	if err != nil {
+		t.Fatalf("Stream was not created")
+	}
+	if m := stream.Metadata(); m.Protocol != "whip" {
+		t.Errorf("Stream has wrong protocol %s", m.Protocol)
+	}
+
+	// Keyframe requests of viewers are forwarded to publisher
+	if !requestPublisherKeyframe("demo") || len(whipSessions[id].keyframeRequests) != 1 {
+		t.Errorf("Keyframe request was not forwarded to publisher")
+	}
+	if requestPublisherKeyframe("other") {
+		t.Errorf("Forwarded keyframe request to publisher of another stream")
+	}
+
+	// Stream already has a publisher
+	if _, _, err := Publish(streams, "demo", *peerConnection.LocalDescription(), messaging.Metadata{}, &cfg); err == nil {
+		t.Errorf("Published twice the same stream")
+	}
+
+	// Stop session
+	if err := Unpublish("other", id); err != ErrSessionNotFound {
+		t.Errorf("Stopped session of another stream")
+	}
+	if err := Unpublish("demo", id); err != nil {
+		t.Errorf("Failed to stop session: %s", err)
+	}
+	if _, err := streams.Get("demo"); err == nil {
+		t.Errorf("Stream was not deleted")
+	}
+}
+
+// newDemoStreams returns streams with a source quality of stream demo
+func newDemoStreams(t *testing.T) *messaging.Streams {
+	streams := messaging.New(&messaging.Options{})
+	stream, err := streams.Create("demo")
+	if err != nil {
+		t.Fatalf("Failed to create stream: %s", err)
+	}
+	if _, err := stream.CreateQuality("source"); err != nil {
+		t.Fatalf("Failed to create quality: %s", err)
+	}
+	return streams
+}
+
+// TestWHEP plays a stream with an offer, then stops the session
+func TestWHEP(t *testing.T) {
+	cfg := Options{Enabled: true, MinPortUDP: 10020, MaxPortUDP: 10025}
+
+	// Viewer receives video and audio
+	mediaEngine := &webrtc.MediaEngine{}
+	mediaEngine.RegisterDefaultCodecs()
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine))
+	peerConnection, _ := api.NewPeerConnection(webrtc.Configuration{})
+	defer peerConnection.Close()
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		init := webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}
+		if _, err := peerConnection.AddTransceiverFromKind(kind, init); err != nil {
+			t.Fatal("Failed to add transceiver", err)
+		}
+	}
+	offer, _ := peerConnection.CreateOffer(nil)
+	peerConnection.SetLocalDescription(offer)
+
+	// Start session
+	answer, id, err := Play(newDemoStreams(t), "demo", offer, &cfg, nil)
+	if err != nil {
+		t.Fatalf("Failed to play: %s", err)
+	}
+	if err := peerConnection.SetRemoteDescription(answer); err != nil {
+		t.Errorf("Viewer rejected answer: %s", err)
+	}
+
+	// Trickle ICE
+	fragment := "a=mid:0\r\na=candidate:1 1 udp 2130706431 127.0.0.1 10030 typ host\r\n"
+	if _, err := AddCandidates("demo", id, fragment); err != nil {
+		t.Errorf("Failed to add candidates: %s", err)
+	}
+	if _, err := AddCandidates("other", id, fragment); err != ErrSessionNotFound {
+		t.Errorf("Added candidates to session of another stream")
+	}
+
+	// Stop session
+	if err := Stop("demo", id); err != nil {
+		t.Errorf("Failed to stop session: %s", err)
+	}
+	if err := Stop("demo", id); err != ErrSessionNotFound {
+		t.Errorf("Stopped session twice")
+	}
+}
+
+// TestTrickleICE answers a viewer before gathering candidates,
+// then sends them progressively
+func TestTrickleICE(t *testing.T) {
+	cfg := Options{Enabled: true, MinPortUDP: 10030, MaxPortUDP: 10035}
+
+	mediaEngine := &webrtc.MediaEngine{}
+	mediaEngine.RegisterDefaultCodecs()
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine))
+	peerConnection, _ := api.NewPeerConnection(webrtc.Configuration{})
+	defer peerConnection.Close()
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		init := webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}
+		if _, err := peerConnection.AddTransceiverFromKind(kind, init); err != nil {
+			t.Fatal("Failed to add transceiver", err)
+		}
+	}
+	offer, _ := peerConnection.CreateOffer(nil)
+	peerConnection.SetLocalDescription(offer)
+
+	// Gathering ends with a nil candidate
+	candidates := make(chan *ICECandidateInit, 64)
+	answer, id, err := Play(newDemoStreams(t), "demo", offer, &cfg, func(c *ICECandidateInit) {
+		candidates <- c
+	})
+	if err != nil {
+		t.Fatalf("Failed to play: %s", err)
+	}
+	defer Stop("demo", id)
+	if err := peerConnection.SetRemoteDescription(answer); err != nil {
+		t.Errorf("Viewer rejected answer: %s", err)
+	}
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case c := <-candidates:
+			if c == nil {
+				return
+			}
+			if c.SDPMid == nil || *c.SDPMid != "0" {
+				t.Errorf("Candidate has wrong media identifier")
+			}
+			if err := peerConnection.AddICECandidate(*c); err != nil {
+				t.Errorf("Viewer rejected candidate: %s", err)
+			}
+		case <-timeout:
+			t.Fatalf("Candidate gathering did not complete")
+		}
+	}
+}
+
+// TestConcurrentPlay negotiates sessions of many viewers at once,
+// each session must answer the offer of its viewer
+func TestConcurrentPlay(t *testing.T) {
+	cfg := Options{Enabled: true, MinPortUDP: 10040, MaxPortUDP: 10060}
+	streams := newDemoStreams(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mediaEngine := &webrtc.MediaEngine{}
+			mediaEngine.RegisterDefaultCodecs()
+			api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine))
+			peerConnection, _ := api.NewPeerConnection(webrtc.Configuration{})
+			defer peerConnection.Close()
+			for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+				init := webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}
+				if _, err := peerConnection.AddTransceiverFromKind(kind, init); err != nil {
+					t.Error("Failed to add transceiver", err)
+					return
+				}
+			}
+			offer, _ := peerConnection.CreateOffer(nil)
+			peerConnection.SetLocalDescription(offer)
+
+			answer, id, err := Play(streams, "demo", offer, &cfg, func(*ICECandidateInit) {})
+			if err != nil {
+				t.Errorf("Failed to play: %s", err)
+				return
+			}
+			defer Stop("demo", id)
+			if s := getViewerSession("demo", id); s == nil || s.pc.RemoteDescription().SDP != offer.SDP {
+				t.Errorf("Session did not get the offer of its viewer")
+			}
+			if err := peerConnection.SetRemoteDescription(answer); err != nil {
+				t.Errorf("Viewer rejected answer: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// TestRegistry registers sessions from many goroutines and counts them
+func TestRegistry(t *testing.T) {
+	r := newRegistry()
+	sessions := make([]*viewerSession, 16)
+	var wg sync.WaitGroup
+	for i := range sessions {
+		sessions[i] = &viewerSession{}
+		wg.Add(1)
+		go func(s *viewerSession) {
+			defer wg.Done()
+			if !r.add("demo", s) {
+				t.Errorf("Failed to register session")
+			}
+			r.forEach("demo", func(*viewerSession) {})
+		}(sessions[i])
+	}
+	wg.Wait()
+	if n := r.count("demo"); n != len(sessions) {
+		t.Errorf("Expected %d sessions, found %d", len(sessions), n)
+	}
+
+	// Sessions are registered once
+	if r.add("demo", sessions[0]) {
+		t.Errorf("Registered session twice")
+	}
+	for _, s := range sessions {
+		if !r.remove("demo", s) {
+			t.Errorf("Failed to unregister session")
+		}
+	}
+	if r.remove("demo", sessions[0]) {
+		t.Errorf("Unregistered session twice")
+	}
+	if n := r.count("demo"); n != 0 {
+		t.Errorf("Expected no session, found %d", n)
+	}
+}
+
+// TestPacketizer splits frames in RTP packets timestamped from their PTS
+func TestPacketizer(t *testing.T) {
+	// Parameter sets then a keyframe larger than MTU
+	idr := append([]byte{0x65}, bytes.Repeat([]byte{0xab}, 3000)...)
+	data := append([]byte{0, 0, 0, 1, 0x67, 0x42, 0xc0, 0x1f, 0, 0, 0, 1, 0x68, 0xce, 0x3c, 0x80, 0, 0, 0, 1}, idr...)
+	packets := newVideoPacketizer("h264").packetize(demux.Frame{Codec: "h264", PTS: 90000, Data: data})
+	if len(packets) != 4 {
+		t.Fatalf("Expected 4 packets, got %d", len(packets))
+	}
+	for i, packet := range packets {
+		if packet.Timestamp != 90000 {
+			t.Errorf("Packet %d has wrong timestamp %d", i, packet.Timestamp)
+		}
+		if len(packet.Payload) > rtpMTU {
+			t.Errorf("Packet %d is larger than MTU", i)
+		}
+		if packet.Marker != (i == len(packets)-1) {
+			t.Errorf("Packet %d has wrong marker", i)
+		}
+	}
+	if packets[0].Payload[0]&0x1f != 24 || packets[1].Payload[0]&0x1f != 28 {
+		t.Errorf("Parameter sets must be aggregated first, then keyframe fragments")
+	}
+
+	// Opus uses a 48 kHz clock
+	packets = newOpusPacketizer().packetize(demux.Frame{Codec: "opus", PTS: 90000, Data: []byte{0xfc, 1, 2}})
+	if len(packets) != 1 || packets[0].Timestamp != 48000 {
+		t.Errorf("Wrong Opus packetization")
+	}
+
+	// VP8 payload descriptor marks the start of the frame
+	packets = newVideoPacketizer("vp8").packetize(demux.Frame{Codec: "vp8", PTS: 90000, Data: bytes.Repeat([]byte{1}, 2000)})
+	if len(packets) != 2 || packets[0].Payload[0]&0x10 == 0 || packets[1].Payload[0]&0x10 != 0 {
+		t.Errorf("Wrong VP8 packetization")
+	}
+
+	// AV1 temporal delimiter is removed, then each OBU is sent without
+	// its size field, the frame in two fragments
+	frame := append([]byte{0x32, 0xd0, 0x0f}, bytes.Repeat([]byte{0xab}, 2000)...)
+	data = append([]byte{0x12, 0x00, 0x0a, 0x03, 1, 2, 3}, frame...)
+	packets = newVideoPacketizer("av1").packetize(demux.Frame{Codec: "av1", PTS: 90000, Data: data})
+	if len(packets) != 3 {
+		t.Fatalf("Expected 3 AV1 packets, got %d", len(packets))
+	}
+	if !bytes.Equal(packets[0].Payload, []byte{0x00, 0x04, 0x08, 1, 2, 3}) {
+		t.Errorf("Wrong AV1 sequence header packet: %v", packets[0].Payload)
+	}
+	if packets[1].Payload[0] != 0x40 || packets[1].Payload[3] != 0x30 || packets[2].Payload[0] != 0x80 {
+		t.Errorf("Wrong AV1 frame fragments")
+	}
+	if packets[1].Marker || !packets[2].Marker {
+		t.Errorf("Only the last AV1 packet must have a marker")
+	}
+}
+
+// TestTURN allocates a relay with credentials given to viewers
+func TestTURN(t *testing.T) {
+	cfg := Options{
+		STUNServers:       []string{"stun:stun.l.google.com:19302"},
+		TURN:              true,
+		TURNListenAddress: "127.0.0.1:13478",
+		TURNRelayIP:       "127.0.0.1",
+		TURNCredentialTTL: time.Hour,
+		MinPortUDP:        10080,
+		MaxPortUDP:        10085,
+	}
+	turnLock.Lock()
+	turnAddress = ""
+	turnLock.Unlock()
+	if _, err := serveTURN(&Options{TURNListenAddress: "127.0.0.1:13478"}); err == nil {
+		t.Errorf("Started TURN server without relay address")
+	}
+	if servers := ICEServers(&cfg); len(servers) != 1 {
+		t.Errorf("Advertised TURN server which is not running: %v", servers)
+	}
+	server, err := serveTURN(&cfg)
+	if err != nil {
+		t.Fatalf("Failed to start TURN server: %s", err)
+	}
+	defer server.Close()
+
+	servers := ICEServers(&cfg)
+	if len(servers) != 2 || servers[1].URLs[0] != "turn:127.0.0.1:13478?transport=udp" {
+		t.Fatalf("Wrong ICE servers %v", servers)
+	}
+
+	// Viewer allocates a relay
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := turn.NewClient(&turn.ClientConfig{
+		TURNServerAddr: "127.0.0.1:13478",
+		Username:       servers[1].Username,
+		Password:       servers[1].Credential,
+		Conn:           conn,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	relay, err := client.Allocate()
+	if err != nil {
+		t.Fatalf("Failed to allocate relay: %s", err)
+	}
+	defer relay.Close()
+
+	// Relay only reaches media ports of the server
+	media, err := net.ListenPacket("udp4", "127.0.0.1:10080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer media.Close()
+	other, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	for _, peer := range []net.PacketConn{other, media} {
+		if _, err := relay.WriteTo([]byte("demo"), peer.LocalAddr()); err != nil {
+			t.Errorf("Failed to send through relay: %s", err)
+		}
+	}
+	b := make([]byte, 16)
+	media.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, _, err := media.ReadFrom(b); err != nil || string(b[:n]) != "demo" {
+		t.Errorf("Media port did not receive relayed data: %s", err)
+	}
+	other.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err := other.ReadFrom(b); err == nil {
+		t.Errorf("Relayed data to a port which is not a media port")
+	}
+
+	// Credentials expire, unless client is active, unauthenticated
+	// requests leave no state
+	if _, ok := turnAuth("1:demo", turnRealm, other.LocalAddr()); ok {
+		t.Errorf("Accepted expired credentials from another client")
+	}
+	turnAuth("9999999999:demo", turnRealm, other.LocalAddr())
+	turnLock.Lock()
+	_, recorded := turnClients[other.LocalAddr().String()]
+	turnLock.Unlock()
+	if recorded {
+		t.Errorf("Recorded a client before authentication")
+	}
+	if _, ok := turnAuth("1:demo", turnRealm, conn.LocalAddr()); !ok {
+		t.Errorf("Rejected expired credentials of an active client")
+	}
+}
+
+// TestICETCP gathers candidates only on the shared TCP port,
+// advertising a public address
+func TestICETCP(t *testing.T) {
+	if _, err := newSettingEngine(&Options{ICETCPOnly: true}); err != ErrNoNetwork {
+		t.Errorf("Accepted configuration without network")
+	}
+	cfg := Options{
+		Enabled:             true,
+		ICETCPListenAddress: ":13479",
+		ICETCPOnly:          true,
+		NAT1To1IPs:          []string{"203.0.113.1"},
+	}
+
+	mediaEngine := &webrtc.MediaEngine{}
+	mediaEngine.RegisterDefaultCodecs()
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine))
+	peerConnection, _ := api.NewPeerConnection(webrtc.Configuration{})
+	defer peerConnection.Close()
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		init := webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}
+		if _, err := peerConnection.AddTransceiverFromKind(kind, init); err != nil {
+			t.Fatal("Failed to add transceiver", err)
+		}
+	}
+	offer, _ := peerConnection.CreateOffer(nil)
+	peerConnection.SetLocalDescription(offer)
+
+	candidates := make(chan *ICECandidateInit, 64)
+	_, id, err := Play(newDemoStreams(t), "demo", offer, &cfg, func(c *ICECandidateInit) {
+		candidates <- c
+	})
+	if err != nil {
+		t.Fatalf("Failed to play: %s", err)
+	}
+	defer Stop("demo", id)
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case c := <-candidates:
+			if c == nil {
+				return
+			}
+			// Public address is IPv4, so it replaces IPv4 addresses only
+			fields := strings.Fields(c.Candidate)
+			if len(fields) < 6 || fields[2] != "tcp" || fields[5] != "13479" {
+				t.Errorf("Unexpected candidate %s", c.Candidate)
+			} else if !strings.Contains(fields[4], ":") && fields[4] != "203.0.113.1" {
+				t.Errorf("Candidate does not use public address: %s", c.Candidate)
+			}
+		case <-timeout:
+			t.Fatalf("Candidate gathering did not complete")
+		}
+	}
+}
+
+// TestICEUDP gathers host candidates on the shared UDP port
+func TestICEUDP(t *testing.T) {
+	cfg := Options{
+		Enabled:             true,
+		MinPortUDP:          10090,
+		MaxPortUDP:          10095,
+		ICEUDPListenAddress: "127.0.0.1:13480",
+	}
+
+	mediaEngine := &webrtc.MediaEngine{}
+	mediaEngine.RegisterDefaultCodecs()
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine))
+	peerConnection, _ := api.NewPeerConnection(webrtc.Configuration{})
+	defer peerConnection.Close()
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		init := webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}
+		if _, err := peerConnection.AddTransceiverFromKind(kind, init); err != nil {
+			t.Fatal("Failed to add transceiver", err)
+		}
+	}
+	offer, _ := peerConnection.CreateOffer(nil)
+	peerConnection.SetLocalDescription(offer)
+
+	// Sessions share the port
+	streams := newDemoStreams(t)
+	for i := 0; i < 2; i++ {
+		candidates := make(chan *ICECandidateInit, 64)
+		_, id, err := Play(streams, "demo", offer, &cfg, func(c *ICECandidateInit) {
+			candidates <- c
+		})
+		if err != nil {
+			t.Fatalf("Failed to play: %s", err)
+		}
+		defer Stop("demo", id)
+		found := false
+		timeout := time.After(5 * time.Second)
+		for gathering := true; gathering; {
+			select {
+			case c := <-candidates:
+				if c == nil {
+					gathering = false
+					break
+				}
+				fields := strings.Fields(c.Candidate)
+				if len(fields) < 8 || fields[2] != "udp" || fields[7] != "host" {
+					continue
+				}
+				if fields[4] != "127.0.0.1" || fields[5] != "13480" {
+					t.Errorf("Host candidate does not use shared port: %s", c.Candidate)
+				}
+				found = true
+			case <-timeout:
+				t.Fatalf("Candidate gathering did not complete")
+			}
+		}
+		if !found {
+			t.Errorf("No host candidate on shared port")
+		}
+	}
+}
+
+// TestSelectQuality chooses a quality with a video codec offered by viewer
+func TestSelectQuality(t *testing.T) {
+	stream, err := newDemoStreams(t).Get("demo")
+	if err != nil {
+		t.Fatalf("Failed to get stream: %s", err)
+	}
+	h264 := webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/h264", ClockRate: 90000, SDPFmtpLine: "packetization-mode=0"},
+		PayloadType:        102,
+	}
+	h264Mode1 := webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/H264", ClockRate: 90000, SDPFmtpLine: "packetization-mode=1"},
+		PayloadType:        104,
+	}
+	vp9 := webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: 90000},
+		PayloadType:        98,
+	}
+
+	// Source is H.264 until its media is known
+	quality, codec, err := selectQuality(stream, "source", []webrtc.RTPCodecParameters{vp9, h264, h264Mode1})
+	if err != nil || quality != "source" || codec.PayloadType != 104 {
+		t.Errorf("Wrong codec selected: %s %v %s", quality, codec, err)
+	}
+
+	// Missing quality falls back to another one
+	if quality, _, err := selectQuality(stream, "720p", []webrtc.RTPCodecParameters{h264Mode1}); err != nil || quality != "source" {
+		t.Errorf("Did not fall back to source: %s %s", quality, err)
+	}
+
+	// H.264 must support fragmentation
+	if _, _, err := selectQuality(stream, "source", []webrtc.RTPCodecParameters{vp9, h264}); err != ErrNoCodec {
+		t.Errorf("Selected a codec not supported by viewer")
+	}
+
+	// Viewer must decode the profile of source
+	baseline := webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f"},
+		PayloadType:        106,
+	}
+	high := webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=64001f"},
+		PayloadType:        108,
+	}
+	if c := selectH264("640028", []webrtc.RTPCodecParameters{baseline, high}); c == nil || c.PayloadType != 108 {
+		t.Errorf("Did not select high profile: %v", c)
+	}
+	if c := selectH264("42c028", []webrtc.RTPCodecParameters{baseline, high}); c == nil || c.PayloadType != 106 {
+		t.Errorf("Did not select constrained baseline profile: %v", c)
+	}
+	if c := selectH264("4d0028", []webrtc.RTPCodecParameters{baseline}); c != nil {
+		t.Errorf("Selected a profile which can not decode main profile")
+	}
+
+	// Other codecs are sent if viewer offers them
+	av1 := webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/av1", ClockRate: 90000},
+		PayloadType:        45,
+	}
+	offered := []webrtc.RTPCodecParameters{h264Mode1, vp9, av1}
+	if c := selectVideoCodec(messaging.MediaInfo{VideoCodec: "vp9"}, offered); c == nil || c.PayloadType != 98 {
+		t.Errorf("Did not select VP9: %v", c)
+	}
+	if c := selectVideoCodec(messaging.MediaInfo{VideoCodec: "av1"}, offered); c == nil || c.PayloadType != 45 {
+		t.Errorf("Did not select AV1: %v", c)
+	}
+	if c := selectVideoCodec(messaging.MediaInfo{VideoCodec: "vp8"}, offered); c != nil {
+		t.Errorf("Selected a codec for VP8 which viewer does not offer: %v", c)
+	}
+	if c := selectVideoCodec(messaging.MediaInfo{VideoCodec: "hevc"}, offered); c != nil {
+		t.Errorf("Selected a codec for HEVC which can not be sent: %v", c)
+	}
+}
+
+// TestFeedback connects a viewer which requests a keyframe and reports
+// losses, packets since last keyframe must be sent again
+func TestFeedback(t *testing.T) {
+	cfg := Options{Enabled: true, MinPortUDP: 10070, MaxPortUDP: 10079}
+
+	// Packets sent again are received again
+	mediaEngine := &webrtc.MediaEngine{}
+	mediaEngine.RegisterDefaultCodecs()
+	settingEngine := webrtc.SettingEngine{}
+	settingEngine.DisableSRTPReplayProtection(true)
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithSettingEngine(settingEngine))
+	peerConnection, _ := api.NewPeerConnection(webrtc.Configuration{})
+	defer peerConnection.Close()
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		init := webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}
+		if _, err := peerConnection.AddTransceiverFromKind(kind, init); err != nil {
+			t.Fatal("Failed to add transceiver", err)
+		}
+	}
+	received := make(chan *rtp.Packet, 64)
+	peerConnection.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		for {
+			packet, _, err := track.ReadRTP()
+			if err != nil {
+				return
+			}
+			received <- packet
+		}
+	})
+	connected := make(chan struct{})
+	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateConnected {
+			close(connected)
+		}
+	})
+	offer, _ := peerConnection.CreateOffer(nil)
+	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+	peerConnection.SetLocalDescription(offer)
+	<-gatherComplete
+
+	answer, id, err := Play(newDemoStreams(t), "demo", *peerConnection.LocalDescription(), &cfg, nil)
+	if err != nil {
+		t.Fatalf("Failed to play: %s", err)
+	}
+	defer Stop("demo", id)
+	if err := peerConnection.SetRemoteDescription(answer); err != nil {
+		t.Fatalf("Viewer rejected answer: %s", err)
+	}
+	s := getViewerSession("demo", id)
+	timeout := time.After(10 * time.Second)
+	select {
+	case <-connected:
+	case <-timeout:
+		t.Fatalf("Viewer did not connect")
+	}
+	for viewers.count("demo") == 0 {
+		select {
+		case <-timeout:
+			t.Fatalf("Viewer did not connect")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	// receive returns payloads and timestamps of n packets, sequence numbers
+	// must follow and timestamps must not go backwards
+	var (
+		sequence  uint16
+		timestamp uint32
+		started   bool
+	)
+	receive := func(n int) ([]byte, []uint32) {
+		payloads, timestamps := []byte{}, []uint32{}
+		for i := 0; i < n; i++ {
+			select {
+			case packet := <-received:
+				if started && packet.SequenceNumber != sequence+1 {
+					t.Errorf("Sequence number %d does not follow %d", packet.SequenceNumber, sequence)
+				}
+				if started && int32(packet.Timestamp-timestamp) < 0 {
+					t.Errorf("Timestamp %d goes back from %d", packet.Timestamp, timestamp)
+				}
+				sequence, timestamp, started = packet.SequenceNumber, packet.Timestamp, true
+				payloads = append(payloads, packet.Payload...)
+				timestamps = append(timestamps, packet.Timestamp)
+			case <-timeout:
+				t.Fatalf("Viewer did not receive packets")
+			}
+		}
+		return payloads, timestamps
+	}
+	newPacket := func(b byte, timestamp uint32) *rtp.Packet {
+		return &rtp.Packet{Header: rtp.Header{Version: 2, Timestamp: timestamp}, Payload: []byte{b}}
+	}
+
+	// Packets sent before viewer is ready are lost
+	for ready := false; !ready; {
+		writeRTP("demo", "source", []*rtp.Packet{newPacket(0, 0)}, nil, true)
+		select {
+		case <-received:
+			ready = true
+		case <-timeout:
+			t.Fatalf("Viewer did not receive packets")
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	for len(received) > 0 {
+		<-received
+	}
+
+	// Keyframe answers request of new viewer
+	gop := []*rtp.Packet{newPacket(1, 3000), newPacket(2, 3000), newPacket(3, 6000)}
+	writeRTP("demo", "source", gop[:2], nil, true)
+	writeRTP("demo", "source", gop[2:], gop[:2], true)
+	if payloads, _ := receive(3); !bytes.Equal(payloads, []byte{1, 2, 3}) {
+		t.Errorf("Viewer received %v instead of keyframe and next frame", payloads)
+	}
+
+	// Viewer lost keyframe and reports a quarter of packets lost,
+	// feedback is sent until received as RTCP may be lost too
+	loss := monitoring.WebRTCFractionLost.WithLabelValues("demo", s.number, "video")
+	ssrc := uint32(s.pc.GetSenders()[0].GetParameters().Encodings[0].SSRC)
+	for atomic.LoadInt32(&s.keyframeRequested) == 0 || testutil.ToFloat64(loss) == 0 {
+		err = peerConnection.WriteRTCP([]rtcp.Packet{
+			&rtcp.PictureLossIndication{MediaSSRC: ssrc},
+			&rtcp.ReceiverReport{Reports: []rtcp.ReceptionReport{{SSRC: ssrc, FractionLost: 64, Jitter: 9000}}},
+		})
+		if err != nil {
+			t.Fatalf("Failed to send RTCP: %s", err)
+		}
+		select {
+		case <-timeout:
+			t.Fatalf("Feedback was not received")
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	if value := testutil.ToFloat64(loss); value != 0.25 {
+		t.Errorf("Fraction lost is %f instead of 0.25", value)
+	}
+	if value := testutil.ToFloat64(monitoring.WebRTCJitter.WithLabelValues("demo", s.number, "video")); value != 0.1 {
+		t.Errorf("Jitter is %f instead of 0.1s", value)
+	}
+
+	// Frames since keyframe are sent again before next frame, keeping their
+	// spacing, packets of ingest are not modified
+	writeRTP("demo", "source", []*rtp.Packet{newPacket(4, 9000)}, gop, true)
+	payloads, timestamps := receive(4)
+	if !bytes.Equal(payloads, []byte{1, 2, 3, 4}) {
+		t.Errorf("Viewer received %v instead of keyframe and next frames", payloads)
+	}
+	if timestamps[1] != timestamps[0] || timestamps[2]-timestamps[0] != 3000 || timestamps[3]-timestamps[2] != 3000 {
+		t.Errorf("Frames sent again have timestamps %v", timestamps)
+	}
+	if gop[0].Timestamp != 3000 || gop[0].SequenceNumber != 0 {
+		t.Errorf("Packets of ingest were modified")
+	}
+
+	// Frames are sent again at most once per second
+	s.requestKeyframe()
+	writeRTP("demo", "source", []*rtp.Packet{newPacket(5, 12000)}, gop, true)
+	if payloads, _ := receive(1); payloads[0] != 5 {
+		t.Errorf("Viewer received %v instead of next frame", payloads)
+	}
+	s.lastReplay = s.lastReplay.Add(-replayInterval)
+	writeRTP("demo", "source", []*rtp.Packet{newPacket(6, 15000)}, gop, true)
+	if payloads, _ := receive(4); !bytes.Equal(payloads, []byte{1, 2, 3, 6}) {
+		t.Errorf("Viewer received %v instead of keyframe and next frames", payloads)
+	}
+
+	// Lost packet is sent again
+	for resent := false; !resent; {
+		err = peerConnection.WriteRTCP([]rtcp.Packet{
+			&rtcp.TransportLayerNack{MediaSSRC: ssrc, Nacks: []rtcp.NackPair{{PacketID: sequence}}},
+		})
+		if err != nil {
+			t.Fatalf("Failed to send RTCP: %s", err)
+		}
+		select {
+		case packet := <-received:
+			resent = packet.SequenceNumber == sequence && bytes.Equal(packet.Payload, []byte{6})
+		case <-timeout:
+			t.Fatalf("Lost packet was not sent again")
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,324 @@
+// Package webrtc provides the backend to simulate a WebRTC client to send stream
+package webrtc
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/samplebuilder"
+	"gitlab.crans.org/nounous/ghostream/internal/h264"
+	"gitlab.crans.org/nounous/ghostream/internal/mpegts"
+	"gitlab.crans.org/nounous/ghostream/messaging"
+)
+
+const (
+	// Maximum number of packets a sample builder waits for late packets
+	videoMaxLate = 512
+	audioMaxLate = 16
+
+	// Publisher is asked for a keyframe with this period
+	pliPeriod = 2 * time.Second
+)
+
+var (
+	// ErrNoVideo is returned when the publisher does not offer H.264 video
+	ErrNoVideo = errors.New("publisher does not offer H.264 video")
+
+	// ErrSessionNotFound is returned when stopping an unknown WHIP or WHEP session
+	ErrSessionNotFound = errors.New("WebRTC session not found")
+
+	// WHIP sessions by identifier
+	whipSessions = make(map[string]*whipSession)
+	whipLock     sync.Mutex
+)
+
+// whipSession receives a stream published with WHIP
+// and muxes it in MPEG-TS for other outputs
+type whipSession struct {
+	id      string
+	name    string
+	streams *messaging.Streams
+	quality *messaging.Quality
+	pc      *webrtc.PeerConnection
+
+	// Muxer writes in buffer, then buffer is broadcasted
+	lock     sync.Mutex
+	muxer    *mpegts.Muxer
+	buffer   bytes.Buffer
+	videoPID uint16
+	audioPID uint16
+	closed   bool
+	done     chan struct{}
+
+	// Keyframe requests of viewers
+	keyframeRequests chan struct{}
+
+	// Start of session, to synchronize tracks
+	started time.Time
+
+	closeOnce sync.Once
+}
+
+// Publish starts a WHIP session for a stream from the publisher offer.
+// It returns the answer and the identifier of the session.
+func Publish(streams *messaging.Streams, name string, offer SessionDescription, metadata messaging.Metadata, cfg *Options) (SessionDescription, string, error) {
+	// Create media engine with H.264 and Opus codecs of publisher
+	videoOffered, err := offeredCodecs(offer, webrtc.RTPCodecTypeVideo)
+	if err != nil {
+		return SessionDescription{}, "", err
+	}
+	audioOffered, err := offeredCodecs(offer, webrtc.RTPCodecTypeAudio)
+	if err != nil {
+		return SessionDescription{}, "", err
+	}
+	mediaEngine := &webrtc.MediaEngine{}
+	withVideo := false
+	for _, c := range videoOffered {
+		if !strings.EqualFold(c.MimeType, webrtc.MimeTypeH264) {
+			continue
+		}
+		if err := mediaEngine.RegisterCodec(c, webrtc.RTPCodecTypeVideo); err != nil {
+			return SessionDescription{}, "", err
+		}
+		withVideo = true
+	}
+	if !withVideo {
+		return SessionDescription{}, "", ErrNoVideo
+	}
+	audioCodec := selectCodec(webrtc.MimeTypeOpus, audioOffered)
+	withAudio := audioCodec != nil
+	if withAudio {
+		if err := mediaEngine.RegisterCodec(*audioCodec, webrtc.RTPCodecTypeAudio); err != nil {
+			return SessionDescription{}, "", err
+		}
+	}
+
+	// Create a new PeerConnection
+	settingsEngine, err := newSettingEngine(cfg)
+	if err != nil {
+		return SessionDescription{}, "", err
+	}
+	api := webrtc.NewAPI(
+		webrtc.WithMediaEngine(mediaEngine),
+		webrtc.WithSettingEngine(settingsEngine),
+	)
+	pc, err := api.NewPeerConnection(webrtc.Configuration{
+		ICEServers: []webrtc.ICEServer{{URLs: cfg.STUNServers}},
+	})
+	if err != nil {
+		return SessionDescription{}, "", err
+	}
+
+	// Create stream
+	metadata.Protocol = "whip"
+	_, q, err := streams.Publish(name, metadata)
+	if err != nil {
+		pc.Close()
+		return SessionDescription{}, "", err
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		pc.Close()
+		streams.Release(name)
+		return SessionDescription{}, "", err
+	}
+	s := &whipSession{
+		id:      hex.EncodeToString(id),
+		name:    name,
+		streams: streams,
+		quality: q,
+		pc:      pc,
+		done:    make(chan struct{}),
+		started: time.Now(),
+
+		keyframeRequests: make(chan struct{}, 1),
+	}
+	s.muxer = mpegts.NewMuxer(&s.buffer)
+	s.videoPID = s.muxer.AddStream(mpegts.StreamTypeH264, nil)
+	if withAudio {
+		s.audioPID = s.muxer.AddStream(mpegts.StreamTypePrivate, mpegts.OpusDescriptors(2))
+	}
+
+	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		switch track.Kind() {
+		case webrtc.RTPCodecTypeVideo:
+			go s.requestKeyframes(uint32(track.SSRC()))
+			go s.receive(track, samplebuilder.New(videoMaxLate, &codecs.H264Packet{}, 90000), s.writeVideo)
+		case webrtc.RTPCodecTypeAudio:
+			if withAudio {
+				go s.receive(track, samplebuilder.New(audioMaxLate, &codecs.OpusPacket{}, 48000), s.writeAudio)
+			}
+		}
+	})
+	pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		log.Printf("WHIP session for stream %s is %s", name, state)
+		switch state {
+		case webrtc.ICEConnectionStateFailed, webrtc.ICEConnectionStateDisconnected, webrtc.ICEConnectionStateClosed:
+			s.close()
+		}
+	})
+
+	whipLock.Lock()
+	whipSessions[s.id] = s
+	whipLock.Unlock()
+
+	// Answer offer
+	answer, err := s.answer(offer)
+	if err != nil {
+		s.close()
+		return SessionDescription{}, "", err
+	}
+	log.Printf("New WHIP streamer for stream '%s' quality 'source'", name)
+	return answer, s.id, nil
+}
+
+// Unpublish stops the WHIP session of a stream.
+func Unpublish(name, id string) error {
+	whipLock.Lock()
+	s, ok := whipSessions[id]
+	whipLock.Unlock()
+	if !ok || s.name != name {
+		return ErrSessionNotFound
+	}
+	s.close()
+	return nil
+}
+
+func (s *whipSession) answer(offer SessionDescription) (SessionDescription, error) {
+	if err := s.pc.SetRemoteDescription(offer); err != nil {
+		return SessionDescription{}, err
+	}
+	answer, err := s.pc.CreateAnswer(nil)
+	if err != nil {
+		return SessionDescription{}, err
+	}
+
+	// WHIP does not use trickle ICE, wait for all candidates
+	gatherComplete := webrtc.GatheringCompletePromise(s.pc)
+	if err := s.pc.SetLocalDescription(answer); err != nil {
+		return SessionDescription{}, err
+	}
+	<-gatherComplete
+	return *s.pc.LocalDescription(), nil
+}
+
+// close stops the session, the stream is kept a bit in case the publisher
+// reconnects.
+func (s *whipSession) close() {
+	s.closeOnce.Do(func() {
+		whipLock.Lock()
+		delete(whipSessions, s.id)
+		whipLock.Unlock()
+
+		s.lock.Lock()
+		s.closed = true
+		close(s.done)
+		s.lock.Unlock()
+
+		if err := s.pc.Close(); err != nil {
+			log.Printf("Failed to close WHIP peer connection: %s", err)
+		}
+		s.streams.Release(s.name)
+		log.Printf("WHIP streamer left stream '%s'", s.name)
+	})
+}
+
+// requestKeyframes sends picture loss indications periodically, so new
+// outputs do not wait too long for a keyframe, and for viewers requesting
+// a keyframe.
+func (s *whipSession) requestKeyframes(ssrc uint32) {
+	ticker := time.NewTicker(pliPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.keyframeRequests:
+		case <-s.done:
+			return
+		}
+		if err := s.pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: ssrc}}); err != nil {
+			log.Printf("Failed to request keyframe: %s", err)
+		}
+	}
+}
+
+// requestPublisherKeyframe asks the WHIP publisher of a stream for
+// a keyframe. It returns false if the stream is not published with WHIP.
+func requestPublisherKeyframe(name string) bool {
+	whipLock.Lock()
+	defer whipLock.Unlock()
+	for _, s := range whipSessions {
+		if s.name != name {
+			continue
+		}
+		select {
+		case s.keyframeRequests <- struct{}{}:
+		default:
+			// A request is already pending
+		}
+		return true
+	}
+	return false
+}
+
+// receive reads RTP packets of a track and writes complete samples.
+func (s *whipSession) receive(track *webrtc.TrackRemote, builder *samplebuilder.SampleBuilder, write func(data []byte, pts int64)) {
+	clock := int64(track.Codec().ClockRate)
+	var offset, elapsed int64
+	var last uint32
+	first := true
+	for {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+		if first {
+			// Position track in session timeline on first packet
+			first = false
+			offset = int64(time.Since(s.started) * 90000 / time.Second)
+			last = packet.Timestamp
+		}
+		builder.Push(packet)
+		for sample := builder.Pop(); sample != nil; sample = builder.Pop() {
+			// Follow RTP timestamp wrap around
+			elapsed += int64(int32(sample.PacketTimestamp - last))
+			last = sample.PacketTimestamp
+			write(sample.Data, offset+elapsed*90000/clock)
+		}
+	}
+}
+
+func (s *whipSession) writeVideo(data []byte, pts int64) {
+	s.write(s.videoPID, pts, h264.IsKeyframe(data), data)
+}
+
+func (s *whipSession) writeAudio(data []byte, pts int64) {
+	s.write(s.audioPID, pts, false, append(mpegts.OpusControlHeader(len(data)), data...))
+}
+
+// write muxes an access unit then broadcasts it.
+func (s *whipSession) write(pid uint16, pts int64, keyframe bool, data []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return
+	}
+	if err := s.muxer.WritePES(pid, pts, pts, keyframe, data); err != nil {
+		log.Printf("Failed to mux WHIP stream: %s", err)
+		return
+	}
+	msg := make([]byte, s.buffer.Len())
+	copy(msg, s.buffer.Bytes())
+	s.buffer.Reset()
+	s.quality.Broadcast <- msg
+}
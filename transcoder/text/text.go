@@ -27,24 +27,30 @@ func Init(streams *messaging.Streams, cfg *Options) {
 		return
 	}
 
-	// Subscribe to new stream event
-	event := make(chan string, 8)
-	streams.Subscribe(event)
+	// Subscribe to new quality event
+	event := make(chan messaging.Event, 8)
+	streams.Subscribe(event, messaging.Filter{Types: []messaging.EventType{messaging.QualityCreated}})
+
+	// For each new source quality
+	for e := range event {
+		// FIXME: make it possible to transcode other qualities
+		if e.Quality != "source" {
+			continue
+		}
+		name, qualityName := e.Stream, e.Quality
 
-	// For each new stream
-	for name := range event {
 		// Get stream
 		stream, err := streams.Get(name)
 		if err != nil {
 			log.Printf("Failed to get stream '%s'", name)
+			continue
 		}
 
 		// Get specific quality
-		// FIXME: make it possible to forward other qualities
-		qualityName := "source"
 		quality, err := stream.GetQuality(qualityName)
 		if err != nil {
 			log.Printf("Failed to get quality '%s'", qualityName)
+			continue
 		}
 
 		// Create new text quality
@@ -63,7 +69,7 @@ func Init(streams *messaging.Streams, cfg *Options) {
 func transcode(input, output *messaging.Quality, cfg *Options) {
 	// Start ffmpeg to transcode video to rawvideo
 	videoInput := make(chan []byte, 1024)
-	input.Register(videoInput)
+	input.Register(videoInput, messaging.Policy{Name: "text", Mode: messaging.DropUntilKeyframe})
 	ffmpeg, rawvideo, err := startFFmpeg(videoInput, cfg)
 	if err != nil {
 		log.Printf("Error while starting ffmpeg: %s", err)
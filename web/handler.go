@@ -15,6 +15,7 @@ import (
 
 	"github.com/markbates/pkger"
 	"gitlab.crans.org/nounous/ghostream/internal/monitoring"
+	"gitlab.crans.org/nounous/ghostream/messaging"
 	"gitlab.crans.org/nounous/ghostream/stream/ovenmediaengine"
 	"gitlab.crans.org/nounous/ghostream/stream/webrtc"
 )
@@ -29,6 +30,12 @@ var (
 
 // Handle site index and viewer pages
 func viewerHandler(w http.ResponseWriter, r *http.Request) {
+	// Players import /<stream>.m3u and /live.m3u
+	if strings.HasSuffix(r.URL.Path, ".m3u") {
+		playlistHandler(w, r)
+		return
+	}
+
 	// Validation on path
 	if validPath.FindStringSubmatch(r.URL.Path) == nil {
 		http.NotFound(w, r)
@@ -68,7 +75,17 @@ func viewerHandler(w http.ResponseWriter, r *http.Request) {
 		Path      string
 		WidgetURL string
 		OMECfg    *ovenmediaengine.Options
-	}{Path: path, Cfg: cfg, WidgetURL: "", OMECfg: omeCfg}
+		Metadata  *messaging.Metadata
+
+		// STUN and TURN servers, with credentials for this viewer
+		ICEServers []webrtc.ICEServer
+	}{Path: path, Cfg: cfg, WidgetURL: "", OMECfg: omeCfg, ICEServers: webrtc.ICEServers(rtcCfg)}
+
+	// Describe stream if it is live
+	if stream, err := streams.Get(path); err == nil {
+		metadata := stream.Metadata()
+		data.Metadata = &metadata
+	}
 
 	// Load widget is user does not disable it with ?nowidget
 	if _, ok := r.URL.Query()["nowidget"]; !ok {
@@ -142,3 +159,42 @@ func statisticsHandler(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Failed to generate JSON: %s", err)
 	}
 }
+
+func metadataHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve stream name from URL
+	name := strings.SplitN(strings.Replace(r.URL.Path[10:], "/", "", -1), "@", 2)[0]
+
+	// Get requested stream
+	stream, err := streams.Get(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Display stream metadata
+	enc := json.NewEncoder(w)
+	err = enc.Encode(stream.Metadata())
+	if err != nil {
+		http.Error(w, "Failed to generate JSON.", http.StatusInternalServerError)
+		log.Printf("Failed to generate JSON: %s", err)
+	}
+}
+
+// srtStatisticsHandler returns network statistics of SRT publishers and viewers
+func srtStatisticsHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve stream name from URL
+	name := strings.SplitN(strings.Replace(r.URL.Path[5:], "/", "", -1), "@", 2)[0]
+
+	if srtStats == nil {
+		http.Error(w, "SRT statistics are not available.", http.StatusNotFound)
+		return
+	}
+
+	// Display statistics of each link
+	enc := json.NewEncoder(w)
+	err := enc.Encode(srtStats.Links(name))
+	if err != nil {
+		http.Error(w, "Failed to generate JSON.", http.StatusInternalServerError)
+		log.Printf("Failed to generate JSON: %s", err)
+	}
+}
@@ -0,0 +1,96 @@
+// Package web serves the JavaScript player and WebRTC negotiation
+package web
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"gitlab.crans.org/nounous/ghostream/stream/hls"
+)
+
+// playlistHandler serves M3U playlists for external players.
+// /<stream>.m3u lists the qualities of a stream, /live.m3u lists every live
+// stream, configuration rejects a stream named live.
+// Each quality has a SRT, a HTTP MPEG-TS and, if packaged, a HLS URL.
+func playlistHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimSuffix(r.URL.Path[1:], ".m3u")
+	names := []string{name}
+	global := name == "live"
+	if global {
+		names = streams.Names()
+	} else if validPath.FindStringSubmatch("/"+name) == nil || strings.HasPrefix(name, "_") {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Scheme of the request, TLS may be terminated by a reverse proxy
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+
+	type entry struct {
+		protocol string
+		url      string
+	}
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	found := false
+	for _, name := range names {
+		stream, err := streams.Get(name)
+		if err != nil {
+			// Stream is not live, or ended since listing
+			continue
+		}
+		found = true
+		title := stream.Metadata().Title
+		if title == "" {
+			title = name
+		}
+		// Title ends the line
+		title = strings.NewReplacer("\n", " ", "\r", " ").Replace(title)
+
+		for _, q := range stream.Qualities() {
+			streamID := name
+			if q != "source" {
+				streamID += "@" + q
+			}
+			srtPort := cfg.SRTServerPort
+			if port, ok := cfg.SRTStreamPorts[name]; ok {
+				srtPort = port
+			}
+			entries := []entry{
+				{"SRT", fmt.Sprintf("srt://%s:%s?streamid=%s", cfg.Hostname, srtPort, streamID)},
+				{"HTTP", fmt.Sprintf("%s://%s/live/%s.ts?quality=%s", scheme, cfg.Hostname, name, q)},
+			}
+			if hls.Packaged(name, q) {
+				entries = append(entries, entry{"HLS", fmt.Sprintf("%s://%s/hls/%s/%s/index.m3u8", scheme, cfg.Hostname, name, q)})
+			}
+			for _, e := range entries {
+				fmt.Fprintf(&b, "#EXTINF:-1 tvg-id=\"%s\" group-title=\"%s\",%s (%s, %s)\n%s\n",
+					name, cfg.Name, title, q, e.protocol, e.url)
+			}
+		}
+	}
+	if !found && !global {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "audio/x-mpegurl")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"%s.m3u\"", name))
+	w.Header().Set("Cache-Control", "no-cache")
+	if _, err := w.Write([]byte(b.String())); err != nil {
+		log.Printf("Failed to write playlist of %s: %s", name, err)
+	}
+}
@@ -0,0 +1,275 @@
+// Package web serves the JavaScript player and WebRTC negotiation
+package web
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"gitlab.crans.org/nounous/ghostream/internal/demux"
+	"gitlab.crans.org/nounous/ghostream/internal/flv"
+	"gitlab.crans.org/nounous/ghostream/internal/h264"
+	"gitlab.crans.org/nounous/ghostream/internal/mpegts"
+	"gitlab.crans.org/nounous/ghostream/messaging"
+)
+
+// progressiveHandler streams a quality over HTTP, starting at a keyframe.
+// GET /live/<stream>.ts serves MPEG-TS and /live/<stream>.flv serves FLV,
+// ?quality=<name> selects the quality.
+func progressiveHandler(w http.ResponseWriter, r *http.Request) {
+	// Players are often embedded on other websites
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	file := strings.TrimPrefix(r.URL.Path, "/live/")
+	ext := path.Ext(file)
+	name := strings.TrimSuffix(file, ext)
+	var m remuxer
+	switch ext {
+	case ".ts":
+		w.Header().Set("Content-Type", "video/mp2t")
+		m = &tsRemuxer{w: w}
+	case ".flv":
+		w.Header().Set("Content-Type", "video/x-flv")
+		m = &flvRemuxer{w: w}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	qualityName := r.URL.Query().Get("quality")
+	if qualityName == "" {
+		qualityName = "source"
+	}
+
+	// Get requested stream and quality
+	stream, err := streams.Get(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	q, err := stream.GetQuality(qualityName)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Quality %s does not exist, available qualities are %s.",
+			qualityName, strings.Join(stream.Qualities(), ", ")), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	log.Printf("New HTTP viewer for stream %s quality %s", name, qualityName)
+
+	// Register new output
+	c := make(chan []byte, 1024)
+	q.Register(c, messaging.Policy{Name: "http", Mode: messaging.DropUntilKeyframe})
+	stream.IncrementClientCount()
+	defer func() {
+		q.Unregister(c)
+		stream.DecrementClientCount()
+	}()
+
+	// Send headers now, data waits for next keyframe
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	// Remux frames as the quality may be published in another format
+	demuxer := demux.New()
+	for {
+		select {
+		case data, ok := <-c:
+			if !ok || len(data) < 1 {
+				log.Print("Remove HTTP viewer because of end of stream")
+				return
+			}
+			frames := demuxer.Write(data)
+			codecs := demuxer.Codecs()
+			for _, f := range frames {
+				if err := m.writeFrame(f, codecs); err != nil {
+					log.Printf("Remove HTTP viewer because of sending error, %s", err)
+					return
+				}
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
+			log.Print("Remove HTTP viewer because it left")
+			return
+		}
+	}
+}
+
+// remuxer writes frames in a container, starting at a keyframe
+type remuxer interface {
+	// writeFrame writes a frame, codecs are those of the streams found
+	// by the demuxer, tracks are declared from them
+	writeFrame(f demux.Frame, codecs []string) error
+}
+
+// isStart returns true if a remuxer can start at this frame, which is a
+// video keyframe or audio if there is no video
+func isStart(f demux.Frame, codecs []string) bool {
+	if f.IsVideo() {
+		return f.Keyframe
+	}
+	for _, codec := range codecs {
+		if demux.IsVideoCodec(codec) {
+			return false
+		}
+	}
+	return true
+}
+
+// tsRemuxer writes frames in MPEG-TS
+type tsRemuxer struct {
+	w     io.Writer
+	muxer *mpegts.Muxer
+
+	// PID of each track by codec
+	pids map[string]uint16
+}
+
+func (m *tsRemuxer) writeFrame(f demux.Frame, codecs []string) error {
+	if m.muxer == nil {
+		if !isStart(f, codecs) {
+			return nil
+		}
+		m.muxer = mpegts.NewMuxer(m.w)
+		m.pids = make(map[string]uint16)
+		for _, codec := range codecs {
+			m.addStream(codec)
+		}
+	}
+
+	pid, ok := m.pids[f.Codec]
+	if !ok {
+		// Streams found later are announced in new tables
+		if pid, ok = m.addStream(f.Codec); !ok {
+			return nil
+		}
+	}
+	data := f.Data
+	switch f.Codec {
+	case "aac":
+		data = append(demux.ADTSHeader(f.Config, len(f.Data)), f.Data...)
+	case "opus":
+		data = append(mpegts.OpusControlHeader(len(f.Data)), f.Data...)
+	}
+	return m.muxer.WritePES(pid, f.PTS, f.DTS, f.Keyframe, data)
+}
+
+// addStream declares the track of a codec, it returns false if the codec
+// can not be carried
+func (m *tsRemuxer) addStream(codec string) (uint16, bool) {
+	switch codec {
+	case "h264":
+		m.pids[codec] = m.muxer.AddStream(mpegts.StreamTypeH264, nil)
+	case "hevc":
+		m.pids[codec] = m.muxer.AddStream(mpegts.StreamTypeH265, nil)
+	case "mpeg2video":
+		m.pids[codec] = m.muxer.AddStream(mpegts.StreamTypeMPEG2Video, nil)
+	case "aac":
+		m.pids[codec] = m.muxer.AddStream(mpegts.StreamTypeADTSAAC, nil)
+	case "mp3":
+		m.pids[codec] = m.muxer.AddStream(mpegts.StreamTypeMPEG1Audio, nil)
+	case "opus":
+		m.pids[codec] = m.muxer.AddStream(mpegts.StreamTypePrivate, mpegts.OpusDescriptors(2))
+	default:
+		return 0, false
+	}
+	return m.pids[codec], true
+}
+
+// flvRemuxer writes H.264, AAC and MP3 frames in FLV
+type flvRemuxer struct {
+	w       io.Writer
+	started bool
+
+	// Timestamps start at zero
+	start int64
+
+	video      bool
+	audioCodec string
+
+	// Codec configurations already sent
+	sps, pps  []byte
+	aacConfig []byte
+}
+
+func (m *flvRemuxer) writeFrame(f demux.Frame, codecs []string) error {
+	if !m.started {
+		if !isStart(f, codecs) {
+			return nil
+		}
+
+		// FLV header declares tracks once, later streams are dropped
+		m.started = true
+		m.start = f.DTS
+		for _, codec := range codecs {
+			switch {
+			case codec == "h264":
+				m.video = true
+			case (codec == "aac" || codec == "mp3") && m.audioCodec == "":
+				m.audioCodec = codec
+			}
+		}
+		if _, err := m.w.Write(flv.Header(m.audioCodec != "", m.video)); err != nil {
+			return err
+		}
+	}
+
+	// Milliseconds since start, audio can start a bit before video
+	var timestamp uint32
+	if f.DTS > m.start {
+		timestamp = uint32((f.DTS - m.start) / 90)
+	}
+
+	switch {
+	case f.Codec == "h264" && m.video:
+		if f.Keyframe {
+			sps, pps := h264.ParameterSets(f.Data)
+			if sps != nil && pps != nil && (!bytes.Equal(sps, m.sps) || !bytes.Equal(pps, m.pps)) {
+				m.sps, m.pps = sps, pps
+				header := append([]byte{0x17, 0, 0, 0, 0}, h264.DecoderConfig(sps, pps)...)
+				if err := m.writeTag(flv.TagTypeVideo, timestamp, header); err != nil {
+					return err
+				}
+			}
+		}
+		if m.sps == nil {
+			// Decoder is not configured yet
+			return nil
+		}
+		frameType := byte(0x27)
+		if f.Keyframe {
+			frameType = 0x17
+		}
+		cts := (f.PTS - f.DTS) / 90
+		data := append([]byte{frameType, 1, byte(cts >> 16), byte(cts >> 8), byte(cts)}, h264.ToAVCC(f.Data)...)
+		return m.writeTag(flv.TagTypeVideo, timestamp, data)
+	case f.Codec == "aac" && m.audioCodec == "aac":
+		if !bytes.Equal(f.Config, m.aacConfig) {
+			m.aacConfig = f.Config
+			if err := m.writeTag(flv.TagTypeAudio, timestamp, append([]byte{0xaf, 0}, f.Config...)); err != nil {
+				return err
+			}
+		}
+		return m.writeTag(flv.TagTypeAudio, timestamp, append([]byte{0xaf, 1}, f.Data...))
+	case f.Codec == "mp3" && m.audioCodec == "mp3":
+		// Decoders read sampling rate and channels from MP3 frames
+		return m.writeTag(flv.TagTypeAudio, timestamp, append([]byte{0x2f}, f.Data...))
+	}
+	return nil
+}
+
+func (m *flvRemuxer) writeTag(tagType byte, timestamp uint32, data []byte) error {
+	_, err := m.w.Write(flv.Tag(tagType, timestamp, data))
+	return err
+}
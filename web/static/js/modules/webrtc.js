@@ -3,15 +3,15 @@
  */
 export class GsWebRTC {
     /**
-     * @param {list} stunServers STUN servers
+     * @param {list} iceServers STUN and TURN servers
      * @param {HTMLElement} viewer Video HTML element
      * @param {HTMLElement} connectionIndicator Connection indicator element
      */
-    constructor(stunServers, viewer, connectionIndicator) {
+    constructor(iceServers, viewer, connectionIndicator) {
         this.viewer = viewer;
         this.connectionIndicator = connectionIndicator;
         this.pc = new RTCPeerConnection({
-            iceServers: [{ urls: stunServers }]
+            iceServers: iceServers
         });
 
         // We want to receive audio and video
@@ -63,27 +63,25 @@ export class GsWebRTC {
     /**
      * Create an offer and set local description.
      * After that the browser will fire onicecandidate events.
+     * @param {Function} sendFunction Called with the local description to send.
      */
-    createOffer() {
+    createOffer(sendFunction) {
         this.pc.createOffer().then(offer => {
             this.pc.setLocalDescription(offer);
-            console.log("[WebRTC] WebRTC offer created");
+            console.log("[WebRTC] WebRTC offer created, sending it to server");
+            sendFunction(offer);
         }).catch(console.log);
     }
 
     /**
-     * Register a function to call to send local descriptions
-     * @param {Function} sendFunction Called with a local description to send.
+     * Register a function to call to send local ICE candidates
+     * @param {Function} sendFunction Called with each local candidate to send.
      */
     onICECandidate(sendFunction) {
-        // When candidate is null, ICE layer has run out of potential configurations to suggest
-        // so let's send the offer to the server.
-        // FIXME: Send offers progressively to do Trickle ICE
         this.pc.onicecandidate = event => {
-            if (event.candidate === null) {
-                // Send offer to server
-                console.log("[WebRTC] Sending session description to server");
-                sendFunction(this.pc.localDescription);
+            // When candidate is null, ICE layer has run out of potential configurations to suggest
+            if (event.candidate !== null) {
+                sendFunction(event.candidate);
             }
         };
     }
@@ -96,4 +94,12 @@ export class GsWebRTC {
     setRemoteDescription(sdp) {
         this.pc.setRemoteDescription(sdp);
     }
+
+    /**
+     * Add a remote ICE candidate
+     * @param {RTCIceCandidateInit} candidate Candidate received from server
+     */
+    addIceCandidate(candidate) {
+        this.pc.addIceCandidate(candidate).catch(console.log);
+    }
 }
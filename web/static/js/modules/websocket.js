@@ -48,15 +48,59 @@ export class GsWebSocket {
         }));
     }
 
+    /**
+     * Send local ICE candidate to remote.
+     * @param {RTCIceCandidate} candidate WebRTC local candidate
+     */
+    sendCandidate(candidate) {
+        if (this.socket.readyState !== 1) {
+            setTimeout(() => this.sendCandidate(candidate), 100);
+            return;
+        }
+        this.socket.send(JSON.stringify({
+            "candidate": candidate
+        }));
+    }
+
     /**
      * Set callback function on new remote session description.
      * @param {Function} callback Function called when data is received
      */
     onRemoteDescription(callback) {
         this.socket.addEventListener("message", (event) => {
+            const data = JSON.parse(event.data);
+            if ("candidate" in data || "error" in data) {
+                return;
+            }
             console.log("[WebSocket] Received WebRTC remote session description");
-            const sdp = new RTCSessionDescription(JSON.parse(event.data));
-            callback(sdp);
+            callback(new RTCSessionDescription(data));
+        });
+    }
+
+    /**
+     * Set callback function on new remote ICE candidate.
+     * @param {Function} callback Function called when a candidate is received
+     */
+    onRemoteCandidate(callback) {
+        this.socket.addEventListener("message", (event) => {
+            const data = JSON.parse(event.data);
+            if ("candidate" in data) {
+                callback(data.candidate);
+            }
+        });
+    }
+
+    /**
+     * Set callback function when remote could not start a session.
+     * @param {Function} callback Function called with the error message
+     */
+    onError(callback) {
+        this.socket.addEventListener("message", (event) => {
+            const data = JSON.parse(event.data);
+            if ("error" in data) {
+                console.log(`[WebSocket] Session failed: ${data.error}`);
+                callback(data.error);
+            }
         });
     }
 }
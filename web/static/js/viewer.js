@@ -6,10 +6,10 @@ import { GsWebRTC } from "./modules/webrtc.js";
  * Initialize viewer page
  * 
  * @param {String} stream 
- * @param {List} stunServers 
+ * @param {List} iceServers STUN and TURN servers
  * @param {Number} viewersCounterRefreshPeriod 
  */
-export function initViewerPage(stream, stunServers, viewersCounterRefreshPeriod) {
+export function initViewerPage(stream, iceServers, viewersCounterRefreshPeriod) {
     // Viewer element
     const viewer = document.getElementById("viewer");
 
@@ -19,17 +19,29 @@ export function initViewerPage(stream, stunServers, viewersCounterRefreshPeriod)
     // Create WebSocket and WebRTC
     const websocket = new GsWebSocket();
     const webrtc = new GsWebRTC(
-        stunServers,
+        iceServers,
         viewer,
         document.getElementById("connectionIndicator"),
     );
-    webrtc.createOffer();
-    webrtc.onICECandidate(localDescription => {
+    const sendOffer = localDescription => {
         websocket.sendLocalDescription(localDescription, stream, quality);
+    };
+    webrtc.onICECandidate(candidate => {
+        websocket.sendCandidate(candidate);
     });
+    webrtc.createOffer(sendOffer);
+    const error = document.getElementById("error");
     websocket.onRemoteDescription(sdp => {
+        error.hidden = true;
         webrtc.setRemoteDescription(sdp);
     });
+    websocket.onError(message => {
+        error.textContent = message;
+        error.hidden = false;
+    });
+    websocket.onRemoteCandidate(candidate => {
+        webrtc.addIceCandidate(candidate);
+    });
 
     // Register keyboard events
     window.addEventListener("keydown", (event) => {
@@ -82,6 +94,6 @@ export function initViewerPage(stream, stunServers, viewersCounterRefreshPeriod)
         console.log(`Stream quality changed to ${quality}`);
 
         // Restart WebRTC negociation
-        webrtc.createOffer();
+        webrtc.createOffer(sendOffer);
     });
 }
@@ -2,7 +2,6 @@
 package web
 
 import (
-	"gitlab.crans.org/nounous/ghostream/stream/ovenmediaengine"
 	"html/template"
 	"io/ioutil"
 	"log"
@@ -11,7 +10,12 @@ import (
 	"strings"
 
 	"github.com/markbates/pkger"
+	"gitlab.crans.org/nounous/ghostream/auth"
 	"gitlab.crans.org/nounous/ghostream/messaging"
+	"gitlab.crans.org/nounous/ghostream/stream/dash"
+	"gitlab.crans.org/nounous/ghostream/stream/hls"
+	"gitlab.crans.org/nounous/ghostream/stream/ovenmediaengine"
+	"gitlab.crans.org/nounous/ghostream/stream/webrtc"
 )
 
 // Options holds web package configuration
@@ -25,7 +29,7 @@ type Options struct {
 	MapDomainToStream           map[string]string
 	PlayerPoster                string
 	SRTServerPort               string
-	STUNServers                 []string
+	SRTStreamPorts              map[string]string
 	ViewersCounterRefreshPeriod int
 	WidgetURL                   string
 	LegalMentionsEntity         string
@@ -34,11 +38,25 @@ type Options struct {
 	LegalMentionsEmail          string
 }
 
+// LinkStatistics gives network statistics of the links of streams
+type LinkStatistics interface {
+	// Links returns statistics of a stream, or of all streams if name is empty
+	Links(name string) interface{}
+}
+
 var (
 	cfg *Options
 
 	omeCfg *ovenmediaengine.Options
 
+	rtcCfg *webrtc.Options
+
+	// Authentification backend of WHIP publishers
+	authBackend auth.Backend
+
+	// Network statistics of SRT links, nil if unavailable
+	srtStats LinkStatistics
+
 	// Preload templates
 	templates *template.Template
 
@@ -77,10 +95,13 @@ func loadTemplates() error {
 }
 
 // Serve HTTP server
-func Serve(s *messaging.Streams, c *Options, ome *ovenmediaengine.Options) {
+func Serve(s *messaging.Streams, a auth.Backend, ls LinkStatistics, c *Options, ome *ovenmediaengine.Options, rtc *webrtc.Options) {
 	streams = s
+	authBackend = a
+	srtStats = ls
 	cfg = c
 	omeCfg = ome
+	rtcCfg = rtc
 
 	if !cfg.Enabled {
 		// Web server is not enabled, ignore
@@ -98,6 +119,13 @@ func Serve(s *messaging.Streams, c *Options, ome *ovenmediaengine.Options) {
 	mux.Handle("/static/", staticHandler())
 	mux.HandleFunc("/_ws/", websocketHandler)
 	mux.HandleFunc("/_stats/", statisticsHandler)
+	mux.HandleFunc("/_metadata/", metadataHandler)
+	mux.HandleFunc("/_srt/", srtStatisticsHandler)
+	mux.HandleFunc("/whip/", whipHandler)
+	mux.HandleFunc("/whep/", whepHandler)
+	mux.HandleFunc("/live/", progressiveHandler)
+	mux.HandleFunc("/hls/", hls.Handle)
+	mux.HandleFunc("/dash/", dash.Handle)
 	log.Printf("HTTP server listening on %s", cfg.ListenAddress)
 	log.Fatal(http.ListenAndServe(cfg.ListenAddress, mux))
 }
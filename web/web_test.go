@@ -6,15 +6,17 @@ import (
 	"time"
 
 	"gitlab.crans.org/nounous/ghostream/messaging"
+	"gitlab.crans.org/nounous/ghostream/stream/ovenmediaengine"
+	"gitlab.crans.org/nounous/ghostream/stream/webrtc"
 )
 
 // TestHTTPServe tries to serve a real HTTP server and load some pages
 func TestHTTPServe(t *testing.T) {
 	// Init streams messaging
-	streams := messaging.New()
+	streams := messaging.New(&messaging.Options{})
 
 	// Create a disabled web server
-	go Serve(streams, &Options{Enabled: false, ListenAddress: "127.0.0.1:8081"})
+	go Serve(streams, nil, nil, &Options{Enabled: false, ListenAddress: "127.0.0.1:8081"}, &ovenmediaengine.Options{}, &webrtc.Options{})
 
 	// Sleep 500ms to ensure that the web server is running, to avoid fails because the request came too early
 	time.Sleep(500 * time.Millisecond)
@@ -26,7 +28,7 @@ func TestHTTPServe(t *testing.T) {
 	}
 
 	// Now let's really start the web server
-	go Serve(streams, &Options{Enabled: true, ListenAddress: "127.0.0.1:8081"})
+	go Serve(streams, nil, nil, &Options{Enabled: true, ListenAddress: "127.0.0.1:8081"}, &ovenmediaengine.Options{}, &webrtc.Options{})
 
 	// Sleep 500ms to ensure that the web server is running, to avoid fails because the request came too early
 	time.Sleep(500 * time.Millisecond)
@@ -4,6 +4,8 @@ package web
 import (
 	"log"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"gitlab.crans.org/nounous/ghostream/stream/webrtc"
@@ -14,14 +16,29 @@ var upgrader = websocket.Upgrader{
 	WriteBufferSize: 1024,
 }
 
-// clientDescription is sent by new client
-type clientDescription struct {
+// Time to send a message to a client before giving up
+const websocketWriteTimeout = 10 * time.Second
+
+// clientMessage is sent by client, either a description to start a
+// session or an ICE candidate of this session
+type clientMessage struct {
 	WebRtcSdp webrtc.SessionDescription
 	Stream    string
 	Quality   string
+	Candidate *webrtc.ICECandidateInit
+}
+
+// candidateMessage sends a local ICE candidate to client
+type candidateMessage struct {
+	Candidate *webrtc.ICECandidateInit `json:"candidate"`
 }
 
-// websocketHandler exchanges WebRTC SDP and viewer count
+// errorMessage tells client why its session could not start
+type errorMessage struct {
+	Error string `json:"error"`
+}
+
+// websocketHandler exchanges WebRTC SDP and ICE candidates
 func websocketHandler(w http.ResponseWriter, r *http.Request) {
 	// Upgrade client connection to WebSocket
 	conn, err := upgrader.Upgrade(w, r, nil)
@@ -30,16 +47,53 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Current session of client, lock also serializes writes
+	var (
+		lock     sync.Mutex
+		name, id string
+	)
+	// Lock must be held to send
+	send := func(v interface{}) error {
+		_ = conn.SetWriteDeadline(time.Now().Add(websocketWriteTimeout))
+		return conn.WriteJSON(v)
+	}
+	stop := func() {
+		lock.Lock()
+		defer lock.Unlock()
+		if id != "" {
+			_ = webrtc.Stop(name, id)
+			id = ""
+		}
+	}
+	defer stop()
+
 	for {
-		// Get client description
-		c := &clientDescription{}
+		// Get client message
+		c := &clientMessage{}
 		err = conn.ReadJSON(c)
 		if err != nil {
-			log.Printf("Failed to receive client description: %s", err)
+			log.Printf("Failed to receive client message: %s", err)
 			_ = conn.Close()
 			return
 		}
 
+		// Add remote candidate to current session
+		if c.Candidate != nil {
+			lock.Lock()
+			if id != "" {
+				if err := webrtc.AddCandidate(name, id, *c.Candidate); err != nil {
+					log.Printf("Failed to add ICE candidate: %s", err)
+				}
+			}
+			lock.Unlock()
+			continue
+		}
+
+		if !rtcCfg.Enabled {
+			log.Printf("WebRTC is disabled, ignoring session description")
+			continue
+		}
+
 		// Get requested stream
 		stream, err := streams.Get(c.Stream)
 		if err != nil {
@@ -48,21 +102,64 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Get requested quality
-		q, err := stream.GetQuality(c.Quality)
-		if err != nil {
+		if _, err := stream.GetQuality(c.Quality); err != nil {
 			log.Printf("Quality not found: %s", c.Quality)
 			continue
 		}
 
-		// Exchange session descriptions with WebRTC stream server
-		// FIXME: Add trickle ICE support
-		q.WebRtcRemoteSdp <- c.WebRtcSdp
-		localDescription := <-q.WebRtcLocalSdp
+		// A new description replaces current session
+		stop()
 
-		// Send new local description
-		if err := conn.WriteJSON(localDescription); err != nil {
-			log.Println(err)
+		// Local candidates are sent after the answer, those gathered
+		// before wait in pending. Gathering must not be blocked.
+		sessionName := c.Stream + "@" + c.Quality
+		var (
+			sessionID string
+			answered  bool
+			pending   []*webrtc.ICECandidateInit
+		)
+		localDescription, sessionID, err := webrtc.Play(streams, sessionName, c.WebRtcSdp, rtcCfg, func(candidate *webrtc.ICECandidateInit) {
+			lock.Lock()
+			defer lock.Unlock()
+			if candidate == nil {
+				return
+			}
+			if !answered {
+				pending = append(pending, candidate)
+				return
+			}
+			if id != sessionID {
+				return
+			}
+			if err := send(candidateMessage{candidate}); err != nil {
+				log.Printf("Failed to send ICE candidate: %s", err)
+			}
+		})
+		if err == webrtc.ErrNoCodec {
+			lock.Lock()
+			if err := send(errorMessage{err.Error()}); err != nil {
+				log.Println(err)
+			}
+			lock.Unlock()
 			continue
+		} else if err != nil {
+			log.Printf("Failed to start WebRTC session: %s", err)
+			continue
+		}
+
+		// Send new local description, then pending candidates
+		lock.Lock()
+		name, id = sessionName, sessionID
+		answered = true
+		if err := send(localDescription); err != nil {
+			log.Println(err)
+		}
+		for _, candidate := range pending {
+			if err := send(candidateMessage{candidate}); err != nil {
+				log.Printf("Failed to send ICE candidate: %s", err)
+			}
 		}
+		pending = nil
+		lock.Unlock()
 	}
 }
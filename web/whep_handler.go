@@ -0,0 +1,116 @@
+// Package web serves the JavaScript player and WebRTC negotiation
+package web
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	"gitlab.crans.org/nounous/ghostream/stream/webrtc"
+)
+
+// whepHandler lets viewers play streams with WebRTC.
+// POST /whep/<stream> with a SDP offer starts a session,
+// PATCH on the returned location exchanges trickle ICE candidates
+// and DELETE stops it.
+func whepHandler(w http.ResponseWriter, r *http.Request) {
+	// Players may be web pages from other origins
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, PATCH, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, If-Match")
+	w.Header().Set("Access-Control-Expose-Headers", "Location")
+
+	if !rtcCfg.Enabled {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Path is /whep/<stream> or /whep/<stream>/<session>
+	split := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/whep/"), "/", 2)
+	name := split[0]
+	if validPath.FindStringSubmatch("/"+name) == nil || name == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodOptions:
+		w.Header().Set("Accept-Post", "application/sdp")
+		w.Header().Set("Accept-Patch", "application/trickle-ice-sdpfrag")
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && len(split) == 1:
+		whepPlay(w, r, name)
+	case r.Method == http.MethodPatch && len(split) == 2:
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/trickle-ice-sdpfrag") {
+			http.Error(w, "Unsupported media type.", http.StatusUnsupportedMediaType)
+			return
+		}
+		fragment, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxOfferSize))
+		if err != nil {
+			http.Error(w, "Failed to read candidates.", http.StatusBadRequest)
+			return
+		}
+		local, err := webrtc.AddCandidates(name, split[1], string(fragment))
+		if err == webrtc.ErrSessionNotFound {
+			http.NotFound(w, r)
+		} else if err != nil {
+			log.Printf("Failed to add WHEP candidates for stream %s: %s", name, err)
+			http.Error(w, "Invalid candidates.", http.StatusBadRequest)
+		} else if local == "" {
+			w.WriteHeader(http.StatusNoContent)
+		} else {
+			// Send back candidates gathered since the answer
+			w.Header().Set("Content-Type", "application/trickle-ice-sdpfrag")
+			if _, err := w.Write([]byte(local)); err != nil {
+				log.Printf("Failed to send WHEP candidates: %s", err)
+			}
+		}
+	case r.Method == http.MethodDelete && len(split) == 2:
+		if err := webrtc.Stop(name, split[1]); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+	}
+}
+
+func whepPlay(w http.ResponseWriter, r *http.Request, name string) {
+	// Stream must be live, name may select a quality with "stream@quality"
+	if _, err := streams.Get(strings.SplitN(name, "@", 2)[0]); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/sdp") {
+		http.Error(w, "Unsupported media type.", http.StatusUnsupportedMediaType)
+		return
+	}
+	offer, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxOfferSize))
+	if err != nil {
+		http.Error(w, "Failed to read offer.", http.StatusBadRequest)
+		return
+	}
+
+	answer, id, err := webrtc.Play(streams, name, webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  string(offer),
+	}, rtcCfg, nil)
+	if err == webrtc.ErrNoCodec {
+		http.Error(w, "No supported video codec.", http.StatusNotAcceptable)
+		return
+	} else if err != nil {
+		log.Printf("Failed to start WHEP session for stream %s: %s", name, err)
+		http.Error(w, "Failed to start session.", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", "/whep/"+name+"/"+id)
+	w.WriteHeader(http.StatusCreated)
+	if _, err := w.Write([]byte(answer.SDP)); err != nil {
+		log.Printf("Failed to send WHEP answer: %s", err)
+	}
+}
@@ -0,0 +1,110 @@
+// Package web serves the JavaScript player and WebRTC negotiation
+package web
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	"gitlab.crans.org/nounous/ghostream/auth"
+	"gitlab.crans.org/nounous/ghostream/messaging"
+	"gitlab.crans.org/nounous/ghostream/stream/webrtc"
+)
+
+// Maximum size of a publisher offer
+const maxOfferSize = 64 * 1024
+
+// whipHandler lets publishers stream with WebRTC.
+// POST /whip/<stream> with a SDP offer starts a session,
+// DELETE on the returned location stops it.
+func whipHandler(w http.ResponseWriter, r *http.Request) {
+	// Publishers may be web pages from other origins
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	w.Header().Set("Access-Control-Expose-Headers", "Location")
+
+	if !rtcCfg.WHIP {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Path is /whip/<stream> or /whip/<stream>/<session>
+	split := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/whip/"), "/", 2)
+	name := split[0]
+	if validPath.FindStringSubmatch("/"+name) == nil || name == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodOptions:
+		w.Header().Set("Accept-Post", "application/sdp")
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && len(split) == 1:
+		whipPublish(w, r, name)
+	case r.Method == http.MethodDelete && len(split) == 2:
+		if err := webrtc.Unpublish(name, split[1]); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+	}
+}
+
+func whipPublish(w http.ResponseWriter, r *http.Request, name string) {
+	// Bearer token is the stream password
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if authBackend != nil {
+		if ok, err := authBackend.Login(name, token); !ok || err != nil {
+			log.Printf("Failed to authenticate for stream %s", name)
+			http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/sdp") {
+		http.Error(w, "Unsupported media type.", http.StatusUnsupportedMediaType)
+		return
+	}
+	offer, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxOfferSize))
+	if err != nil {
+		http.Error(w, "Failed to read offer.", http.StatusBadRequest)
+		return
+	}
+
+	// Describe stream with publisher information
+	info := auth.Info(authBackend, name)
+	metadata := messaging.Metadata{
+		Title:       info.DisplayName,
+		Description: info.Description,
+		Publisher:   info.Username,
+		RemoteAddr:  r.RemoteAddr,
+	}
+
+	answer, id, err := webrtc.Publish(streams, name, webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  string(offer),
+	}, metadata, rtcCfg)
+	if err != nil {
+		log.Printf("Failed to start WHIP session for stream %s: %s", name, err)
+		if err == webrtc.ErrNoVideo {
+			http.Error(w, "Publisher must send H.264 video.", http.StatusBadRequest)
+		} else if _, getErr := streams.Get(name); getErr == nil {
+			http.Error(w, "Stream is already published.", http.StatusConflict)
+		} else {
+			http.Error(w, "Failed to start session.", http.StatusBadRequest)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", "/whip/"+name+"/"+id)
+	w.WriteHeader(http.StatusCreated)
+	if _, err := w.Write([]byte(answer.SDP)); err != nil {
+		log.Printf("Failed to send WHIP answer: %s", err)
+	}
+}